@@ -0,0 +1,53 @@
+// Command migrate-images moves base64 data-URI images stored in the wines
+// table into the configured storage backend. It is safe to interrupt and
+// re-run; only wines that still hold inline images are processed.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"wine-cellar/internal/features/images"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/storage"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	batchSize := flag.Int("batch", 50, "wines loaded per query")
+	limit := flag.Int("limit", 0, "stop after this many wines (0 = all)")
+	startAfter := flag.Uint("start-after", 0, "skip wines with an ID up to and including this one")
+	dryRun := flag.Bool("dry-run", false, "validate images without uploading or updating rows")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found")
+	}
+
+	database.InitDB()
+	storage.Init()
+
+	// Finish the current wine on Ctrl-C instead of dying mid-upload
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := images.MigrateInlineImages(ctx, database.DB, images.MigrationOptions{
+		BatchSize:  *batchSize,
+		Limit:      *limit,
+		StartAfter: uint(*startAfter),
+		DryRun:     *dryRun,
+	}, log.Printf)
+
+	log.Printf("Scanned %d, migrated %d, skipped %d, failed %d (last wine ID %d)", report.Scanned, report.Migrated, report.Skipped, report.Failed, report.LastID)
+	if err != nil {
+		log.Printf("Stopped early: %v (resume with -start-after=%d or simply re-run)", err, report.LastID)
+		os.Exit(1)
+	}
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
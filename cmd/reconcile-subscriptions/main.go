@@ -0,0 +1,50 @@
+// Command reconcile-subscriptions compares every customer's subscription with
+// Stripe and fixes users whose tier or status drifted, e.g. after webhooks
+// were missed. With -dry-run the discrepancies are only reported.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"wine-cellar/internal/features/subscription"
+	"wine-cellar/internal/shared/database"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	customer := flag.String("customer", "", "only check this Stripe customer ID")
+	dryRun := flag.Bool("dry-run", false, "report discrepancies without fixing them")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found")
+	}
+
+	database.InitDB()
+	subscription.Init()
+	if subscription.Fake() != nil {
+		log.Fatal("The fake billing provider only lives inside the app; its reconciliation job covers it")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := subscription.Reconcile(ctx, database.DB, subscription.ReconcileOptions{
+		CustomerID: *customer,
+		DryRun:     *dryRun,
+	}, log.Printf)
+
+	log.Printf("Checked %d, drifted %d, fixed %d, failed %d",
+		report.Checked, report.Drifted, report.Fixed, report.Failed)
+	if err != nil {
+		log.Fatalf("Reconciliation stopped: %v", err)
+	}
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,60 @@
+// Command replay-webhooks processes stored Stripe webhook events again, in
+// the order Stripe created them. Use it after fixing a bug in how an event
+// type is handled. With -dry-run the selected events are only listed. Only
+// state is replayed; users are emailed again with -send-emails.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"wine-cellar/internal/features/subscription"
+	"wine-cellar/internal/shared/database"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	eventID := flag.String("id", "", "only replay the event with this ID")
+	eventType := flag.String("type", "", "only replay events of this type, e.g. customer.subscription.updated")
+	customer := flag.String("customer", "", "only replay events for this Stripe customer ID")
+	since := flag.Duration("since", 0, "only replay events created within this duration, e.g. 72h")
+	dryRun := flag.Bool("dry-run", false, "list the events without processing them")
+	sendEmails := flag.Bool("send-emails", false, "send the billing emails the events trigger, e.g. payment failed")
+	flag.Parse()
+
+	if *eventID == "" && *eventType == "" && *customer == "" && *since == 0 {
+		log.Fatal("Select events with at least one of -id, -type, -customer or -since")
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found")
+	}
+
+	database.InitDB()
+	subscription.Init()
+
+	opts := subscription.ReplayOptions{
+		EventID:    *eventID,
+		Type:       *eventType,
+		CustomerID: *customer,
+		DryRun:     *dryRun,
+		SendEmails: *sendEmails,
+	}
+	if *since > 0 {
+		opts.Since = time.Now().Add(-*since)
+	}
+
+	report, err := subscription.ReplayEvents(database.DB, opts, log.Printf)
+	if err != nil {
+		log.Fatalf("Replay stopped: %v", err)
+	}
+
+	log.Printf("Selected %d, processed %d, stale %d, ignored %d, failed %d",
+		report.Selected, report.Processed, report.Stale, report.Ignored, report.Failed)
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,49 @@
+// Command storage-gc deletes stored images that no wine references. With
+// -dry-run the orphans are moved under quarantine/ instead of deleted.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"wine-cellar/internal/features/images"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/storage"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	grace := flag.Duration("grace", images.DefaultGracePeriod, "never touch objects younger than this")
+	prefix := flag.String("prefix", "wines/", "only consider objects under this prefix")
+	dryRun := flag.Bool("dry-run", false, "quarantine orphans instead of deleting them")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found")
+	}
+
+	database.InitDB()
+	storage.Init()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := images.CollectGarbage(ctx, database.DB, storage.Default(), images.GCOptions{
+		Prefix:      *prefix,
+		GracePeriod: *grace,
+		DryRun:      *dryRun,
+	}, log.Printf)
+
+	log.Printf("Scanned %d, referenced %d, within grace period %d, deleted %d, quarantined %d, failed %d",
+		report.Scanned, report.Referenced, report.Young, report.Deleted, report.Quarantined, report.Failed)
+	if err != nil {
+		log.Fatalf("Garbage collection stopped: %v", err)
+	}
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -1,6 +1,8 @@
 package domain
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
@@ -11,8 +13,25 @@ type User struct {
 	Currency           string `gorm:"default:'USD'"`
 	SubscriptionTier   string `gorm:"default:'free'"` // "free" or "pro"
 	StripeCustomerID   string
+	CheckoutSessionID  string // Last checkout started, to find its customer if the webhook was missed
 	SubscriptionStatus string // "active", "past_due", "canceled", etc.
 	SubscriptionID     string
+	StripePriceID      string // Price of the Stripe subscription
+	BillingInterval    string // "month" or "year", empty without a subscription
+	PaymentFailedAt    *time.Time // First failed payment since the subscription was last paid
+	GraceEndsAt        *time.Time // Pro is kept until then while a payment is failing
+	PaymentNotifiedFor string // Invoice and attempt of the last failed payment email, e.g. "in_123#2"
+	CalendarToken      string `gorm:"index"` // Secret token for the ICS feed, empty when disabled
+	DeletionDueAt      *time.Time // Set while an account erasure is pending
+	EmailVerified      bool       `gorm:"default:false"`
+	EmailVerifiedAt    *time.Time
+	TOTPSecret         string // Base32 secret, only set while two-factor authentication is enabled
+	TOTPEnabled        bool   `gorm:"default:false"`
+	TOTPLastCounter    int64  // Last accepted time step, so a code cannot be replayed
+	PasskeyHandle      string `gorm:"index"` // Random WebAuthn user handle, set with the first passkey
+	Role               string `gorm:"default:'user'"` // "user" or "admin"
+	DisabledAt         *time.Time // Set while an admin has disabled the account
+	DisabledReason     string
 }
 
 type Wine struct {
@@ -31,14 +50,18 @@ type Wine struct {
 	Location       string
 	Rating         string
 	DrinkingWindow string
+	DeliveryDate   string // Expected delivery date (YYYY-MM-DD), empty if already in the cellar
 	Notes          string
-	ImageURL       string
+	ImageURL       string // Storage key (see storage.PublicURL); older rows may hold a full URL
+	ThumbnailURL   string // Storage key of the small rendition used by the list view
 	Type           string  `json:"type"`
 	Category       string  `json:"category"`
 	SubCategory    string  `json:"sub_category"`
 	BottleSize     string  `gorm:"default:'75cl'"`
 	Reviews        []Review
 	TastingNotes   []TastingNote
+	TastingEvents  []TastingEvent
+	ArchivedAt     *time.Time // Set while the wine is over the plan's limit; archived wines are read-only
 }
 
 type Review struct {
@@ -57,3 +80,175 @@ type TastingNote struct {
 	Date   string
 	Note   string
 }
+
+type TastingEvent struct {
+	gorm.Model
+	WineID uint `gorm:"index"`
+	Date   string // Planned date (YYYY-MM-DD)
+	Title  string
+}
+
+// PasswordResetToken is a single-use link sent by email. Only a SHA-256
+// hash of the token is stored.
+type PasswordResetToken struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"index"`
+	TokenHash string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// RecoveryCode is a single-use fallback for a lost authenticator. Only a
+// SHA-256 hash of the code is stored.
+type RecoveryCode struct {
+	ID       uint `gorm:"primarykey"`
+	UserID   uint `gorm:"index"`
+	CodeHash string
+	UsedAt   *time.Time
+}
+
+// TierGrant is a subscription tier given by an admin, e.g. a free Pro year.
+// While a grant is active it takes precedence over the Stripe subscription.
+type TierGrant struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"index"`
+	Tier      string // "free" or "pro"
+	Reason    string
+	GrantedBy string     // Email of the admin
+	ExpiresAt *time.Time // Nil for a grant that runs until it is ended by hand
+	EndedAt   *time.Time `gorm:"index"` // Set once the grant has expired or was ended
+}
+
+// Redemption records a free trial or promotion code used at checkout. It is
+// kept when the account is erased and matched by email hash as well, so a
+// trial can't be claimed again by signing up anew. The redemption is held
+// from the moment the checkout is created: ExpiresAt is set while the
+// session is open and cleared once it completes.
+type Redemption struct {
+	ID                uint `gorm:"primarykey"`
+	CreatedAt         time.Time
+	UserID            uint   `gorm:"index"`
+	EmailHash         string `gorm:"index"`
+	Kind              string `gorm:"uniqueIndex:idx_redemption_checkout"` // "trial" or "promo"
+	Code              string // Promotion code, empty for trials
+	CheckoutSessionID string `gorm:"uniqueIndex:idx_redemption_checkout"`
+	ExpiresAt         *time.Time
+}
+
+// AdminAuditLog records every change an admin makes and every impersonation
+type AdminAuditLog struct {
+	ID           uint `gorm:"primarykey"`
+	CreatedAt    time.Time
+	AdminID      uint
+	AdminEmail   string
+	Action       string // e.g. "grant_tier", "disable", "impersonate_start"
+	TargetUserID uint   `gorm:"index"`
+	Detail       string
+}
+
+// StripeEvent is a verified Stripe webhook event. Events are stored before
+// they are processed, so retries are skipped and events can be replayed.
+// ClaimedAt is set while a delivery is processing the event.
+type StripeEvent struct {
+	ID          string `gorm:"primarykey"` // Stripe's event ID, e.g. "evt_..."
+	Type        string `gorm:"index"`
+	CustomerID  string `gorm:"index"`
+	Created     time.Time // When Stripe created the event, used for ordering
+	Payload     []byte    // The event as received, cleared when the account is erased
+	ReceivedAt  time.Time `gorm:"autoCreateTime"`
+	ProcessedAt *time.Time
+	ClaimedAt   *time.Time
+	Outcome     string // "processed", "stale" or "ignored"; empty until processed
+	Error       string // Last processing error
+}
+
+// Invoice is a Stripe invoice, cached from invoice.* webhook events so the
+// billing history renders without calling Stripe
+type Invoice struct {
+	ID               uint `gorm:"primarykey"`
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	UserID           uint   `gorm:"index"`
+	StripeInvoiceID  string `gorm:"uniqueIndex"` // e.g. "in_..."
+	Number           string // Shown on the receipt, empty while a draft
+	Status           string // "draft", "open", "paid", "void" or "uncollectible"
+	Currency         string // Upper case, e.g. "USD"
+	AmountDue        int64  // In the currency's smallest unit
+	AmountPaid       int64
+	HostedInvoiceURL string    // Stripe's page for the invoice, with its receipt once paid
+	InvoicePDF       string    // Download link of the invoice PDF
+	IssuedAt         time.Time // When Stripe created the invoice
+	EventCreated     time.Time // Creation time of the last event applied, so older ones are skipped
+}
+
+// Passkey is a WebAuthn credential registered by a user
+type Passkey struct {
+	ID           uint `gorm:"primarykey"`
+	CreatedAt    time.Time
+	UserID       uint   `gorm:"index"`
+	Name         string // Chosen by the user, e.g. "MacBook"
+	CredentialID string `gorm:"uniqueIndex"` // Base64url credential ID
+	Credential   string // JSON encoded webauthn.Credential, including the public key and sign count
+	LastUsedAt   *time.Time
+}
+
+// ExternalIdentity links a user to an account at an OpenID Connect provider
+type ExternalIdentity struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	UserID      uint   `gorm:"index"`
+	Provider    string `gorm:"uniqueIndex:idx_external_identity"` // Name from OIDC_PROVIDERS
+	Subject     string `gorm:"uniqueIndex:idx_external_identity"` // The provider's "sub" claim
+	Email       string // Address reported by the provider when linked
+	LastLoginAt *time.Time
+}
+
+// WineChange is one entry in a wine's change log. Changes saved together
+// share a revision number and are numbered by Position within it; lifecycle
+// events use a pseudo field such as "created" or "deleted".
+type WineChange struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	WineID    uint `gorm:"index;uniqueIndex:idx_wine_change_revision"`
+	Revision  int  `gorm:"uniqueIndex:idx_wine_change_revision"`
+	Position  int  `gorm:"uniqueIndex:idx_wine_change_revision"`
+	Field     string
+	OldValue  string
+	NewValue  string
+	Actor     string // Email of the user who made the change
+}
+
+// Session is a logged in browser. The cookie holds a random token; only its
+// SHA-256 hash is stored. UserID is 0 until the session is authenticated.
+type Session struct {
+	ID            uint `gorm:"primarykey"`
+	CreatedAt     time.Time
+	TokenHash     string `gorm:"uniqueIndex"`
+	UserID        uint   `gorm:"index"`
+	PendingUserID uint   `gorm:"index"` // Set while a sign-in waits for the second factor
+	Data          string // Gob encoded session values
+	Device        string // Derived from the User-Agent, e.g. "Firefox on Windows"
+	IP            string
+	LastSeenAt    time.Time
+	ExpiresAt     time.Time `gorm:"index"`
+}
+
+// RateLimitEntry counts recent failed attempts for a key such as
+// "login:ip:203.0.113.7", when rate limits are kept in the database
+type RateLimitEntry struct {
+	Key           string `gorm:"primarykey"`
+	Failures      int
+	LastFailureAt time.Time `gorm:"index"`
+}
+
+// AccountErasure is the tombstone left behind when an account is erased.
+// It holds no personal data beyond a hash of the email address.
+type AccountErasure struct {
+	ID          uint `gorm:"primarykey"`
+	UserID      uint
+	EmailHash   string `gorm:"index"`
+	RequestedAt time.Time
+	ErasedAt    time.Time
+}
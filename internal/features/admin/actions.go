@@ -0,0 +1,204 @@
+package admin
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/features/auth"
+	"wine-cellar/internal/features/subscription"
+	"wine-cellar/internal/shared/database"
+)
+
+// GrantHandler gives a user a tier with a reason and optional expiry in days
+func GrantHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	tier := r.FormValue("tier")
+	if tier != "pro" && tier != "free" {
+		http.Error(w, "Invalid tier", http.StatusBadRequest)
+		return
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+
+	var expiresAt *time.Time
+	detail := tier + " with no end date: " + reason
+	if v := r.FormValue("days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days <= 0 {
+			http.Error(w, "Invalid number of days", http.StatusBadRequest)
+			return
+		}
+		t := time.Now().AddDate(0, 0, days)
+		expiresAt = &t
+		detail = fmt.Sprintf("%s for %d days: %s", tier, days, reason)
+	}
+
+	admin := r.Context().Value("admin").(domain.User)
+	if _, err := subscription.GrantTier(database.DB, user.ID, tier, reason, admin.Email, expiresAt); err != nil {
+		log.Printf("Could not grant %s to user %d: %v", tier, user.ID, err)
+		http.Error(w, "Could not grant tier", http.StatusInternalServerError)
+		return
+	}
+	record(r, "grant_tier", user.ID, detail)
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+}
+
+// EndGrantHandler ends the user's active grant early
+func EndGrantHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	grant, err := subscription.ActiveGrant(database.DB, user.ID)
+	if err != nil {
+		http.Error(w, "Could not load tier grant", http.StatusInternalServerError)
+		return
+	}
+	if grant != nil {
+		if err := subscription.EndGrant(database.DB, grant); err != nil {
+			log.Printf("Could not end tier grant %d: %v", grant.ID, err)
+			http.Error(w, "Could not end tier grant", http.StatusInternalServerError)
+			return
+		}
+		record(r, "end_grant", user.ID, fmt.Sprintf("%s grant #%d", grant.Tier, grant.ID))
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+}
+
+// DisableHandler stops a user from logging in and signs them out everywhere
+func DisableHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+	admin := r.Context().Value("admin").(domain.User)
+	if user.ID == admin.ID {
+		http.Error(w, "You cannot disable your own account", http.StatusBadRequest)
+		return
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Updates(map[string]interface{}{
+			"disabled_at":     time.Now(),
+			"disabled_reason": reason,
+		}).Error; err != nil {
+			return err
+		}
+		return auth.EndSessions(tx, user.ID)
+	})
+	if err != nil {
+		log.Printf("Could not disable user %d: %v", user.ID, err)
+		http.Error(w, "Could not disable account", http.StatusInternalServerError)
+		return
+	}
+	record(r, "disable", user.ID, reason)
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+}
+
+// EnableHandler lets a disabled user log in again
+func EnableHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := database.DB.Model(&user).Updates(map[string]interface{}{
+		"disabled_at":     nil,
+		"disabled_reason": "",
+	}).Error; err != nil {
+		http.Error(w, "Could not enable account", http.StatusInternalServerError)
+		return
+	}
+	record(r, "enable", user.ID, "")
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+}
+
+// ImpersonateHandler starts viewing the app as the user. Impersonation is
+// read-only and audited; other admins cannot be impersonated.
+func ImpersonateHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+	admin := r.Context().Value("admin").(domain.User)
+	if user.ID == admin.ID || user.Role == "admin" {
+		http.Error(w, "Admins cannot be impersonated", http.StatusBadRequest)
+		return
+	}
+
+	if err := auth.StartImpersonation(w, r, admin, user); err != nil {
+		log.Printf("Could not impersonate user %d: %v", user.ID, err)
+		http.Error(w, "Could not view as user", http.StatusInternalServerError)
+		return
+	}
+	record(r, "impersonate_start", user.ID, "")
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// StopImpersonationHandler returns the admin to their own account. It sits
+// behind auth.Middleware only, as the session belongs to the viewed user
+// until it is switched back.
+func StopImpersonationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	adminID, adminEmail, ok := auth.Impersonator(r)
+	if !ok {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	targetID, err := auth.StopImpersonation(w, r)
+	if err != nil {
+		http.Error(w, "Could not stop viewing as user", http.StatusInternalServerError)
+		return
+	}
+	recordAs(adminID, adminEmail, "impersonate_stop", targetID, "")
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", targetID), http.StatusSeeOther)
+}
+
+// targetUser loads the user named by the "id" form value of a POST request
+func targetUser(w http.ResponseWriter, r *http.Request) (domain.User, bool) {
+	var user domain.User
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return user, false
+	}
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return user, false
+	}
+	if err := database.DB.First(&user, id).Error; err != nil {
+		http.NotFound(w, r)
+		return user, false
+	}
+	return user, true
+}
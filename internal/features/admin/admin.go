@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/features/auth"
+	"wine-cellar/internal/shared/database"
+)
+
+// Require only lets admins through. It must be wrapped by auth.Middleware.
+// Users listed in ADMIN_EMAILS become admins the first time they open the
+// admin area, once their email address is verified.
+func Require(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := auth.Impersonator(r); ok {
+			http.Error(w, "Stop viewing as another user to use the admin area", http.StatusForbidden)
+			return
+		}
+
+		userID := r.Context().Value("user_id").(uint)
+		var user domain.User
+		if err := database.DB.First(&user, userID).Error; err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		if user.Role != "admin" && user.EmailVerified && listedAdmin(user.Email) {
+			if err := database.DB.Model(&user).Update("role", "admin").Error; err != nil {
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("User %d is now an admin (ADMIN_EMAILS)", user.ID)
+		}
+		if user.Role != "admin" {
+			http.NotFound(w, r)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), "admin", user)))
+	}
+}
+
+func listedAdmin(email string) bool {
+	for _, listed := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if listed = strings.TrimSpace(listed); listed != "" && strings.EqualFold(listed, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// record adds an entry to the audit log. Failing to write it is logged but
+// does not undo the action.
+func record(r *http.Request, action string, targetUserID uint, detail string) {
+	admin := r.Context().Value("admin").(domain.User)
+	recordAs(admin.ID, admin.Email, action, targetUserID, detail)
+}
+
+func recordAs(adminID uint, adminEmail, action string, targetUserID uint, detail string) {
+	entry := domain.AdminAuditLog{
+		AdminID:      adminID,
+		AdminEmail:   adminEmail,
+		Action:       action,
+		TargetUserID: targetUserID,
+		Detail:       detail,
+	}
+	if err := database.DB.Create(&entry).Error; err != nil {
+		log.Printf("Could not write audit log %s by admin %d: %v", action, adminID, err)
+	}
+}
@@ -0,0 +1,187 @@
+package admin
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/features/subscription"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/ui"
+
+	"github.com/gorilla/csrf"
+)
+
+// UserRow is a user in the admin search results
+type UserRow struct {
+	User      domain.User
+	WineCount int64
+	Granted   bool // The tier comes from an active grant
+}
+
+// Handler shows totals and searches users by email
+func Handler(w http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value("admin").(domain.User)
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	db := database.DB.Model(&domain.User{}).Order("created_at DESC").Limit(50)
+	if query != "" {
+		db = db.Where("LOWER(email) LIKE ?", "%"+strings.ToLower(query)+"%")
+	}
+	var users []domain.User
+	if err := db.Find(&users).Error; err != nil {
+		http.Error(w, "Could not load users", http.StatusInternalServerError)
+		return
+	}
+
+	ids := make([]uint, len(users))
+	for i, u := range users {
+		ids[i] = u.ID
+	}
+
+	var counts []struct {
+		UserID uint
+		Count  int64
+	}
+	database.DB.Model(&domain.Wine{}).Select("user_id, COUNT(*) AS count").
+		Where("user_id IN ?", ids).Group("user_id").Scan(&counts)
+	wineCounts := make(map[uint]int64)
+	for _, c := range counts {
+		wineCounts[c.UserID] = c.Count
+	}
+
+	var grantedIDs []uint
+	database.DB.Model(&domain.TierGrant{}).Where("user_id IN ? AND ended_at IS NULL", ids).Pluck("user_id", &grantedIDs)
+	granted := make(map[uint]bool)
+	for _, id := range grantedIDs {
+		granted[id] = true
+	}
+
+	rows := make([]UserRow, len(users))
+	for i, u := range users {
+		rows[i] = UserRow{User: u, WineCount: wineCounts[u.ID], Granted: granted[u.ID]}
+	}
+
+	var totalUsers, proUsers, disabledUsers int64
+	database.DB.Model(&domain.User{}).Count(&totalUsers)
+	database.DB.Model(&domain.User{}).Where("subscription_tier = ?", "pro").Count(&proUsers)
+	database.DB.Model(&domain.User{}).Where("disabled_at IS NOT NULL").Count(&disabledUsers)
+
+	tmpl, err := template.New("admin.html").Funcs(ui.FuncMap).ParseFiles("internal/features/admin/admin.html", "templates/header.html", "templates/footer.html", "templates/analytics.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Rows          []UserRow
+		Query         string
+		TotalUsers    int64
+		ProUsers      int64
+		DisabledUsers int64
+		LoggedIn      bool
+		UserEmail     string
+	}{
+		Rows:          rows,
+		Query:         query,
+		TotalUsers:    totalUsers,
+		ProUsers:      proUsers,
+		DisabledUsers: disabledUsers,
+		LoggedIn:      true,
+		UserEmail:     admin.Email,
+	}
+	tmpl.Execute(w, data)
+}
+
+// UserHandler shows one user, e.g. /admin/users/42, with the actions an
+// admin can take
+func UserHandler(w http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value("admin").(domain.User)
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/admin/users/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var user domain.User
+	if err := database.DB.First(&user, id).Error; err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var wineCount, trashCount, sessionCount int64
+	database.DB.Model(&domain.Wine{}).Where("user_id = ?", user.ID).Count(&wineCount)
+	database.DB.Unscoped().Model(&domain.Wine{}).Where("user_id = ? AND deleted_at IS NOT NULL", user.ID).Count(&trashCount)
+	database.DB.Model(&domain.Session{}).Where("user_id = ?", user.ID).Count(&sessionCount)
+
+	activeGrant, err := subscription.ActiveGrant(database.DB, user.ID)
+	if err != nil {
+		http.Error(w, "Could not load tier grants", http.StatusInternalServerError)
+		return
+	}
+	var grants []domain.TierGrant
+	database.DB.Where("user_id = ?", user.ID).Order("created_at DESC").Find(&grants)
+
+	var audit []domain.AdminAuditLog
+	database.DB.Where("target_user_id = ?", user.ID).Order("created_at DESC").Limit(50).Find(&audit)
+
+	tmpl, err := template.New("user.html").Funcs(ui.FuncMap).ParseFiles("internal/features/admin/user.html", "templates/header.html", "templates/footer.html", "templates/analytics.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Target       domain.User
+		WineCount    int64
+		TrashCount   int64
+		SessionCount int64
+		ActiveGrant  *domain.TierGrant
+		Grants       []domain.TierGrant
+		Audit        []domain.AdminAuditLog
+		IsSelf       bool
+		LoggedIn     bool
+		UserEmail    string
+		CSRFField    template.HTML
+	}{
+		Target:       user,
+		WineCount:    wineCount,
+		TrashCount:   trashCount,
+		SessionCount: sessionCount,
+		ActiveGrant:  activeGrant,
+		Grants:       grants,
+		Audit:        audit,
+		IsSelf:       user.ID == admin.ID,
+		LoggedIn:     true,
+		UserEmail:    admin.Email,
+		CSRFField:    csrf.TemplateField(r),
+	}
+	tmpl.Execute(w, data)
+}
+
+// AuditHandler lists the most recent admin actions
+func AuditHandler(w http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value("admin").(domain.User)
+
+	var entries []domain.AdminAuditLog
+	if err := database.DB.Order("created_at DESC").Limit(200).Find(&entries).Error; err != nil {
+		http.Error(w, "Could not load audit log", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.New("audit.html").Funcs(ui.FuncMap).ParseFiles("internal/features/admin/audit.html", "templates/header.html", "templates/footer.html", "templates/analytics.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Entries   []domain.AdminAuditLog
+		LoggedIn  bool
+		UserEmail string
+	}{
+		Entries:   entries,
+		LoggedIn:  true,
+		UserEmail: admin.Email,
+	}
+	tmpl.Execute(w, data)
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/mailer"
+)
+
+func TestMain(m *testing.M) {
+	// Templates are parsed relative to the repository root
+	if err := os.Chdir("../../.."); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+// setup gives the test an empty database and initializes the package
+func setup(t *testing.T) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(database.Models...); err != nil {
+		t.Fatal(err)
+	}
+	database.DB = db
+	Init()
+}
+
+func createUser(t *testing.T, email, password string) domain.User {
+	t.Helper()
+	hash, err := HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := domain.User{Email: email, PasswordHash: hash, EmailVerified: true}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// captureMail replaces the mailer for the test and returns the messages
+// sent through it
+func captureMail(t *testing.T) <-chan mailer.Message {
+	t.Helper()
+	sent := make(chan mailer.Message, 10)
+	previous := mailer.Default
+	mailer.Default = captureMailer(sent)
+	t.Cleanup(func() { mailer.Default = previous })
+	return sent
+}
+
+type captureMailer chan mailer.Message
+
+func (m captureMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m <- msg
+	return nil
+}
+
+// nextMail waits for a message, since some are sent in the background
+func nextMail(t *testing.T, sent <-chan mailer.Message) mailer.Message {
+	t.Helper()
+	select {
+	case msg := <-sent:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was sent")
+		return mailer.Message{}
+	}
+}
+
+// client drives handlers like a browser: it keeps the cookies they set
+type client struct {
+	cookies map[string]*http.Cookie
+}
+
+func newClient() *client {
+	return &client{cookies: map[string]*http.Cookie{}}
+}
+
+func (c *client) do(handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	for _, cookie := range c.cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(c.cookies, cookie.Name)
+		} else {
+			c.cookies[cookie.Name] = cookie
+		}
+	}
+	return w
+}
+
+func (c *client) get(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	return c.do(handler, httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+func (c *client) post(handler http.HandlerFunc, target string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(handler, r)
+}
+
+// logInAs returns a client with an authenticated session for the user
+func logInAs(t *testing.T, user domain.User) *client {
+	t.Helper()
+	c := newClient()
+	c.do(func(w http.ResponseWriter, r *http.Request) { logIn(w, r, user) }, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if c.cookies["session-name"] == nil {
+		t.Fatal("logging in set no session cookie")
+	}
+	return c
+}
+
+// whoAmI is a handler behind Middleware that echoes the signed in user
+var whoAmI = Middleware(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(r.Context().Value("email").(string)))
+})
+
+func sessionCount(t *testing.T, userID uint) int64 {
+	t.Helper()
+	var count int64
+	if err := database.DB.Model(&domain.Session{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
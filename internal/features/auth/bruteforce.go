@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/clientip"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/jobs"
+	"wine-cellar/internal/shared/mailer"
+	"wine-cellar/internal/shared/ratelimit"
+)
+
+var (
+	loginByIP      *ratelimit.Limiter
+	loginByAccount *ratelimit.Limiter
+	signupByIP     *ratelimit.Limiter
+)
+
+// InitRateLimits sets up brute-force protection for login and signup. Counts
+// are kept in memory, or in the database with RATE_LIMIT_STORE=database
+// when more than one instance is running. It must be called after the
+// database is initialized.
+func InitRateLimits() {
+	var store ratelimit.Store
+	switch v := os.Getenv("RATE_LIMIT_STORE"); v {
+	case "", "memory":
+		store = ratelimit.NewMemoryStore()
+	case "database":
+		store = ratelimit.NewDBStore(database.DB)
+	default:
+		log.Fatalf("unknown RATE_LIMIT_STORE %q", v)
+	}
+
+	policy := func(thresholdKey string, threshold int) ratelimit.Policy {
+		return ratelimit.Policy{
+			Threshold: envInt(thresholdKey, threshold),
+			BaseDelay: jobs.Duration("LOCKOUT_BASE_DELAY", time.Minute),
+			MaxDelay:  jobs.Duration("LOCKOUT_MAX_DELAY", time.Hour),
+			Window:    jobs.Duration("LOCKOUT_WINDOW", time.Hour),
+		}
+	}
+	loginByAccount = ratelimit.New(store, policy("LOGIN_MAX_ATTEMPTS_PER_ACCOUNT", 5))
+	loginByIP = ratelimit.New(store, policy("LOGIN_MAX_ATTEMPTS_PER_IP", 20))
+	signupByIP = ratelimit.New(store, policy("SIGNUP_MAX_PER_IP", 5))
+
+	p := loginByAccount.Policy()
+	jobs.Every("rate-limit-prune", jobs.Duration("RATE_LIMIT_PRUNE_INTERVAL", 10*time.Minute), func(ctx context.Context) error {
+		return store.Prune(ctx, time.Now().Add(-p.Window-p.MaxDelay))
+	})
+}
+
+// AccountLimitKey is the key failed logins to the address are counted
+// under. Erasing the account deletes it with the rest of the user's data.
+func AccountLimitKey(email string) string {
+	return accountKey(email)
+}
+
+func accountKey(email string) string {
+	return "login:account:" + hashToken(strings.ToLower(strings.TrimSpace(email)))
+}
+
+// loginLocked returns how long the client or the account has to wait before
+// trying again. Store errors fail open, so that an outage does not lock
+// everybody out.
+func loginLocked(r *http.Request, email string) time.Duration {
+	var wait time.Duration
+	for _, check := range []struct {
+		limiter *ratelimit.Limiter
+		key     string
+	}{
+		{loginByIP, "login:ip:" + clientip.From(r)},
+		{loginByAccount, accountKey(email)},
+	} {
+		d, err := check.limiter.Locked(r.Context(), check.key)
+		if err != nil {
+			log.Printf("Rate limit check failed: %v", err)
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// loginFailed counts a failed password or two-factor code. When the account
+// gets locked, its owner is told by email.
+func loginFailed(r *http.Request, email string, user *domain.User) {
+	ip := clientip.From(r)
+	if _, _, err := loginByIP.Fail(r.Context(), "login:ip:"+ip); err != nil {
+		log.Printf("Rate limit update failed: %v", err)
+	}
+
+	wait, locked, err := loginByAccount.Fail(r.Context(), accountKey(email))
+	if err != nil {
+		log.Printf("Rate limit update failed: %v", err)
+		return
+	}
+	if !locked || user == nil {
+		return
+	}
+
+	log.Printf("Login for user %d locked for %s after failed attempts from %s", user.ID, wait, ip)
+	err = mailer.Send(r.Context(), mailer.Message{
+		To:      user.Email,
+		Subject: "Failed login attempts on your Winetrackr account",
+		Body: "We noticed several failed attempts to log in to your Winetrackr account, " +
+			"the last one from " + ip + ". Logging in has been paused for " + waitText(wait) + ".\n\n" +
+			"If this was you, you can try again later. If it wasn't, we recommend resetting your password:\n\n" +
+			mailer.AppURL("/forgot-password") + "\n",
+	})
+	if err != nil {
+		log.Printf("Lockout email for user %d failed: %v", user.ID, err)
+	}
+}
+
+// loginSucceeded clears the failures of the account. The IP keeps its count,
+// so that logging in to one's own account does not reset a guessing spree.
+func loginSucceeded(r *http.Request, email string) {
+	if err := loginByAccount.Reset(r.Context(), accountKey(email)); err != nil {
+		log.Printf("Rate limit reset failed: %v", err)
+	}
+}
+
+// signupAllowed counts a signup attempt from the client and reports whether
+// it may go ahead
+func signupAllowed(w http.ResponseWriter, r *http.Request) bool {
+	key := "signup:ip:" + clientip.From(r)
+	wait, err := signupByIP.Locked(r.Context(), key)
+	if err != nil {
+		log.Printf("Rate limit check failed: %v", err)
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
+		return false
+	}
+	if _, _, err := signupByIP.Fail(r.Context(), key); err != nil {
+		log.Printf("Rate limit update failed: %v", err)
+	}
+	return true
+}
+
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	http.Error(w, fmt.Sprintf("Too many attempts. Please try again in %s.", waitText(wait)), http.StatusTooManyRequests)
+}
+
+// waitText rounds a wait up to whole minutes, e.g. "4 minutes"
+func waitText(d time.Duration) string {
+	minutes := int((d + time.Minute - 1) / time.Minute)
+	if minutes <= 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
+
+func envInt(key string, fallback int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return fallback
+}
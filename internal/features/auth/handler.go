@@ -2,6 +2,7 @@ package auth
 
 import (
 	"html/template"
+	"log"
 	"net/http"
 	"wine-cellar/internal/domain"
 	"wine-cellar/internal/shared/database"
@@ -23,6 +24,7 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 		data := map[string]interface{}{
 			"CSRFField": csrf.TemplateField(r),
 			"Tier":      tier,
+			"Providers": oidcButtons(),
 		}
 		
 		tmpl.Execute(w, data)
@@ -30,6 +32,10 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == http.MethodPost {
+		if !signupAllowed(w, r) {
+			return
+		}
+
 		email := r.FormValue("email")
 		password := r.FormValue("password")
 		tier := r.FormValue("tier")
@@ -54,22 +60,44 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// If signing up for pro tier, auto-login and redirect to Stripe checkout
-		if tier == "pro" {
-			// Auto-login the user
-			session, _ := store.Get(r, "session-name")
-			session.Values["authenticated"] = true
-			session.Values["user_id"] = user.ID
-			session.Values["email"] = user.Email
-			session.Save(r, w)
-
-			// Redirect to checkout
-			http.Redirect(w, r, "/create-checkout-session", http.StatusSeeOther)
+		finishSignup(w, r, user, tier)
+	}
+}
+
+// finishSignup sends a new account on its way. Pro signups continue to
+// checkout, once the email address is verified.
+func finishSignup(w http.ResponseWriter, r *http.Request, user domain.User, tier string) {
+	// Checkout continues from the verification link for pro signups
+	next := ""
+	if tier == "pro" {
+		next = "checkout"
+	}
+
+	// Addresses confirmed by an identity provider need no link
+	if user.EmailVerified {
+		logIn(w, r, user)
+		if path, ok := verifyNextPaths[next]; ok {
+			http.Redirect(w, r, path, http.StatusSeeOther)
 			return
 		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if err := sendVerificationLink(r, user, next); err != nil {
+		log.Printf("Verification email for user %d failed: %v", user.ID, err)
+	}
 
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	// If signing up for pro tier, auto-login and wait for the address to be verified
+	if tier == "pro" {
+		// Auto-login the user
+		logIn(w, r, user)
+
+		http.Redirect(w, r, "/verify-email", http.StatusSeeOther)
+		return
 	}
+
+	http.Redirect(w, r, "/login?verify=1", http.StatusSeeOther)
 }
 
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
@@ -81,7 +109,12 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		
 		data := map[string]interface{}{
-			"CSRFField": csrf.TemplateField(r),
+			"CSRFField":     csrf.TemplateField(r),
+			"CSRFToken":     csrf.Token(r),
+			"Providers":     oidcButtons(),
+			"PasswordReset": r.URL.Query().Get("reset") == "1",
+			"VerifySent":    r.URL.Query().Get("verify") == "1",
+			"Verified":      r.URL.Query().Get("verified") == "1",
 		}
 
 		tmpl.Execute(w, data)
@@ -92,18 +125,29 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		email := r.FormValue("email")
 		password := r.FormValue("password")
 
+		if wait := loginLocked(r, email); wait > 0 {
+			tooManyAttempts(w, wait)
+			return
+		}
+
 		var user domain.User
 		result := database.DB.Where("email = ?", email).First(&user)
 		if result.Error != nil {
+			loginFailed(r, email, nil)
 			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 			return
 		}
 
 		if !CheckPasswordHash(password, user.PasswordHash) {
+			loginFailed(r, email, &user)
 			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 			return
 		}
 
+		if accountDisabled(w, user) {
+			return
+		}
+
 		// Check if password needs re-hashing (migration from cost 14 to 10)
 		// This ensures existing users get faster logins next time
 		if NeedsRehash(user.PasswordHash) {
@@ -114,11 +158,14 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		session, _ := store.Get(r, "session-name")
-		session.Values["authenticated"] = true
-		session.Values["user_id"] = user.ID
-		session.Values["email"] = user.Email
-		session.Save(r, w)
+		if user.TOTPEnabled {
+			startSecondFactor(w, r, user)
+			http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+			return
+		}
+
+		loginSucceeded(r, email)
+		logIn(w, r, user)
 
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	}
@@ -126,9 +173,6 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "session-name")
-	session.Values["authenticated"] = false
-	session.Values["user_id"] = nil
-	session.Values["email"] = nil
-	session.Save(r, w)
+	clearSession(w, r, session)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
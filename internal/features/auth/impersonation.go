@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/csrf"
+
+	"wine-cellar/internal/domain"
+)
+
+// Paths that stay out of reach while an admin views the app as another
+// user, on top of every request that is not a GET
+var impersonationBlocked = []string{"/create-checkout-session", "/create-portal-session", "/export", "/logout"}
+
+var impersonationBanner = template.Must(template.New("banner").Parse(`
+<div class="sticky top-0 z-50 flex flex-wrap items-center justify-center gap-3 bg-amber-500 px-4 py-2 text-sm font-medium text-black">
+    <span>Viewing as {{.Email}}. Changes are disabled.</span>
+    <form action="/admin/impersonate/stop" method="POST">
+        {{.CSRFField}}
+        <button type="submit" class="rounded-lg bg-black/80 px-3 py-1 text-xs font-bold text-white hover:bg-black">Stop viewing</button>
+    </form>
+</div>`))
+
+// StartImpersonation lets an admin see the app as target. The session keeps
+// the admin's identity so that StopImpersonation can switch back.
+func StartImpersonation(w http.ResponseWriter, r *http.Request, admin, target domain.User) error {
+	session, _ := store.Get(r, "session-name")
+	if _, ok := session.Values["impersonator_id"].(uint); ok {
+		return errors.New("already viewing as another user")
+	}
+	if err := store.renew(session); err != nil {
+		return err
+	}
+	session.Values["impersonator_id"] = admin.ID
+	session.Values["impersonator_email"] = admin.Email
+	session.Values["user_id"] = target.ID
+	session.Values["email"] = target.Email
+	return session.Save(r, w)
+}
+
+// StopImpersonation returns the session to the admin. It returns the ID of
+// the user that was being viewed.
+func StopImpersonation(w http.ResponseWriter, r *http.Request) (uint, error) {
+	session, _ := store.Get(r, "session-name")
+	adminID, ok := session.Values["impersonator_id"].(uint)
+	if !ok {
+		return 0, errors.New("not viewing as another user")
+	}
+	targetID, _ := session.Values["user_id"].(uint)
+
+	if err := store.renew(session); err != nil {
+		return 0, err
+	}
+	session.Values["user_id"] = adminID
+	session.Values["email"] = session.Values["impersonator_email"]
+	delete(session.Values, "impersonator_id")
+	delete(session.Values, "impersonator_email")
+	return targetID, session.Save(r, w)
+}
+
+// Impersonator returns the admin behind the request while they view the app
+// as another user. It must be called behind Middleware.
+func Impersonator(r *http.Request) (uint, string, bool) {
+	adminID, ok := r.Context().Value("impersonator_id").(uint)
+	if !ok {
+		return 0, "", false
+	}
+	email, _ := r.Context().Value("impersonator_email").(string)
+	return adminID, email, true
+}
+
+// impersonating serves a request made while viewing as another user: it is
+// read-only and every page gets a banner
+func impersonating(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, adminID uint, adminEmail string) {
+	blocked := r.Method != http.MethodGet && r.Method != http.MethodHead
+	for _, path := range impersonationBlocked {
+		if r.URL.Path == path {
+			blocked = true
+		}
+	}
+	if blocked && r.URL.Path != "/admin/impersonate/stop" {
+		http.Error(w, "Not available while viewing as another user", http.StatusForbidden)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), "impersonator_id", adminID)
+	ctx = context.WithValue(ctx, "impersonator_email", adminEmail)
+	r = r.WithContext(ctx)
+
+	bw := &bannerWriter{ResponseWriter: w}
+	next(bw, r)
+
+	var banner bytes.Buffer
+	impersonationBanner.Execute(&banner, map[string]interface{}{
+		"Email":     r.Context().Value("email"),
+		"CSRFField": csrf.TemplateField(r),
+	})
+	bw.flush(banner.Bytes())
+}
+
+// bannerWriter holds back a response so that a banner can be inserted at the
+// top of HTML pages
+type bannerWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bannerWriter) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bannerWriter) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *bannerWriter) flush(banner []byte) {
+	body := b.body.Bytes()
+	contentType := b.Header().Get("Content-Type")
+	if contentType == "" && len(body) > 0 {
+		contentType = http.DetectContentType(body)
+		b.Header().Set("Content-Type", contentType)
+	}
+
+	if strings.HasPrefix(contentType, "text/html") {
+		if i := bytes.Index(body, []byte("<body")); i >= 0 {
+			if j := bytes.IndexByte(body[i:], '>'); j >= 0 {
+				at := i + j + 1
+				body = append(body[:at:at], append(banner, body[at:]...)...)
+			}
+		}
+	}
+
+	if b.status != 0 {
+		b.ResponseWriter.WriteHeader(b.status)
+	}
+	b.ResponseWriter.Write(body)
+}
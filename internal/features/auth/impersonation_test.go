@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+)
+
+func TestImpersonationSessionStaysWithAdmin(t *testing.T) {
+	setup(t)
+	admin := createUser(t, "admin@example.com", "password")
+	target := createUser(t, "ana@example.com", "password")
+
+	c := logInAs(t, admin)
+	w := c.do(func(w http.ResponseWriter, r *http.Request) {
+		if err := StartImpersonation(w, r, admin, target); err != nil {
+			t.Fatal(err)
+		}
+	}, httptest.NewRequest(http.MethodPost, "/admin/impersonate", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("start: %d", w.Code)
+	}
+	if got := c.get(whoAmI, "/").Body.String(); got != target.Email {
+		t.Fatalf("viewing as %q, want %q", got, target.Email)
+	}
+
+	var rows []domain.Session
+	database.DB.Find(&rows)
+	if len(rows) != 1 || rows[0].UserID != admin.ID {
+		t.Fatalf("sessions %+v, want one row of the admin", rows)
+	}
+
+	// The target can neither see nor end the admin's session
+	listed, err := ActiveSessions(httptest.NewRequest(http.MethodGet, "/settings", nil), target.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 0 {
+		t.Fatalf("target lists %d sessions, want 0", len(listed))
+	}
+	if err := EndSessions(database.DB, target.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.get(whoAmI, "/").Body.String(); got != target.Email {
+		t.Fatal("ending the target's sessions signed the admin out")
+	}
+
+	c.do(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := StopImpersonation(w, r); err != nil {
+			t.Fatal(err)
+		}
+	}, httptest.NewRequest(http.MethodPost, "/admin/impersonate/stop", nil))
+	if got := c.get(whoAmI, "/").Body.String(); got != admin.Email {
+		t.Fatalf("after stopping signed in as %q, want %q", got, admin.Email)
+	}
+	if n := sessionCount(t, admin.ID); n != 1 {
+		t.Fatalf("admin has %d sessions, want 1", n)
+	}
+}
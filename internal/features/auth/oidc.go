@@ -0,0 +1,356 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/mailer"
+)
+
+// oidcLoginTTL is how long the user has to finish logging in at the provider
+const oidcLoginTTL = 10 * time.Minute
+
+// oidcProvider is an OpenID Connect issuer configured through the environment.
+// Discovery happens on first use, so an unreachable issuer does not stop the
+// app from starting.
+type oidcProvider struct {
+	Name         string
+	DisplayName  string
+	issuer       string
+	clientID     string
+	clientSecret string
+	scopes       []string
+
+	mu       sync.Mutex
+	config   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// oidcButton is what the login and signup pages need to link to a provider
+type oidcButton struct {
+	Name        string
+	DisplayName string
+}
+
+var oidcProviders []*oidcProvider
+
+// initOIDC reads OIDC_PROVIDERS, a comma-separated list of names, and for
+// each name OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID,
+// OIDC_<NAME>_CLIENT_SECRET and optionally OIDC_<NAME>_DISPLAY_NAME and
+// OIDC_<NAME>_SCOPES
+func initOIDC() {
+	oidcProviders = nil
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+
+		p := &oidcProvider{
+			Name:         name,
+			DisplayName:  os.Getenv(prefix + "DISPLAY_NAME"),
+			issuer:       os.Getenv(prefix + "ISSUER"),
+			clientID:     os.Getenv(prefix + "CLIENT_ID"),
+			clientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		}
+		if p.issuer == "" || p.clientID == "" {
+			log.Printf("OIDC provider %q skipped: %sISSUER and %sCLIENT_ID are required", name, prefix, prefix)
+			continue
+		}
+		if p.DisplayName == "" {
+			p.DisplayName = strings.ToUpper(name[:1]) + name[1:]
+		}
+		if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+			p.scopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+		}
+
+		oidcProviders = append(oidcProviders, p)
+		log.Printf("OIDC provider %q configured for %s", name, p.issuer)
+	}
+}
+
+func findOIDCProvider(name string) *oidcProvider {
+	for _, p := range oidcProviders {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func oidcButtons() []oidcButton {
+	buttons := make([]oidcButton, 0, len(oidcProviders))
+	for _, p := range oidcProviders {
+		buttons = append(buttons, oidcButton{Name: p.Name, DisplayName: p.DisplayName})
+	}
+	return buttons
+}
+
+// discover fetches the issuer's configuration, once it succeeds
+func (p *oidcProvider) discover() (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.config != nil {
+		return p.config, p.verifier, nil
+	}
+
+	// The context is kept for fetching signing keys later on
+	ctx := oidc.ClientContext(context.Background(), &http.Client{Timeout: 10 * time.Second})
+	provider, err := oidc.NewProvider(ctx, p.issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.config = &oauth2.Config{
+		ClientID:     p.clientID,
+		ClientSecret: p.clientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  mailer.AppURL("/oidc/callback/" + p.Name),
+		Scopes:       p.scopes,
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.clientID})
+	return p.config, p.verifier, nil
+}
+
+// oidcLogin is kept in the session between the redirect to the provider and
+// the callback
+type oidcLogin struct {
+	Provider string
+	State    string
+	Nonce    string
+	Verifier string // PKCE code verifier
+	Tier     string // Passed on from the signup page
+	Expires  int64
+}
+
+// OIDCLoginHandler redirects to the provider named in the path, e.g.
+// /oidc/login/google?tier=pro
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	p := findOIDCProvider(strings.TrimPrefix(r.URL.Path, "/oidc/login/"))
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	config, _, err := p.discover()
+	if err != nil {
+		log.Printf("OIDC discovery for %q failed: %v", p.Name, err)
+		http.Error(w, fmt.Sprintf("%s sign-in is currently unavailable", p.DisplayName), http.StatusBadGateway)
+		return
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	login := oidcLogin{
+		Provider: p.Name,
+		State:    state,
+		Nonce:    nonce,
+		Verifier: oauth2.GenerateVerifier(),
+		Tier:     r.URL.Query().Get("tier"),
+		Expires:  time.Now().Add(oidcLoginTTL).Unix(),
+	}
+	encoded, _ := json.Marshal(login)
+
+	session, _ := store.Get(r, "session-name")
+	session.Values["oidc_login"] = string(encoded)
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(login.Verifier)), http.StatusSeeOther)
+}
+
+// OIDCCallbackHandler completes the authorization code flow. The identity is
+// matched to a user by provider and subject, then by verified email address;
+// without a match a new account is created.
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	p := findOIDCProvider(strings.TrimPrefix(r.URL.Path, "/oidc/callback/"))
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	session, _ := store.Get(r, "session-name")
+	encoded, _ := session.Values["oidc_login"].(string)
+	delete(session.Values, "oidc_login")
+	session.Save(r, w)
+
+	var login oidcLogin
+	if encoded == "" || json.Unmarshal([]byte(encoded), &login) != nil ||
+		login.Provider != p.Name || login.State != r.URL.Query().Get("state") || time.Now().Unix() > login.Expires {
+		http.Error(w, "Sign-in expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		log.Printf("OIDC provider %q returned error %q: %s", p.Name, e, r.URL.Query().Get("error_description"))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	config, verifier, err := p.discover()
+	if err != nil {
+		log.Printf("OIDC discovery for %q failed: %v", p.Name, err)
+		http.Error(w, fmt.Sprintf("%s sign-in is currently unavailable", p.DisplayName), http.StatusBadGateway)
+		return
+	}
+
+	ctx := oidc.ClientContext(r.Context(), &http.Client{Timeout: 10 * time.Second})
+	token, err := config.Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		log.Printf("OIDC code exchange with %q failed: %v", p.Name, err)
+		http.Error(w, "Sign-in failed, please try again", http.StatusBadGateway)
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "Sign-in failed, please try again", http.StatusBadGateway)
+		return
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil || idToken.Nonce != login.Nonce {
+		log.Printf("OIDC ID token from %q rejected: %v", p.Name, err)
+		http.Error(w, "Sign-in failed, please try again", http.StatusUnauthorized)
+		return
+	}
+
+	var claims struct {
+		Email         string      `json:"email"`
+		EmailVerified interface{} `json:"email_verified"` // Some providers send a string
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, "Sign-in failed, please try again", http.StatusBadGateway)
+		return
+	}
+	emailVerified := claims.EmailVerified == true || claims.EmailVerified == "true"
+
+	user, created, err := resolveExternalIdentity(p.Name, idToken.Subject, claims.Email, emailVerified)
+	if errors.Is(err, errUnverifiedExternalEmail) {
+		http.Error(w, fmt.Sprintf("Your %s account has no verified email address", p.DisplayName), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, errUnverifiedLocalAccount) {
+		http.Error(w, "An account with this email address already exists. Log in with your password and confirm your email address before using "+p.DisplayName+" sign-in.", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("OIDC login with %q failed: %v", p.Name, err)
+		http.Error(w, "Could not sign in", http.StatusInternalServerError)
+		return
+	}
+
+	if created {
+		finishSignup(w, r, user, login.Tier)
+		return
+	}
+
+	if accountDisabled(w, user) {
+		return
+	}
+
+	if user.TOTPEnabled {
+		startSecondFactor(w, r, user)
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	logIn(w, r, user)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+var (
+	errUnverifiedExternalEmail = errors.New("provider did not verify the email address")
+	errUnverifiedLocalAccount  = errors.New("existing account has not verified its email address")
+)
+
+// resolveExternalIdentity finds or creates the user for a provider's subject.
+// An existing account is only linked when both sides have verified the
+// address, so nobody can claim an account by registering its email first.
+func resolveExternalIdentity(provider, subject, email string, emailVerified bool) (domain.User, bool, error) {
+	var user domain.User
+	var identity domain.ExternalIdentity
+	now := time.Now()
+
+	err := database.DB.Where("provider = ? AND subject = ?", provider, subject).First(&identity).Error
+	if err == nil {
+		if err := database.DB.First(&user, identity.UserID).Error; err != nil {
+			return user, false, err
+		}
+		database.DB.Model(&identity).Update("last_login_at", now)
+		return user, false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return user, false, err
+	}
+
+	if email == "" || !emailVerified {
+		return user, false, errUnverifiedExternalEmail
+	}
+
+	created := false
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("LOWER(email) = ?", strings.ToLower(email)).First(&user).Error
+		switch {
+		case err == nil:
+			if !user.EmailVerified {
+				return errUnverifiedLocalAccount
+			}
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			// No password, one can be set with a password reset
+			user = domain.User{Email: email, EmailVerified: true, EmailVerifiedAt: &now}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+			created = true
+		default:
+			return err
+		}
+
+		return tx.Create(&domain.ExternalIdentity{
+			UserID:      user.ID,
+			Provider:    provider,
+			Subject:     subject,
+			Email:       email,
+			LastLoginAt: &now,
+		}).Error
+	})
+	return user, created, err
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
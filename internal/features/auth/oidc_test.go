@@ -0,0 +1,326 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+)
+
+// mockIssuer is an OpenID Connect provider serving discovery, its signing
+// key and the token endpoint. The authorization step is skipped: tests
+// issue a code for a login and pass it to the callback themselves.
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]issuedCode
+}
+
+// issuedCode is what the issuer remembers about an authorization code
+type issuedCode struct {
+	challenge string // PKCE code challenge of the login it was issued for
+	claims    map[string]interface{}
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, codes: map[string]issuedCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                m.URL,
+			"authorization_endpoint":                m.URL + "/authorize",
+			"token_endpoint":                        m.URL + "/token",
+			"jwks_uri":                              m.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+
+	t.Setenv("OIDC_PROVIDERS", "mock")
+	t.Setenv("OIDC_MOCK_ISSUER", m.URL)
+	t.Setenv("OIDC_MOCK_CLIENT_ID", "winetrackr")
+	t.Setenv("OIDC_MOCK_CLIENT_SECRET", "secret")
+	initOIDC()
+	return m
+}
+
+// token redeems a code once, checking the PKCE verifier against the
+// challenge of the login the code was issued for
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	code, ok := m.codes[r.FormValue("code")]
+	delete(m.codes, r.FormValue("code"))
+	m.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     m.sign(code.claims),
+	})
+}
+
+// sign returns the claims as an RS256 JWT
+func (m *mockIssuer) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// issue returns a code for a login, whose ID token has the claims. The
+// issuer, audience, nonce and lifetime are filled in unless given.
+func (m *mockIssuer) issue(login oidcStart, claims map[string]interface{}) string {
+	full := map[string]interface{}{
+		"iss":   m.URL,
+		"aud":   "winetrackr",
+		"nonce": login.nonce,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		full[k] = v
+	}
+	code, _ := randomToken()
+	m.mu.Lock()
+	m.codes[code] = issuedCode{challenge: login.challenge, claims: full}
+	m.mu.Unlock()
+	return code
+}
+
+// oidcStart is what the app sent to the provider to start a login
+type oidcStart struct {
+	state     string
+	nonce     string
+	challenge string
+}
+
+func startOIDCLogin(t *testing.T, c *client) oidcStart {
+	t.Helper()
+	w := c.get(OIDCLoginHandler, "/oidc/login/mock")
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("login: %d %s", w.Code, w.Body.String())
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := location.Query()
+	if q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("code challenge method %q, want S256", q.Get("code_challenge_method"))
+	}
+	return oidcStart{state: q.Get("state"), nonce: q.Get("nonce"), challenge: q.Get("code_challenge")}
+}
+
+func oidcCallback(c *client, code, state string) *httptest.ResponseRecorder {
+	return c.get(OIDCCallbackHandler, "/oidc/callback/mock?"+url.Values{"code": {code}, "state": {state}}.Encode())
+}
+
+func verifiedEmail(sub, email string) map[string]interface{} {
+	return map[string]interface{}{"sub": sub, "email": email, "email_verified": true}
+}
+
+func userCount(t *testing.T) int64 {
+	t.Helper()
+	var count int64
+	if err := database.DB.Model(&domain.User{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestOIDCLoginCreatesAccount(t *testing.T) {
+	setup(t)
+	issuer := newMockIssuer(t)
+
+	c := newClient()
+	login := startOIDCLogin(t, c)
+	w := oidcCallback(c, issuer.issue(login, verifiedEmail("sub-1", "ana@example.com")), login.state)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Fatalf("callback: %d %s %s", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+	if got := c.get(whoAmI, "/").Body.String(); got != "ana@example.com" {
+		t.Fatalf("signed in as %q", got)
+	}
+	var identity domain.ExternalIdentity
+	if err := database.DB.Where("provider = ? AND subject = ?", "mock", "sub-1").First(&identity).Error; err != nil {
+		t.Fatalf("identity not stored: %v", err)
+	}
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+	setup(t)
+	issuer := newMockIssuer(t)
+
+	c := newClient()
+	login := startOIDCLogin(t, c)
+	w := oidcCallback(c, issuer.issue(login, verifiedEmail("sub-1", "ana@example.com")), "forged-state")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("callback with another state: %d, want 400", w.Code)
+	}
+	// The login was used up by the failed attempt
+	if w := oidcCallback(c, issuer.issue(login, verifiedEmail("sub-1", "ana@example.com")), login.state); w.Code != http.StatusBadRequest {
+		t.Fatalf("callback after a failed attempt: %d, want 400", w.Code)
+	}
+	if n := userCount(t); n != 0 {
+		t.Fatalf("%d users created, want 0", n)
+	}
+}
+
+func TestOIDCPKCEMismatch(t *testing.T) {
+	setup(t)
+	issuer := newMockIssuer(t)
+
+	// A code issued to the victim's login, injected into the attacker's
+	victim := startOIDCLogin(t, newClient())
+	attacker := newClient()
+	login := startOIDCLogin(t, attacker)
+	code := issuer.issue(oidcStart{nonce: login.nonce, challenge: victim.challenge}, verifiedEmail("sub-1", "ana@example.com"))
+
+	w := oidcCallback(attacker, code, login.state)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("callback with another login's code: %d, want 502", w.Code)
+	}
+	if attacker.get(whoAmI, "/").Code != http.StatusSeeOther {
+		t.Fatal("signed in without the code verifier")
+	}
+	if n := userCount(t); n != 0 {
+		t.Fatalf("%d users created, want 0", n)
+	}
+}
+
+func TestOIDCNonceMismatch(t *testing.T) {
+	setup(t)
+	issuer := newMockIssuer(t)
+
+	c := newClient()
+	login := startOIDCLogin(t, c)
+	claims := verifiedEmail("sub-1", "ana@example.com")
+	claims["nonce"] = "replayed-nonce"
+	w := oidcCallback(c, issuer.issue(login, claims), login.state)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("callback with another nonce: %d, want 401", w.Code)
+	}
+	if c.get(whoAmI, "/").Code != http.StatusSeeOther {
+		t.Fatal("signed in with a replayed ID token")
+	}
+	if n := userCount(t); n != 0 {
+		t.Fatalf("%d users created, want 0", n)
+	}
+}
+
+func TestOIDCLinksVerifiedAccount(t *testing.T) {
+	setup(t)
+	issuer := newMockIssuer(t)
+	user := createUser(t, "ana@example.com", "password")
+
+	c := newClient()
+	login := startOIDCLogin(t, c)
+	if w := oidcCallback(c, issuer.issue(login, verifiedEmail("sub-1", "Ana@Example.com")), login.state); w.Code != http.StatusSeeOther {
+		t.Fatalf("callback: %d %s", w.Code, w.Body.String())
+	}
+	if got := c.get(whoAmI, "/").Body.String(); got != user.Email {
+		t.Fatalf("signed in as %q, want %q", got, user.Email)
+	}
+	if n := userCount(t); n != 1 {
+		t.Fatalf("%d users, want the existing one only", n)
+	}
+	var identity domain.ExternalIdentity
+	if err := database.DB.Where("provider = ? AND subject = ?", "mock", "sub-1").First(&identity).Error; err != nil || identity.UserID != user.ID {
+		t.Fatalf("identity %+v, want one linked to user %d: %v", identity, user.ID, err)
+	}
+}
+
+func TestOIDCDoesNotLinkUnverifiedAccount(t *testing.T) {
+	setup(t)
+	issuer := newMockIssuer(t)
+	user := createUser(t, "ana@example.com", "password")
+	database.DB.Model(&user).Update("email_verified", false)
+
+	c := newClient()
+	login := startOIDCLogin(t, c)
+	if w := oidcCallback(c, issuer.issue(login, verifiedEmail("sub-1", "ana@example.com")), login.state); w.Code != http.StatusConflict {
+		t.Fatalf("callback: %d, want 409", w.Code)
+	}
+	var count int64
+	database.DB.Model(&domain.ExternalIdentity{}).Count(&count)
+	if count != 0 {
+		t.Fatal("linked to an account whose address is not verified")
+	}
+}
+
+func TestOIDCRefusesDisabledAccount(t *testing.T) {
+	setup(t)
+	issuer := newMockIssuer(t)
+	user := createUser(t, "ana@example.com", "password")
+
+	// Linked while the account was still enabled
+	linked := newClient()
+	login := startOIDCLogin(t, linked)
+	if w := oidcCallback(linked, issuer.issue(login, verifiedEmail("sub-1", user.Email)), login.state); w.Code != http.StatusSeeOther {
+		t.Fatalf("first login: %d %s", w.Code, w.Body.String())
+	}
+	if err := EndSessions(database.DB, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	database.DB.Model(&user).Updates(map[string]interface{}{"disabled_at": &now, "disabled_reason": "abuse"})
+
+	c := newClient()
+	login = startOIDCLogin(t, c)
+	w := oidcCallback(c, issuer.issue(login, verifiedEmail("sub-1", user.Email)), login.state)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("callback for a disabled account: %d, want 403", w.Code)
+	}
+	if c.get(whoAmI, "/").Code != http.StatusSeeOther {
+		t.Fatal("a disabled account signed in")
+	}
+	if n := sessionCount(t, user.ID); n != 0 {
+		t.Fatalf("%d sessions for a disabled account, want 0", n)
+	}
+}
@@ -0,0 +1,412 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/securecookie"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+)
+
+var relyingParty *webauthn.WebAuthn
+
+// passkeyLoginTTL is how long the browser has to answer a login challenge
+const passkeyLoginTTL = 5 * time.Minute
+
+// loginCeremonies signs the cookie holding a login challenge
+var loginCeremonies *securecookie.SecureCookie
+
+// initPasskeys configures the WebAuthn relying party from PASSKEY_RP_ID and
+// PASSKEY_ORIGINS, which default to the host and origin of DOMAIN
+func initPasskeys() {
+	origin := os.Getenv("DOMAIN")
+	if origin == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = "8080"
+		}
+		origin = "http://localhost:" + port
+	} else if !strings.HasPrefix(origin, "http") {
+		origin = "https://" + origin
+	}
+
+	origins := []string{strings.TrimRight(origin, "/")}
+	if v := os.Getenv("PASSKEY_ORIGINS"); v != "" {
+		origins = strings.Split(v, ",")
+	}
+
+	rpID := os.Getenv("PASSKEY_RP_ID")
+	if rpID == "" {
+		if u, err := url.Parse(origins[0]); err == nil {
+			rpID = u.Hostname()
+		}
+	}
+
+	loginCeremonies = securecookie.New(signingKey, nil).MaxAge(int(passkeyLoginTTL.Seconds()))
+
+	var err error
+	relyingParty, err = webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: "Winetrackr",
+		RPOrigins:     origins,
+	})
+	if err != nil {
+		log.Printf("Passkeys disabled: %v", err)
+		relyingParty = nil
+	}
+}
+
+// passkeyUser adapts a domain.User and its passkeys to webauthn.User
+type passkeyUser struct {
+	user     domain.User
+	passkeys []domain.Passkey
+}
+
+func (u *passkeyUser) WebAuthnID() []byte {
+	handle, _ := base64.RawURLEncoding.DecodeString(u.user.PasskeyHandle)
+	return handle
+}
+
+func (u *passkeyUser) WebAuthnName() string        { return u.user.Email }
+func (u *passkeyUser) WebAuthnDisplayName() string { return u.user.Email }
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.passkeys))
+	for _, p := range u.passkeys {
+		var c webauthn.Credential
+		if err := json.Unmarshal([]byte(p.Credential), &c); err == nil {
+			credentials = append(credentials, c)
+		}
+	}
+	return credentials
+}
+
+func loadPasskeyUser(user domain.User) (*passkeyUser, error) {
+	u := &passkeyUser{user: user}
+	err := database.DB.Where("user_id = ?", user.ID).Find(&u.passkeys).Error
+	return u, err
+}
+
+// BeginPasskeyRegistrationHandler returns the options for
+// navigator.credentials.create
+func BeginPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if !passkeyRequest(w, r) {
+		return
+	}
+	userID := r.Context().Value("user_id").(uint)
+
+	var user domain.User
+	if err := database.DB.First(&user, userID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	if user.PasskeyHandle == "" {
+		handle := make([]byte, 32)
+		if _, err := rand.Read(handle); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		user.PasskeyHandle = base64.RawURLEncoding.EncodeToString(handle)
+		if err := database.DB.Model(&user).Update("passkey_handle", user.PasskeyHandle).Error; err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	pu, err := loadPasskeyUser(user)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	var exclusions []protocol.CredentialDescriptor
+	for _, c := range pu.WebAuthnCredentials() {
+		exclusions = append(exclusions, c.Descriptor())
+	}
+
+	options, sessionData, err := relyingParty.BeginRegistration(pu,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(exclusions),
+	)
+	if err != nil {
+		log.Printf("Passkey registration for user %d failed: %v", userID, err)
+		http.Error(w, "Could not start passkey registration", http.StatusInternalServerError)
+		return
+	}
+
+	if err := saveCeremony(w, r, "passkey_registration", sessionData); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, options)
+}
+
+// FinishPasskeyRegistrationHandler verifies and stores a new passkey. The
+// name is passed in the query string, the body is the credential.
+func FinishPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if !passkeyRequest(w, r) {
+		return
+	}
+	userID := r.Context().Value("user_id").(uint)
+
+	var sessionData webauthn.SessionData
+	if !loadCeremony(w, r, "passkey_registration", &sessionData) {
+		http.Error(w, "Registration expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	var user domain.User
+	if err := database.DB.First(&user, userID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+	pu, err := loadPasskeyUser(user)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	credential, err := relyingParty.FinishRegistration(pu, sessionData, r)
+	if err != nil {
+		log.Printf("Passkey registration for user %d rejected: %v", userID, err)
+		http.Error(w, "Passkey could not be verified", http.StatusBadRequest)
+		return
+	}
+
+	encoded, err := json.Marshal(credential)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		name = "Passkey"
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	passkey := domain.Passkey{
+		UserID:       userID,
+		Name:         name,
+		CredentialID: base64.RawURLEncoding.EncodeToString(credential.ID),
+		Credential:   string(encoded),
+	}
+	if err := database.DB.Create(&passkey).Error; err != nil {
+		http.Error(w, "Could not save passkey", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// BeginPasskeyLoginHandler returns the options for navigator.credentials.get.
+// Any passkey for this site may answer, so no email is needed.
+func BeginPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !passkeyRequest(w, r) {
+		return
+	}
+
+	options, sessionData, err := relyingParty.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if err != nil {
+		http.Error(w, "Could not start passkey login", http.StatusInternalServerError)
+		return
+	}
+
+	if err := saveLoginCeremony(w, sessionData); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, options)
+}
+
+// FinishPasskeyLoginHandler verifies an assertion and logs the user in. A
+// user-verified passkey counts as both factors, so two-factor
+// authentication is not asked for.
+func FinishPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !passkeyRequest(w, r) {
+		return
+	}
+
+	var sessionData webauthn.SessionData
+	if !loadLoginCeremony(w, r, &sessionData) {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	var found *passkeyUser
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		var user domain.User
+		handle := base64.RawURLEncoding.EncodeToString(userHandle)
+		if err := database.DB.Where("passkey_handle = ?", handle).First(&user).Error; err != nil {
+			return nil, err
+		}
+		pu, err := loadPasskeyUser(user)
+		if err != nil {
+			return nil, err
+		}
+		found = pu
+		return pu, nil
+	}
+
+	_, credential, err := relyingParty.FinishPasskeyLogin(handler, sessionData, r)
+	if err == nil && credential.Authenticator.CloneWarning {
+		err = errors.New("sign count went backwards, authenticator may be cloned")
+	}
+	if err != nil || found == nil {
+		log.Printf("Passkey login rejected: %v", err)
+		http.Error(w, "Passkey could not be verified", http.StatusUnauthorized)
+		return
+	}
+
+	if accountDisabled(w, found.user) {
+		return
+	}
+
+	// Store the new sign count
+	credentialID := base64.RawURLEncoding.EncodeToString(credential.ID)
+	if encoded, err := json.Marshal(credential); err == nil {
+		database.DB.Model(&domain.Passkey{}).
+			Where("user_id = ? AND credential_id = ?", found.user.ID, credentialID).
+			Updates(map[string]interface{}{"credential": string(encoded), "last_used_at": time.Now()})
+	}
+
+	logIn(w, r, found.user)
+	writeJSON(w, map[string]string{"redirect": "/"})
+}
+
+// RenamePasskeyHandler and DeletePasskeyHandler manage passkeys from settings
+func RenamePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("user_id").(uint)
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || len(name) > 64 {
+		http.Error(w, "Name must be between 1 and 64 characters", http.StatusBadRequest)
+		return
+	}
+
+	database.DB.Model(&domain.Passkey{}).Where("id = ? AND user_id = ?", id, userID).Update("name", name)
+	http.Redirect(w, r, "/settings#security", http.StatusSeeOther)
+}
+
+func DeletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("user_id").(uint)
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	database.DB.Where("id = ? AND user_id = ?", id, userID).Delete(&domain.Passkey{})
+	http.Redirect(w, r, "/settings#security", http.StatusSeeOther)
+}
+
+func passkeyRequest(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if relyingParty == nil {
+		http.Error(w, "Passkeys are not available", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// saveCeremony keeps the challenge of a ceremony in the session until the
+// browser answers
+func saveCeremony(w http.ResponseWriter, r *http.Request, key string, data *webauthn.SessionData) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	session, _ := store.Get(r, "session-name")
+	session.Values[key] = string(encoded)
+	return session.Save(r, w)
+}
+
+// loadCeremony returns the stored challenge once; it cannot be reused
+func loadCeremony(w http.ResponseWriter, r *http.Request, key string, data *webauthn.SessionData) bool {
+	session, _ := store.Get(r, "session-name")
+	encoded, _ := session.Values[key].(string)
+	delete(session.Values, key)
+	session.Save(r, w)
+	return encoded != "" && json.Unmarshal([]byte(encoded), data) == nil
+}
+
+// saveLoginCeremony keeps a login challenge in a short-lived signed cookie
+// rather than the session, so that anonymous visitors get no session row
+func saveLoginCeremony(w http.ResponseWriter, data *webauthn.SessionData) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	value, err := loginCeremonies.Encode("passkey_login", string(encoded))
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, loginCeremonyCookie(value, int(passkeyLoginTTL.Seconds())))
+	return nil
+}
+
+// loadLoginCeremony returns the login challenge and clears its cookie
+func loadLoginCeremony(w http.ResponseWriter, r *http.Request, data *webauthn.SessionData) bool {
+	http.SetCookie(w, loginCeremonyCookie("", -1))
+	cookie, err := r.Cookie("passkey_login")
+	if err != nil {
+		return false
+	}
+	var encoded string
+	if err := loginCeremonies.Decode("passkey_login", cookie.Value, &encoded); err != nil {
+		return false
+	}
+	return json.Unmarshal([]byte(encoded), data) == nil
+}
+
+func loginCeremonyCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     "passkey_login",
+		Value:    value,
+		Path:     "/passkeys/login",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   store.Options.Secure,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+)
+
+// authenticator is a software passkey: one P-256 credential for one user
+// handle, answering ceremonies the way a browser and platform
+// authenticator would
+type authenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte // Set by register
+	signCount    uint32
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &authenticator{key: key, credentialID: id}
+}
+
+// ceremony is the part of the options both ceremonies share
+type ceremony struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		User      struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	} `json:"publicKey"`
+}
+
+func parseCeremony(t *testing.T, w *httptest.ResponseRecorder) ceremony {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("begin: %d %s", w.Code, w.Body.String())
+	}
+	var c ceremony
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (a *authenticator) clientData(t *testing.T, kind, challenge string) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]string{
+		"type":      kind,
+		"challenge": challenge,
+		"origin":    relyingParty.Config.RPOrigins[0],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// authData builds the authenticator data; attested is appended as is
+func (a *authenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(relyingParty.Config.RPID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+// register answers a registration ceremony with a "none" attestation
+func (a *authenticator) register(t *testing.T, options ceremony) []byte {
+	t.Helper()
+	handle, err := base64.RawURLEncoding.DecodeString(options.PublicKey.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.userHandle = handle
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, publicKey...)
+
+	// User present, user verified, attested credential data included
+	object, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(0x01|0x04|0x40, attested),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.credential(map[string]string{
+		"clientDataJSON":    encode(a.clientData(t, "webauthn.create", options.PublicKey.Challenge)),
+		"attestationObject": encode(object),
+	})
+}
+
+// assert answers a login ceremony as the given user handle, counting the
+// signature
+func (a *authenticator) assert(t *testing.T, options ceremony, userHandle []byte) []byte {
+	t.Helper()
+	a.signCount++
+	authData := a.authData(0x01|0x04, nil)
+	clientData := a.clientData(t, "webauthn.get", options.PublicKey.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(bytes.Clone(authData), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.credential(map[string]string{
+		"clientDataJSON":    encode(clientData),
+		"authenticatorData": encode(authData),
+		"signature":         encode(signature),
+		"userHandle":        encode(userHandle),
+	})
+}
+
+func (a *authenticator) credential(response map[string]string) []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":       encode(a.credentialID),
+		"rawId":    encode(a.credentialID),
+		"type":     "public-key",
+		"response": response,
+	})
+	return body
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func postJSON(c *client, handler http.HandlerFunc, target string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return c.do(handler, r)
+}
+
+// registerPasskey adds a passkey on the authenticator to the user's account
+func registerPasskey(t *testing.T, user domain.User, a *authenticator) {
+	t.Helper()
+	c := logInAs(t, user)
+	options := parseCeremony(t, postJSON(c, Middleware(BeginPasskeyRegistrationHandler), "/passkeys/register/begin", nil))
+	w := postJSON(c, Middleware(FinishPasskeyRegistrationHandler), "/passkeys/register/finish?name=Laptop", a.register(t, options))
+	if w.Code != http.StatusOK {
+		t.Fatalf("finish registration: %d %s", w.Code, w.Body.String())
+	}
+}
+
+// passkeyLogin runs a login ceremony and returns the finishing response
+func passkeyLogin(t *testing.T, c *client, a *authenticator, userHandle []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	options := parseCeremony(t, postJSON(c, BeginPasskeyLoginHandler, "/passkeys/login/begin", nil))
+	return postJSON(c, FinishPasskeyLoginHandler, "/passkeys/login/finish", a.assert(t, options, userHandle))
+}
+
+func storedSignCount(t *testing.T, userID uint) uint32 {
+	t.Helper()
+	var passkey domain.Passkey
+	if err := database.DB.Where("user_id = ?", userID).First(&passkey).Error; err != nil {
+		t.Fatal(err)
+	}
+	var credential webauthn.Credential
+	if err := json.Unmarshal([]byte(passkey.Credential), &credential); err != nil {
+		t.Fatal(err)
+	}
+	return credential.Authenticator.SignCount
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	setup(t)
+	user := createUser(t, "ana@example.com", "password")
+	a := newAuthenticator(t)
+
+	registerPasskey(t, user, a)
+	var passkey domain.Passkey
+	if err := database.DB.Where("user_id = ?", user.ID).First(&passkey).Error; err != nil {
+		t.Fatalf("no passkey stored: %v", err)
+	}
+	if passkey.Name != "Laptop" || passkey.CredentialID != encode(a.credentialID) {
+		t.Fatalf("stored passkey %q %s", passkey.Name, passkey.CredentialID)
+	}
+
+	c := newClient()
+	w := passkeyLogin(t, c, a, a.userHandle)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", w.Code, w.Body.String())
+	}
+	if got := c.get(whoAmI, "/").Body.String(); got != user.Email {
+		t.Fatalf("signed in as %q, want %q", got, user.Email)
+	}
+	if n := storedSignCount(t, user.ID); n != a.signCount {
+		t.Fatalf("stored sign count %d, want %d", n, a.signCount)
+	}
+	database.DB.First(&passkey, passkey.ID)
+	if passkey.LastUsedAt == nil {
+		t.Fatal("last use was not recorded")
+	}
+}
+
+func TestPasskeyLoginRejectsReusedSignCount(t *testing.T) {
+	setup(t)
+	user := createUser(t, "ana@example.com", "password")
+	a := newAuthenticator(t)
+	registerPasskey(t, user, a)
+
+	if w := passkeyLogin(t, newClient(), a, a.userHandle); w.Code != http.StatusOK {
+		t.Fatalf("first login: %d", w.Code)
+	}
+
+	// A clone still at the old count
+	a.signCount--
+	c := newClient()
+	if w := passkeyLogin(t, c, a, a.userHandle); w.Code != http.StatusUnauthorized {
+		t.Fatalf("login with a reused sign count: %d, want 401", w.Code)
+	}
+	if c.get(whoAmI, "/").Code != http.StatusSeeOther {
+		t.Fatal("a cloned authenticator signed in")
+	}
+	if n := storedSignCount(t, user.ID); n != 1 {
+		t.Fatalf("stored sign count %d, want 1", n)
+	}
+}
+
+func TestPasskeyLoginRejectsWrongUser(t *testing.T) {
+	setup(t)
+	ana := createUser(t, "ana@example.com", "password")
+	ben := createUser(t, "ben@example.com", "password")
+	anas := newAuthenticator(t)
+	bens := newAuthenticator(t)
+	registerPasskey(t, ana, anas)
+	registerPasskey(t, ben, bens)
+
+	// Ana's credential, claiming to be Ben's
+	c := newClient()
+	if w := passkeyLogin(t, c, anas, bens.userHandle); w.Code != http.StatusUnauthorized {
+		t.Fatalf("login with another user's handle: %d, want 401", w.Code)
+	}
+	if c.get(whoAmI, "/").Code != http.StatusSeeOther {
+		t.Fatal("signed in with another user's credential")
+	}
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"gorm.io/gorm"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/mailer"
+)
+
+const (
+	resetTokenTTL     = time.Hour
+	minPasswordLength = 8
+)
+
+// ForgotPasswordHandler emails a reset link. The response is the same
+// whether or not the address has an account.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"CSRFField": csrf.TemplateField(r),
+	}
+
+	if r.Method == http.MethodPost {
+		email := strings.TrimSpace(r.FormValue("email"))
+
+		// The link is created and mailed in the background, so the response
+		// takes as long whether or not the address has an account
+		var user domain.User
+		if result := database.DB.Where("email = ?", email).First(&user); result.Error == nil {
+			ctx := context.WithoutCancel(r.Context())
+			go func() {
+				if err := sendResetLink(ctx, user); err != nil {
+					log.Printf("Password reset for user %d failed: %v", user.ID, err)
+				}
+			}()
+		}
+
+		data["Sent"] = true
+		data["Email"] = email
+	}
+
+	tmpl, err := template.ParseFiles("internal/features/auth/forgot_password.html", "templates/footer.html", "templates/analytics.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, data)
+}
+
+// ResetPasswordHandler shows and processes the form behind an emailed link
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	data := map[string]interface{}{
+		"CSRFField": csrf.TemplateField(r),
+		"Token":     token,
+	}
+
+	resetToken, ok := findResetToken(token)
+	if !ok {
+		data["Invalid"] = true
+	} else if r.Method == http.MethodPost {
+		password := r.FormValue("password")
+		switch {
+		case len(password) < minPasswordLength:
+			data["Error"] = "Your password must be at least 8 characters."
+		case password != r.FormValue("confirm_password"):
+			data["Error"] = "The passwords do not match."
+		default:
+			if err := resetPassword(resetToken, password); err != nil {
+				log.Printf("Password reset for user %d failed: %v", resetToken.UserID, err)
+				http.Error(w, "Could not reset password", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/login?reset=1", http.StatusSeeOther)
+			return
+		}
+	}
+
+	tmpl, err := template.ParseFiles("internal/features/auth/reset_password.html", "templates/footer.html", "templates/analytics.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, data)
+}
+
+func sendResetLink(ctx context.Context, user domain.User) error {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	// Only the newest link is valid
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND used_at IS NULL", user.ID).Delete(&domain.PasswordResetToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&domain.PasswordResetToken{
+			UserID:    user.ID,
+			TokenHash: hashToken(token),
+			ExpiresAt: time.Now().Add(resetTokenTTL),
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	return mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Winetrackr password",
+		Body: "Hi,\n\n" +
+			"Someone asked to reset the password for your Winetrackr account. Use the link below to choose a new one. " +
+			"It can be used once and expires in one hour.\n\n" +
+			mailer.AppURL("/reset-password?token="+url.QueryEscape(token)) + "\n\n" +
+			"If you didn't ask for this, you can ignore this email; your password stays the same.\n",
+	})
+}
+
+func findResetToken(token string) (domain.PasswordResetToken, bool) {
+	var resetToken domain.PasswordResetToken
+	if token == "" {
+		return resetToken, false
+	}
+	err := database.DB.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashToken(token), time.Now()).
+		First(&resetToken).Error
+	return resetToken, err == nil
+}
+
+// resetPassword sets the new password, uses up the token and signs out
+// every existing session of the user
+func resetPassword(resetToken domain.PasswordResetToken, password string) error {
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&domain.PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL", resetToken.ID).Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		if err := tx.Model(&domain.User{}).Where("id = ?", resetToken.UserID).
+			Update("password_hash", hashedPassword).Error; err != nil {
+			return err
+		}
+		return EndSessions(tx, resetToken.UserID)
+	})
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/mailer"
+)
+
+var resetLink = regexp.MustCompile(`/reset-password\?token=(\S+)`)
+
+// requestReset submits the forgot password form and returns the token from
+// the emailed link
+func requestReset(t *testing.T, sent <-chan mailer.Message, email string) string {
+	t.Helper()
+	w := newClient().post(ForgotPasswordHandler, "/forgot-password", url.Values{"email": {email}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "If an account exists") {
+		t.Fatalf("forgot password: %d %s", w.Code, w.Body.String())
+	}
+	msg := nextMail(t, sent)
+	if msg.To != email {
+		t.Fatalf("reset link sent to %q, want %q", msg.To, email)
+	}
+	m := resetLink.FindStringSubmatch(msg.Body)
+	if m == nil {
+		t.Fatalf("no reset link in %q", msg.Body)
+	}
+	token, err := url.QueryUnescape(m[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func resetForm(token, password string) url.Values {
+	return url.Values{"token": {token}, "password": {password}, "confirm_password": {password}}
+}
+
+func isInvalidLink(body string) bool {
+	return strings.Contains(body, "This reset link is invalid or has expired")
+}
+
+func TestPasswordResetTokenIsSingleUse(t *testing.T) {
+	setup(t)
+	sent := captureMail(t)
+	user := createUser(t, "ana@example.com", "old-password")
+
+	token := requestReset(t, sent, user.Email)
+
+	c := newClient()
+	if w := c.get(ResetPasswordHandler, "/reset-password?token="+url.QueryEscape(token)); isInvalidLink(w.Body.String()) {
+		t.Fatal("a fresh link is shown as invalid")
+	}
+	w := c.post(ResetPasswordHandler, "/reset-password", resetForm(token, "new-password"))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login?reset=1" {
+		t.Fatalf("reset: %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	var reloaded domain.User
+	database.DB.First(&reloaded, user.ID)
+	if !CheckPasswordHash("new-password", reloaded.PasswordHash) {
+		t.Fatal("password was not changed")
+	}
+
+	// The same link can't set the password again
+	w = c.post(ResetPasswordHandler, "/reset-password", resetForm(token, "other-password"))
+	if w.Code != http.StatusOK || !isInvalidLink(w.Body.String()) {
+		t.Fatalf("second use: %d, want the invalid link page", w.Code)
+	}
+	database.DB.First(&reloaded, user.ID)
+	if !CheckPasswordHash("new-password", reloaded.PasswordHash) {
+		t.Fatal("a used link changed the password")
+	}
+}
+
+func TestPasswordResetOnlyNewestLinkIsValid(t *testing.T) {
+	setup(t)
+	sent := captureMail(t)
+	user := createUser(t, "ana@example.com", "old-password")
+
+	first := requestReset(t, sent, user.Email)
+	second := requestReset(t, sent, user.Email)
+
+	if _, ok := findResetToken(first); ok {
+		t.Error("an older link is still valid")
+	}
+	if _, ok := findResetToken(second); !ok {
+		t.Error("the newest link is not valid")
+	}
+}
+
+func TestPasswordResetExpiredToken(t *testing.T) {
+	setup(t)
+	sent := captureMail(t)
+	user := createUser(t, "ana@example.com", "old-password")
+
+	token := requestReset(t, sent, user.Email)
+	database.DB.Model(&domain.PasswordResetToken{}).Where("user_id = ?", user.ID).
+		Update("expires_at", time.Now().Add(-time.Minute))
+
+	c := newClient()
+	if w := c.get(ResetPasswordHandler, "/reset-password?token="+url.QueryEscape(token)); !isInvalidLink(w.Body.String()) {
+		t.Fatal("an expired link is accepted")
+	}
+	if w := c.post(ResetPasswordHandler, "/reset-password", resetForm(token, "new-password")); !isInvalidLink(w.Body.String()) {
+		t.Fatal("an expired link reset the password")
+	}
+
+	var reloaded domain.User
+	database.DB.First(&reloaded, user.ID)
+	if !CheckPasswordHash("old-password", reloaded.PasswordHash) {
+		t.Fatal("an expired link changed the password")
+	}
+}
+
+func TestPasswordResetEndsOtherSessions(t *testing.T) {
+	setup(t)
+	sent := captureMail(t)
+	user := createUser(t, "ana@example.com", "old-password")
+	other := createUser(t, "ben@example.com", "password")
+
+	laptop := logInAs(t, user)
+	phone := logInAs(t, user)
+	bystander := logInAs(t, other)
+	if n := sessionCount(t, user.ID); n != 2 {
+		t.Fatalf("%d sessions before the reset, want 2", n)
+	}
+
+	token := requestReset(t, sent, user.Email)
+	if w := newClient().post(ResetPasswordHandler, "/reset-password", resetForm(token, "new-password")); w.Code != http.StatusSeeOther {
+		t.Fatalf("reset: %d", w.Code)
+	}
+
+	if n := sessionCount(t, user.ID); n != 0 {
+		t.Errorf("%d sessions left after the reset, want 0", n)
+	}
+	for name, c := range map[string]*client{"laptop": laptop, "phone": phone} {
+		if w := c.get(whoAmI, "/"); w.Code != http.StatusSeeOther {
+			t.Errorf("%s is still signed in: %d", name, w.Code)
+		}
+	}
+	if w := bystander.get(whoAmI, "/"); w.Code != http.StatusOK || w.Body.String() != other.Email {
+		t.Errorf("another user's session ended: %d", w.Code)
+	}
+}
+
+func TestForgotPasswordUnknownEmail(t *testing.T) {
+	setup(t)
+	sent := captureMail(t)
+	createUser(t, "ana@example.com", "password")
+
+	w := newClient().post(ForgotPasswordHandler, "/forgot-password", url.Values{"email": {"nobody@example.com"}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "If an account exists") {
+		t.Fatalf("forgot password: %d", w.Code)
+	}
+	select {
+	case msg := <-sent:
+		t.Fatalf("email sent to %s for an unknown address", msg.To)
+	case <-time.After(100 * time.Millisecond):
+	}
+	var count int64
+	database.DB.Model(&domain.PasswordResetToken{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("%d reset tokens created, want 0", count)
+	}
+}
@@ -6,11 +6,16 @@ import (
 	"net/http"
 	"os"
 
+	"wine-cellar/internal/domain"
+
 	"github.com/gorilla/sessions"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var store *sessions.CookieStore
+var store *sessionStore
+
+// signingKey authenticates links sent by email
+var signingKey []byte
 
 func Init() {
 	secret := os.Getenv("SESSION_SECRET")
@@ -22,7 +27,11 @@ func Init() {
 		secret = "super-secret-key"
 	}
 
-	store = sessions.NewCookieStore([]byte(secret))
+	store = newSessionStore()
+	signingKey = []byte(secret)
+
+	initPasskeys()
+	initOIDC()
 
 	store.Options = &sessions.Options{
 		Path:     "/",
@@ -54,6 +63,33 @@ func NeedsRehash(hash string) bool {
 	return cost > bcrypt.DefaultCost
 }
 
+// logIn marks the session as authenticated for the user, under a new token
+func logIn(w http.ResponseWriter, r *http.Request, user domain.User) {
+	session, _ := store.Get(r, "session-name")
+	if err := store.renew(session); err != nil {
+		log.Printf("Could not renew session: %v", err)
+	}
+	session.Values["authenticated"] = true
+	session.Values["user_id"] = user.ID
+	session.Values["email"] = user.Email
+	session.Save(r, w)
+}
+
+// accountDisabled refuses to log in a user that an admin has disabled
+func accountDisabled(w http.ResponseWriter, user domain.User) bool {
+	if user.DisabledAt == nil {
+		return false
+	}
+	http.Error(w, "This account has been disabled. Please contact support.", http.StatusForbidden)
+	return true
+}
+
+// clearSession signs the device out by deleting its session
+func clearSession(w http.ResponseWriter, r *http.Request, session *sessions.Session) {
+	session.Options.MaxAge = -1
+	session.Save(r, w)
+}
+
 // Middleware checks if the user is logged in
 func Middleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -73,6 +109,12 @@ func Middleware(next http.HandlerFunc) http.HandlerFunc {
 		email := session.Values["email"].(string)
 		ctx := context.WithValue(r.Context(), "user_id", userID)
 		ctx = context.WithValue(ctx, "email", email)
+
+		if adminID, ok := session.Values["impersonator_id"].(uint); ok {
+			adminEmail, _ := session.Values["impersonator_email"].(string)
+			impersonating(w, r.WithContext(ctx), next, adminID, adminEmail)
+			return
+		}
 		next(w, r.WithContext(ctx))
 	}
 }
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/jobs"
+)
+
+// ActiveSession is a signed in device as shown in settings
+type ActiveSession struct {
+	ID         uint
+	Device     string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	Current    bool // The device making the request
+}
+
+// ActiveSessions lists the signed in devices of the user, most recently
+// used first
+func ActiveSessions(r *http.Request, userID uint) ([]ActiveSession, error) {
+	var rows []domain.Session
+	if err := database.DB.Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	current := currentSessionHash(r)
+	list := make([]ActiveSession, len(rows))
+	for i, row := range rows {
+		list[i] = ActiveSession{
+			ID:         row.ID,
+			Device:     row.Device,
+			IP:         row.IP,
+			CreatedAt:  row.CreatedAt,
+			LastSeenAt: row.LastSeenAt,
+			Current:    row.TokenHash == current,
+		}
+	}
+	return list, nil
+}
+
+// RevokeSessionHandler signs out one of the user's devices. Signing out the
+// current device is the same as logging out.
+func RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("user_id").(uint)
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var row domain.Session
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).Take(&row).Error; err != nil {
+		http.Redirect(w, r, "/settings#sessions", http.StatusSeeOther)
+		return
+	}
+
+	if row.TokenHash == currentSessionHash(r) {
+		session, _ := store.Get(r, "session-name")
+		clearSession(w, r, session)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := database.DB.Delete(&row).Error; err != nil {
+		http.Error(w, "Could not sign out device", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/settings#sessions", http.StatusSeeOther)
+}
+
+// RevokeOtherSessionsHandler signs out every device except the current one
+func RevokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("user_id").(uint)
+
+	if err := database.DB.Where("user_id = ? AND token_hash <> ?", userID, currentSessionHash(r)).
+		Delete(&domain.Session{}).Error; err != nil {
+		http.Error(w, "Could not sign out devices", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/settings#sessions", http.StatusSeeOther)
+}
+
+// ScheduleSessionPruning deletes expired sessions every
+// SESSION_PRUNE_INTERVAL (default 1h)
+func ScheduleSessionPruning() {
+	jobs.Every("session-prune", jobs.Duration("SESSION_PRUNE_INTERVAL", time.Hour), PruneSessions)
+}
+
+func currentSessionHash(r *http.Request) string {
+	session, _ := store.Get(r, "session-name")
+	if session.ID == "" {
+		return ""
+	}
+	return hashToken(session.ID)
+}
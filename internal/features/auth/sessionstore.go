@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/clientip"
+	"wine-cellar/internal/shared/database"
+)
+
+// lastSeenInterval limits how often a session's last seen time is written
+const lastSeenInterval = time.Minute
+
+// sessionStore is a gorilla sessions.Store that keeps session values in the
+// database. The cookie only holds a random token, whose SHA-256 hash
+// identifies the row, so deleting the row signs the device out.
+type sessionStore struct {
+	Options *sessions.Options
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{Options: &sessions.Options{Path: "/", MaxAge: 86400 * 7}}
+}
+
+func (s *sessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *sessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil || cookie.Value == "" {
+		return session, nil
+	}
+
+	var row domain.Session
+	err = database.DB.Where("token_hash = ? AND expires_at > ?", hashToken(cookie.Value), time.Now()).Take(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+
+	if err := gob.NewDecoder(strings.NewReader(row.Data)).Decode(&session.Values); err != nil {
+		return session, nil
+	}
+	session.ID = cookie.Value
+	session.IsNew = false
+
+	// Keep an active session alive and record where it was last used
+	if now := time.Now(); now.Sub(row.LastSeenAt) > lastSeenInterval {
+		database.DB.Model(&row).Updates(map[string]interface{}{
+			"last_seen_at": now,
+			"ip":           clientip.From(r),
+			"expires_at":   now.Add(time.Duration(opts.MaxAge) * time.Second),
+		})
+	}
+	return session, nil
+}
+
+func (s *sessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	// A session left without a user or a pending sign-in is deleted rather
+	// than kept around
+	if session.Options.MaxAge < 0 || !worthKeeping(session) {
+		if session.ID != "" {
+			if err := database.DB.Where("token_hash = ?", hashToken(session.ID)).Delete(&domain.Session{}).Error; err != nil {
+				return err
+			}
+		}
+		expired := *session.Options
+		expired.MaxAge = -1
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", &expired))
+		return nil
+	}
+
+	if session.ID == "" {
+		token, err := sessionToken()
+		if err != nil {
+			return err
+		}
+		session.ID = token
+	}
+
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(session.Values); err != nil {
+		return err
+	}
+
+	userID, _ := session.Values["user_id"].(uint)
+	if authenticated, _ := session.Values["authenticated"].(bool); !authenticated {
+		userID = 0
+	}
+	// An admin viewing as another user keeps the session in their own list
+	if adminID, ok := session.Values["impersonator_id"].(uint); ok {
+		userID = adminID
+	}
+
+	pendingUserID, _ := session.Values["pending_user_id"].(uint)
+
+	now := time.Now()
+	row := domain.Session{
+		TokenHash:     hashToken(session.ID),
+		UserID:        userID,
+		PendingUserID: pendingUserID,
+		Data:          data.String(),
+		Device:        deviceName(r.UserAgent()),
+		IP:            clientip.From(r),
+		LastSeenAt:    now,
+		ExpiresAt:     now.Add(time.Duration(session.Options.MaxAge) * time.Second),
+	}
+	err := database.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "token_hash"}},
+		DoUpdates: clause.AssignmentColumns([]string{"user_id", "pending_user_id", "data", "last_seen_at", "expires_at"}),
+	}).Create(&row).Error
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), session.ID, session.Options))
+	return nil
+}
+
+// worthKeeping reports whether the session needs a row: it is signed in, or
+// a sign-in is waiting for a second factor or an OIDC provider. Anonymous
+// visitors get none, so unauthenticated requests can't fill the table.
+func worthKeeping(session *sessions.Session) bool {
+	if authenticated, _ := session.Values["authenticated"].(bool); authenticated {
+		return true
+	}
+	_, twoFactor := session.Values["pending_user_id"]
+	_, oidcLogin := session.Values["oidc_login"]
+	return twoFactor || oidcLogin
+}
+
+// renew moves the session's values to a new token, so that a token obtained
+// before logging in cannot be used afterwards
+func (s *sessionStore) renew(session *sessions.Session) error {
+	if session.ID != "" {
+		if err := database.DB.Where("token_hash = ?", hashToken(session.ID)).Delete(&domain.Session{}).Error; err != nil {
+			return err
+		}
+	}
+	session.ID = ""
+	return nil
+}
+
+// EndSessions signs the user out on every device, including sign-ins still
+// waiting for the second factor
+func EndSessions(db *gorm.DB, userID uint) error {
+	return db.Where("user_id = ? OR pending_user_id = ?", userID, userID).Delete(&domain.Session{}).Error
+}
+
+// PruneSessions deletes expired sessions
+func PruneSessions(ctx context.Context) error {
+	return database.DB.WithContext(ctx).Where("expires_at < ?", time.Now()).Delete(&domain.Session{}).Error
+}
+
+func sessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// deviceName turns a User-Agent header into something like "Firefox on
+// Windows"
+func deviceName(userAgent string) string {
+	browser := ""
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"FxiOS/", "Firefox"},
+		{"CriOS/", "Chrome"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	system := ""
+	for _, o := range []struct{ token, name string }{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, o.token) {
+			system = o.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	case userAgent != "":
+		if len(userAgent) > 60 {
+			return userAgent[:60]
+		}
+		return userAgent
+	}
+	return "Unknown device"
+}
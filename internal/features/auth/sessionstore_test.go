@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+)
+
+func sessionRows(t *testing.T) int64 {
+	t.Helper()
+	var count int64
+	if err := database.DB.Model(&domain.Session{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestAnonymousSessionsAreNotStored(t *testing.T) {
+	setup(t)
+
+	c := newClient()
+	c.do(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "session-name")
+		session.Values["visited"] = true
+		if err := session.Save(r, w); err != nil {
+			t.Fatal(err)
+		}
+	}, httptest.NewRequest(http.MethodPost, "/login", nil))
+
+	if n := sessionRows(t); n != 0 {
+		t.Fatalf("%d session rows for an anonymous visitor, want 0", n)
+	}
+	if c.cookies["session-name"] != nil {
+		t.Fatal("an anonymous visitor got a session cookie")
+	}
+}
+
+func TestPendingSignInIsStored(t *testing.T) {
+	setup(t)
+	user := createUser(t, "ana@example.com", "password")
+
+	c := newClient()
+	c.do(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "session-name")
+		session.Values["pending_user_id"] = user.ID
+		if err := session.Save(r, w); err != nil {
+			t.Fatal(err)
+		}
+	}, httptest.NewRequest(http.MethodPost, "/login", nil))
+
+	var row domain.Session
+	if err := database.DB.First(&row).Error; err != nil {
+		t.Fatalf("no row for a pending sign-in: %v", err)
+	}
+	if row.UserID != 0 || row.PendingUserID != user.ID {
+		t.Fatalf("pending sign-in stored for user %d pending %d, want 0 and %d until it completes", row.UserID, row.PendingUserID, user.ID)
+	}
+	if c.get(whoAmI, "/").Code != http.StatusSeeOther {
+		t.Fatal("a pending sign-in counts as signed in")
+	}
+
+	// Ending the user's sessions, e.g. on erasure, drops it too
+	if err := EndSessions(database.DB, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n := sessionRows(t); n != 0 {
+		t.Fatalf("%d session rows after ending the user's sessions, want 0", n)
+	}
+}
+
+func TestPasskeyLoginBeginStoresNoSession(t *testing.T) {
+	setup(t)
+
+	c := newClient()
+	w := c.do(BeginPasskeyLoginHandler, httptest.NewRequest(http.MethodPost, "/passkeys/login/begin", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("begin: %d %s", w.Code, w.Body.String())
+	}
+	if n := sessionRows(t); n != 0 {
+		t.Fatalf("%d session rows after starting a passkey login, want 0", n)
+	}
+	if c.cookies["passkey_login"] == nil {
+		t.Fatal("the login challenge was not kept")
+	}
+}
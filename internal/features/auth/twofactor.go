@@ -0,0 +1,281 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"github.com/skip2/go-qrcode"
+	"gorm.io/gorm"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/totp"
+	"wine-cellar/internal/shared/ui"
+)
+
+const (
+	totpIssuer        = "Winetrackr"
+	recoveryCodeCount = 10
+	// How long the second login step may take after the password was accepted
+	secondFactorTTL = 5 * time.Minute
+)
+
+// startSecondFactor remembers a user whose password was accepted but who
+// still has to enter a code. The session is not authenticated yet.
+func startSecondFactor(w http.ResponseWriter, r *http.Request, user domain.User) {
+	session, _ := store.Get(r, "session-name")
+	session.Values["authenticated"] = false
+	session.Values["pending_user_id"] = user.ID
+	session.Values["pending_until"] = time.Now().Add(secondFactorTTL).Unix()
+	session.Save(r, w)
+}
+
+// LoginTwoFactorHandler is the second login step for users with two-factor
+// authentication enabled
+func LoginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	userID, _ := session.Values["pending_user_id"].(uint)
+	until, _ := session.Values["pending_until"].(int64)
+	if userID == 0 || time.Now().Unix() > until {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	data := map[string]interface{}{
+		"CSRFField": csrf.TemplateField(r),
+	}
+
+	if r.Method == http.MethodPost {
+		var user domain.User
+		if err := database.DB.First(&user, userID).Error; err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		if accountDisabled(w, user) {
+			return
+		}
+
+		if wait := loginLocked(r, user.Email); wait > 0 {
+			tooManyAttempts(w, wait)
+			return
+		}
+
+		if verifySecondFactor(&user, r.FormValue("code")) {
+			delete(session.Values, "pending_user_id")
+			delete(session.Values, "pending_until")
+			session.Save(r, w)
+			loginSucceeded(r, user.Email)
+			logIn(w, r, user)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		loginFailed(r, user.Email, &user)
+		data["Error"] = "That code is not valid. Please try again."
+	}
+
+	tmpl, err := template.ParseFiles("internal/features/auth/login_2fa.html", "templates/footer.html", "templates/analytics.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, data)
+}
+
+// TwoFactorSettingsHandler enrols, manages and disables two-factor
+// authentication for the logged in user
+func TwoFactorSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(uint)
+	userEmail := r.Context().Value("email").(string)
+
+	var user domain.User
+	if err := database.DB.First(&user, userID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	session, _ := store.Get(r, "session-name")
+	data := map[string]interface{}{
+		"LoggedIn":  true,
+		"UserEmail": userEmail,
+		"CSRFField": csrf.TemplateField(r),
+	}
+
+	if r.Method == http.MethodPost {
+		code := r.FormValue("code")
+		switch r.FormValue("action") {
+		case "enable":
+			secret, _ := session.Values["totp_setup_secret"].(string)
+			step, ok := totp.Validate(secret, code, time.Now())
+			if secret == "" || !ok {
+				data["Error"] = "That code is not valid. Check the time on your device and try again."
+				break
+			}
+			codes, err := enableTwoFactor(&user, secret, step)
+			if err != nil {
+				log.Printf("Enabling two-factor authentication for user %d failed: %v", user.ID, err)
+				http.Error(w, "Could not enable two-factor authentication", http.StatusInternalServerError)
+				return
+			}
+			delete(session.Values, "totp_setup_secret")
+			session.Save(r, w)
+			data["RecoveryCodes"] = codes
+		case "recovery-codes":
+			if !user.TOTPEnabled || !verifySecondFactor(&user, code) {
+				data["Error"] = "That code is not valid."
+				break
+			}
+			codes, err := replaceRecoveryCodes(database.DB, user.ID)
+			if err != nil {
+				http.Error(w, "Could not generate recovery codes", http.StatusInternalServerError)
+				return
+			}
+			data["RecoveryCodes"] = codes
+		case "disable":
+			if !user.TOTPEnabled || !verifySecondFactor(&user, code) {
+				data["Error"] = "That code is not valid."
+				break
+			}
+			if err := disableTwoFactor(&user); err != nil {
+				http.Error(w, "Could not disable two-factor authentication", http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+	}
+
+	data["Enabled"] = user.TOTPEnabled
+	if user.TOTPEnabled {
+		var remaining int64
+		database.DB.Model(&domain.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", user.ID).Count(&remaining)
+		data["RemainingCodes"] = remaining
+	} else {
+		// Keep the secret across reloads so a scanned QR code stays valid
+		secret, _ := session.Values["totp_setup_secret"].(string)
+		if secret == "" {
+			var err error
+			if secret, err = totp.GenerateSecret(); err != nil {
+				http.Error(w, "Could not generate secret", http.StatusInternalServerError)
+				return
+			}
+			session.Values["totp_setup_secret"] = secret
+			session.Save(r, w)
+		}
+		// The QR code is drawn here: the URI holds the secret, so it must not
+		// be handed to a third-party script
+		png, err := qrcode.Encode(totp.ProvisioningURI(totpIssuer, user.Email, secret), qrcode.Medium, 352)
+		if err != nil {
+			http.Error(w, "Could not generate QR code", http.StatusInternalServerError)
+			return
+		}
+		data["Secret"] = secret
+		data["QRCode"] = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+
+	tmpl, err := template.New("twofactor.html").Funcs(ui.FuncMap).ParseFiles("internal/features/auth/twofactor.html", "templates/header.html", "templates/footer.html", "templates/analytics.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, data)
+}
+
+// verifySecondFactor accepts an authenticator code or an unused recovery
+// code. Each code is accepted once only.
+func verifySecondFactor(user *domain.User, code string) bool {
+	if !user.TOTPEnabled {
+		return false
+	}
+
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok {
+		if step <= user.TOTPLastCounter {
+			return false
+		}
+		// Conditional update so two concurrent requests cannot both use the code
+		result := database.DB.Model(&domain.User{}).
+			Where("id = ? AND totp_last_counter < ?", user.ID, step).Update("totp_last_counter", step)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return false
+		}
+		user.TOTPLastCounter = step
+		return true
+	}
+
+	result := database.DB.Model(&domain.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+func enableTwoFactor(user *domain.User, secret string, step int64) ([]string, error) {
+	var codes []string
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Updates(map[string]interface{}{
+			"totp_secret":       secret,
+			"totp_enabled":      true,
+			"totp_last_counter": step,
+		}).Error; err != nil {
+			return err
+		}
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	return codes, err
+}
+
+func disableTwoFactor(user *domain.User) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&domain.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(user).Updates(map[string]interface{}{
+			"totp_secret":       "",
+			"totp_enabled":      false,
+			"totp_last_counter": 0,
+		}).Error
+	})
+}
+
+// replaceRecoveryCodes discards the user's recovery codes and returns a new
+// set. The plain codes are only ever shown once.
+func replaceRecoveryCodes(db *gorm.DB, userID uint) ([]string, error) {
+	if err := db.Where("user_id = ?", userID).Delete(&domain.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	rows := make([]domain.RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(raw))
+		codes[i] = code[:4] + "-" + code[4:]
+		rows[i] = domain.RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(codes[i])}
+	}
+	if err := db.Create(&rows).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode ignores case, spaces and dashes so codes can be typed
+// loosely
+func hashRecoveryCode(code string) string {
+	code = strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
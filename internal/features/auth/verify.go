@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/mailer"
+)
+
+const verificationTTL = 48 * time.Hour
+
+// Where a verification link may send the user afterwards
+var verifyNextPaths = map[string]string{
+	"checkout": "/create-checkout-session",
+}
+
+// RequireVerified only lets users with a verified email address through. It
+// must be wrapped by Middleware.
+func RequireVerified(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+
+		var user domain.User
+		if err := database.DB.Select("email_verified").First(&user, userID).Error; err != nil {
+			http.Error(w, "User not found", http.StatusInternalServerError)
+			return
+		}
+		if !user.EmailVerified {
+			http.Redirect(w, r, "/verify-email", http.StatusSeeOther)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// VerifyEmailHandler confirms an address from an emailed link, or without a
+// token shows the logged in user that a link is on its way
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	sessionUserID, sessionEmail, authenticated := GetSessionUser(r)
+
+	if token := r.URL.Query().Get("token"); token != "" {
+		userID, ok := checkVerificationToken(token)
+		if !ok {
+			renderVerifyEmail(w, r, map[string]interface{}{"Invalid": true, "LoggedIn": authenticated})
+			return
+		}
+
+		now := time.Now()
+		if err := database.DB.Model(&domain.User{}).Where("id = ? AND email_verified = ?", userID, false).
+			Updates(map[string]interface{}{"email_verified": true, "email_verified_at": now}).Error; err != nil {
+			http.Error(w, "Could not verify email", http.StatusInternalServerError)
+			return
+		}
+
+		if !authenticated || sessionUserID != userID {
+			http.Redirect(w, r, "/login?verified=1", http.StatusSeeOther)
+			return
+		}
+		if next, ok := verifyNextPaths[r.URL.Query().Get("next")]; ok {
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/settings?verified=1", http.StatusSeeOther)
+		return
+	}
+
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	var user domain.User
+	if err := database.DB.First(&user, sessionUserID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+	if user.EmailVerified {
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	renderVerifyEmail(w, r, map[string]interface{}{
+		"LoggedIn":  true,
+		"UserEmail": sessionEmail,
+		"Resent":    r.URL.Query().Get("resent") == "1",
+	})
+}
+
+// ResendVerificationHandler sends a new verification link to the logged in user
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(uint)
+
+	var user domain.User
+	if err := database.DB.First(&user, userID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+	if user.EmailVerified {
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	if err := sendVerificationLink(r, user, ""); err != nil {
+		log.Printf("Verification email for user %d failed: %v", user.ID, err)
+		http.Error(w, "Could not send verification email", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/verify-email?resent=1", http.StatusSeeOther)
+}
+
+func renderVerifyEmail(w http.ResponseWriter, r *http.Request, data map[string]interface{}) {
+	tmpl, err := template.ParseFiles("internal/features/auth/verify_email.html", "templates/footer.html", "templates/analytics.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data["CSRFField"] = csrf.TemplateField(r)
+	tmpl.Execute(w, data)
+}
+
+// sendVerificationLink emails a signed link. next names a page from
+// verifyNextPaths to continue to once verified.
+func sendVerificationLink(r *http.Request, user domain.User, next string) error {
+	q := url.Values{}
+	q.Set("token", verificationToken(user, time.Now().Add(verificationTTL)))
+	if next != "" {
+		q.Set("next", next)
+	}
+
+	return mailer.Send(r.Context(), mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your Winetrackr email address",
+		Body: "Welcome to Winetrackr!\n\n" +
+			"Please confirm your email address by opening the link below. It expires in 48 hours.\n\n" +
+			mailer.AppURL("/verify-email?"+q.Encode()) + "\n\n" +
+			"If you didn't create an account, you can ignore this email.\n",
+	})
+}
+
+// verificationToken signs the user ID, email and expiry so that a link stops
+// working once it expires or the address changes
+func verificationToken(user domain.User, expires time.Time) string {
+	payload := fmt.Sprintf("%d.%d", user.ID, expires.Unix())
+	return payload + "." + verificationSignature(payload, user.Email)
+}
+
+func checkVerificationToken(token string) (uint, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	userID, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0, false
+	}
+
+	var user domain.User
+	if err := database.DB.Select("id", "email").First(&user, userID).Error; err != nil {
+		return 0, false
+	}
+	want := verificationSignature(parts[0]+"."+parts[1], user.Email)
+	if !hmac.Equal([]byte(parts[2]), []byte(want)) {
+		return 0, false
+	}
+	return user.ID, true
+}
+
+func verificationSignature(payload, email string) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte("verify-email|" + payload + "|" + strings.ToLower(email)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,122 @@
+package calendar
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+)
+
+// FeedHandler serves /calendar/{token}.ics. It is not behind auth.Middleware
+// since calendar apps cannot log in; the secret token identifies the user.
+func FeedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, "/calendar/")
+	if !strings.HasSuffix(token, ".ics") {
+		http.NotFound(w, r)
+		return
+	}
+	token = strings.TrimSuffix(token, ".ics")
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var user domain.User
+	if result := database.DB.Where("calendar_token = ? AND disabled_at IS NULL", token).First(&user); result.Error != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var wines []domain.Wine
+	if result := database.DB.Preload("TastingEvents").Where("user_id = ?", user.ID).Find(&wines); result.Error != nil {
+		log.Printf("Calendar feed for user %d: %v", user.ID, result.Error)
+		http.Error(w, "Error generating calendar", http.StatusInternalServerError)
+		return
+	}
+
+	body := renderICS(buildEvents(wines), feedHost(r), time.Now())
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", "inline; filename=winetrackr.ics")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Write([]byte(body))
+}
+
+// TokenHandler enables, regenerates or revokes the user's feed token
+func TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(uint)
+
+	var user domain.User
+	if result := database.DB.First(&user, userID); result.Error != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "revoke":
+		user.CalendarToken = ""
+	case "regenerate":
+		token, err := newToken()
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		user.CalendarToken = token
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	database.DB.Model(&user).Update("calendar_token", user.CalendarToken)
+
+	http.Redirect(w, r, "/settings#calendar", http.StatusSeeOther)
+}
+
+// FeedURL returns the subscription URL for a token, or "" if disabled
+func FeedURL(r *http.Request, token string) string {
+	if token == "" {
+		return ""
+	}
+	base := os.Getenv("DOMAIN")
+	if base == "" {
+		base = "http://" + r.Host
+	} else if !strings.HasPrefix(base, "http") {
+		base = "https://" + base
+	}
+	return strings.TrimRight(base, "/") + "/calendar/" + token + ".ics"
+}
+
+func feedHost(r *http.Request) string {
+	host := os.Getenv("DOMAIN")
+	host = strings.TrimPrefix(host, "http://")
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimRight(host, "/")
+	if host == "" {
+		host = r.Host
+	}
+	return host
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
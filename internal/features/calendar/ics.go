@@ -0,0 +1,161 @@
+package calendar
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"wine-cellar/internal/domain"
+)
+
+// event is a single all-day entry in the feed
+type event struct {
+	UID         string
+	Date        time.Time
+	Summary     string
+	Description string
+}
+
+var yearPattern = regexp.MustCompile(`\d{4}`)
+
+// parseDrinkingWindow extracts the opening and closing years from free-form
+// input such as "2025-2035", "2025 – 2035" or "2030". Zero means unknown.
+func parseDrinkingWindow(window string) (from, to int) {
+	years := yearPattern.FindAllString(window, -1)
+	if len(years) == 0 {
+		return 0, 0
+	}
+	from, _ = strconv.Atoi(years[0])
+	if len(years) > 1 {
+		to, _ = strconv.Atoi(years[len(years)-1])
+	}
+	return from, to
+}
+
+func wineLabel(wine domain.Wine) string {
+	label := wine.Name
+	if wine.Producer != "" {
+		label = wine.Producer + " " + label
+	}
+	if !wine.IsNonVintage && wine.Vintage > 0 {
+		label += fmt.Sprintf(" %d", wine.Vintage)
+	}
+	return label
+}
+
+// buildEvents collects all calendar entries for a user's wines
+func buildEvents(wines []domain.Wine) []event {
+	var events []event
+	for _, wine := range wines {
+		label := wineLabel(wine)
+
+		from, to := parseDrinkingWindow(wine.DrinkingWindow)
+		if from > 0 {
+			events = append(events, event{
+				UID:         fmt.Sprintf("wine-%d-window-open", wine.ID),
+				Date:        time.Date(from, time.January, 1, 0, 0, 0, 0, time.UTC),
+				Summary:     "Ready to drink: " + label,
+				Description: fmt.Sprintf("Drinking window %s opens. %d bottle(s) in %s.", wine.DrinkingWindow, wine.Quantity, locationOrCellar(wine)),
+			})
+		}
+		if to > 0 && to >= from {
+			events = append(events, event{
+				UID:         fmt.Sprintf("wine-%d-window-close", wine.ID),
+				Date:        time.Date(to, time.December, 31, 0, 0, 0, 0, time.UTC),
+				Summary:     "Drink up: " + label,
+				Description: fmt.Sprintf("Drinking window %s closes. %d bottle(s) in %s.", wine.DrinkingWindow, wine.Quantity, locationOrCellar(wine)),
+			})
+		}
+
+		if date, err := time.Parse("2006-01-02", wine.DeliveryDate); err == nil {
+			events = append(events, event{
+				UID:         fmt.Sprintf("wine-%d-delivery", wine.ID),
+				Date:        date,
+				Summary:     "Delivery expected: " + label,
+				Description: fmt.Sprintf("%d bottle(s) of %s expected.", wine.Quantity, label),
+			})
+		}
+
+		for _, tasting := range wine.TastingEvents {
+			date, err := time.Parse("2006-01-02", tasting.Date)
+			if err != nil {
+				continue
+			}
+			events = append(events, event{
+				UID:         fmt.Sprintf("tasting-%d", tasting.ID),
+				Date:        date,
+				Summary:     tasting.Title + ": " + label,
+				Description: "Planned tasting of " + label + ".",
+			})
+		}
+	}
+	return events
+}
+
+func locationOrCellar(wine domain.Wine) string {
+	if wine.Location != "" {
+		return wine.Location
+	}
+	return "the cellar"
+}
+
+// renderICS serialises events as an RFC 5545 calendar
+func renderICS(events []event, host string, now time.Time) string {
+	var b strings.Builder
+	writeLine(&b, "BEGIN:VCALENDAR")
+	writeLine(&b, "VERSION:2.0")
+	writeLine(&b, "PRODID:-//Winetrackr//Cellar Calendar//EN")
+	writeLine(&b, "CALSCALE:GREGORIAN")
+	writeLine(&b, "METHOD:PUBLISH")
+	writeLine(&b, "X-WR-CALNAME:Winetrackr Cellar")
+	writeLine(&b, "REFRESH-INTERVAL;VALUE=DURATION:PT12H")
+	writeLine(&b, "X-PUBLISHED-TTL:PT12H")
+
+	stamp := now.UTC().Format("20060102T150405Z")
+	for _, e := range events {
+		writeLine(&b, "BEGIN:VEVENT")
+		writeLine(&b, "UID:"+e.UID+"@"+host)
+		writeLine(&b, "DTSTAMP:"+stamp)
+		writeLine(&b, "DTSTART;VALUE=DATE:"+e.Date.Format("20060102"))
+		writeLine(&b, "DTEND;VALUE=DATE:"+e.Date.AddDate(0, 0, 1).Format("20060102"))
+		writeLine(&b, "SUMMARY:"+escapeText(e.Summary))
+		if e.Description != "" {
+			writeLine(&b, "DESCRIPTION:"+escapeText(e.Description))
+		}
+		writeLine(&b, "TRANSP:TRANSPARENT")
+		writeLine(&b, "END:VEVENT")
+	}
+
+	writeLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+var textEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func escapeText(s string) string {
+	return textEscaper.Replace(s)
+}
+
+// writeLine writes a content line, folding it at 75 octets as required by
+// RFC 5545 without splitting multi-byte characters.
+func writeLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !isRuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74 // continuation lines start with a space
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+func isRuneStart(c byte) bool {
+	return c&0xC0 != 0x80
+}
@@ -0,0 +1,156 @@
+package images
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/jobs"
+	"wine-cellar/internal/shared/storage"
+)
+
+const (
+	// QuarantinePrefix is where dry-run garbage collection moves orphans
+	QuarantinePrefix = "quarantine/"
+	// DefaultGracePeriod protects uploads whose wine is still being saved
+	DefaultGracePeriod = 72 * time.Hour
+)
+
+// ScheduleGarbageCollection runs CollectGarbage in the background. It is
+// configured with STORAGE_GC_INTERVAL (default 24h, "off" to disable),
+// STORAGE_GC_GRACE and STORAGE_GC_DRY_RUN.
+func ScheduleGarbageCollection() {
+	opts := GCOptions{
+		GracePeriod: jobs.Duration("STORAGE_GC_GRACE", DefaultGracePeriod),
+		DryRun:      os.Getenv("STORAGE_GC_DRY_RUN") == "true",
+	}
+	jobs.Every("storage-gc", jobs.Duration("STORAGE_GC_INTERVAL", 24*time.Hour), func(ctx context.Context) error {
+		report, err := CollectGarbage(ctx, database.DB, storage.Default(), opts, log.Printf)
+		if err != nil {
+			return err
+		}
+		log.Printf("Storage GC: scanned %d, deleted %d, quarantined %d, failed %d", report.Scanned, report.Deleted, report.Quarantined, report.Failed)
+		return nil
+	})
+}
+
+// GCOptions controls CollectGarbage
+type GCOptions struct {
+	Prefix      string        // Only objects under this prefix are considered
+	GracePeriod time.Duration // Objects younger than this are never touched
+	DryRun      bool          // Quarantine orphans instead of deleting them
+}
+
+// GCReport summarises a garbage collection run
+type GCReport struct {
+	Scanned     int
+	Referenced  int
+	Young       int
+	Deleted     int
+	Quarantined int
+	Failed      int
+}
+
+// CollectGarbage removes stored images no wine refers to any more. Objects
+// uploaded less than GracePeriod ago are kept, since the wine that will
+// reference them may not have been saved yet. Soft-deleted wines still
+// count as references so restoring from the trash keeps their images.
+func CollectGarbage(ctx context.Context, db *gorm.DB, store storage.Storage, opts GCOptions, logf func(format string, args ...interface{})) (GCReport, error) {
+	var report GCReport
+	if opts.Prefix == "" {
+		opts.Prefix = "wines/"
+	}
+
+	objects, err := store.List(ctx, opts.Prefix)
+	if err != nil {
+		return report, err
+	}
+
+	referenced, err := referencedKeys(db)
+	if err != nil {
+		return report, err
+	}
+
+	cutoff := time.Now().Add(-opts.GracePeriod)
+	for _, obj := range objects {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		report.Scanned++
+
+		if referenced[obj.Key] {
+			report.Referenced++
+			continue
+		}
+		if obj.LastModified.After(cutoff) {
+			report.Young++
+			continue
+		}
+
+		if opts.DryRun {
+			if err := store.Move(ctx, obj.Key, QuarantinePrefix+obj.Key); err != nil {
+				report.Failed++
+				logf("%s: quarantine FAILED: %v", obj.Key, err)
+				continue
+			}
+			report.Quarantined++
+			logf("%s: quarantined (%d bytes, last modified %s)", obj.Key, obj.Size, obj.LastModified.Format(time.RFC3339))
+			continue
+		}
+
+		if err := store.Delete(ctx, obj.Key); err != nil {
+			report.Failed++
+			logf("%s: delete FAILED: %v", obj.Key, err)
+			continue
+		}
+		report.Deleted++
+		logf("%s: deleted (%d bytes, last modified %s)", obj.Key, obj.Size, obj.LastModified.Format(time.RFC3339))
+	}
+
+	return report, nil
+}
+
+// referencedKeys returns the storage keys of all wine images, including
+// those of soft-deleted wines.
+func referencedKeys(db *gorm.DB) (map[string]bool, error) {
+	var rows []struct {
+		ImageURL     string
+		ThumbnailURL string
+	}
+	if err := db.Unscoped().Model(&domain.Wine{}).Select("image_url", "thumbnail_url").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to load image references: %w", err)
+	}
+
+	keys := make(map[string]bool, len(rows)*2)
+	for _, row := range rows {
+		for _, ref := range []string{row.ImageURL, row.ThumbnailURL} {
+			if key := referencedKey(ref); key != "" {
+				keys[key] = true
+			}
+		}
+	}
+	return keys, nil
+}
+
+// referencedKey is deliberately generous: besides refs that resolve against
+// the current backend, any URL containing a "/wines/" path is treated as
+// referencing that key, so a changed public URL never causes deletions.
+func referencedKey(ref string) string {
+	if key := storage.KeyFromRef(ref); key != "" {
+		return key
+	}
+	if strings.HasPrefix(ref, "data:") {
+		return ""
+	}
+	if i := strings.Index(ref, "/wines/"); i >= 0 {
+		return ref[i+1:]
+	}
+	return ""
+}
@@ -0,0 +1,172 @@
+package images
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/imaging"
+	"wine-cellar/internal/shared/storage"
+)
+
+// MigrationOptions controls MigrateInlineImages
+type MigrationOptions struct {
+	BatchSize  int  // Wines loaded per query
+	Limit      int  // Stop after this many wines, 0 for no limit
+	StartAfter uint // Skip wines with an ID up to and including this one
+	DryRun     bool // Decode and validate only, write nothing
+}
+
+// MigrationReport summarises a migration run
+type MigrationReport struct {
+	Scanned  int
+	Migrated int
+	Skipped  int // Edited by their owner while being migrated
+	Failed   int
+	LastID   uint // Pass as StartAfter to continue after an interrupted run
+}
+
+// MigrateInlineImages moves base64 data-URI images out of the wines table
+// into the configured storage backend and replaces them with storage keys.
+// Each wine is committed on its own, so the migration can be stopped at
+// any time and simply run again: migrated rows no longer match the query.
+func MigrateInlineImages(ctx context.Context, db *gorm.DB, opts MigrationOptions, logf func(format string, args ...interface{})) (MigrationReport, error) {
+	var report MigrationReport
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 50
+	}
+	cursor := opts.StartAfter
+
+	for {
+		var wines []domain.Wine
+		// Include soft-deleted wines so restoring from the trash keeps the image
+		err := db.Unscoped().
+			Select("id", "user_id", "image_url", "thumbnail_url").
+			Where("id > ?", cursor).
+			Where("image_url LIKE ? OR thumbnail_url LIKE ?", "data:%", "data:%").
+			Order("id").
+			Limit(opts.BatchSize).
+			Find(&wines).Error
+		if err != nil {
+			return report, fmt.Errorf("failed to load wines: %w", err)
+		}
+		if len(wines) == 0 {
+			return report, nil
+		}
+
+		for _, wine := range wines {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			if opts.Limit > 0 && report.Scanned >= opts.Limit {
+				return report, nil
+			}
+
+			report.Scanned++
+			cursor = wine.ID
+			report.LastID = wine.ID
+
+			imageKey, thumbKey, err := migrateWine(ctx, db, wine, opts.DryRun)
+			if errors.Is(err, errImageChanged) {
+				report.Skipped++
+				logf("wine %d (user %d): skipped, its image changed during the migration", wine.ID, wine.UserID)
+				continue
+			}
+			if err != nil {
+				report.Failed++
+				logf("wine %d (user %d): FAILED: %v", wine.ID, wine.UserID, err)
+				continue
+			}
+			report.Migrated++
+			if opts.DryRun {
+				logf("wine %d (user %d): ok (dry run)", wine.ID, wine.UserID)
+			} else {
+				logf("wine %d (user %d): migrated to %s (thumbnail %s)", wine.ID, wine.UserID, imageKey, thumbKey)
+			}
+		}
+	}
+}
+
+// errImageChanged means the wine's image was replaced after it was loaded;
+// the new one is kept
+var errImageChanged = errors.New("image changed")
+
+func migrateWine(ctx context.Context, db *gorm.DB, wine domain.Wine, dryRun bool) (string, string, error) {
+	source := wine.ImageURL
+	if !strings.HasPrefix(source, "data:") {
+		// Only the thumbnail is inline. The list view falls back to the full
+		// image, so drop the inline copy rather than re-fetching the original.
+		if dryRun {
+			return wine.ImageURL, "", nil
+		}
+		result := db.Unscoped().Model(&domain.Wine{}).Where("id = ? AND thumbnail_url = ?", wine.ID, wine.ThumbnailURL).UpdateColumn("thumbnail_url", "")
+		if result.Error == nil && result.RowsAffected == 0 {
+			return "", "", errImageChanged
+		}
+		return wine.ImageURL, "", result.Error
+	}
+
+	data, err := decodeDataURI(source)
+	if err != nil {
+		return "", "", err
+	}
+
+	processed, err := imaging.Process(data)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid image: %w", err)
+	}
+	if dryRun {
+		return "", "", nil
+	}
+
+	imageKey, err := storage.SaveImage(processed.Image, processed.ContentType, wine.UserID)
+	if err != nil {
+		return "", "", err
+	}
+	thumbKey, err := storage.SaveImage(processed.Thumbnail, processed.ContentType, wine.UserID)
+	if err != nil {
+		storage.DeleteImage(imageKey)
+		return "", "", err
+	}
+
+	// UpdateColumns leaves updated_at alone; this is not a user edit. The
+	// owner may have uploaded a new image since the wine was loaded, which
+	// must not be overwritten.
+	result := db.Unscoped().Model(&domain.Wine{}).Where("id = ? AND image_url = ?", wine.ID, source).UpdateColumns(map[string]interface{}{
+		"image_url":     imageKey,
+		"thumbnail_url": thumbKey,
+	})
+	if result.Error != nil || result.RowsAffected == 0 {
+		storage.DeleteImage(imageKey)
+		storage.DeleteImage(thumbKey)
+	}
+	if result.Error != nil {
+		return "", "", fmt.Errorf("failed to update wine: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return "", "", errImageChanged
+	}
+
+	return imageKey, thumbKey, nil
+}
+
+// decodeDataURI extracts the payload of a "data:<mime>;base64,<data>" URI
+func decodeDataURI(uri string) ([]byte, error) {
+	header, payload, ok := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !ok {
+		return nil, fmt.Errorf("malformed data URI")
+	}
+	if !strings.HasSuffix(header, ";base64") {
+		return nil, fmt.Errorf("data URI is not base64 encoded")
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,168 @@
+package settings
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/features/auth"
+	"wine-cellar/internal/features/subscription"
+	"wine-cellar/internal/features/wines/trash"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/jobs"
+	"wine-cellar/internal/shared/mailer"
+	"wine-cellar/internal/shared/storage"
+)
+
+// Tables erased with an account that reference the user directly via
+// user_id. Rows hanging off a wine are listed in trash.WineOwned; sessions
+// and rate limit counts are deleted by EraseAccount.
+var userOwned = []interface{}{&domain.Wine{}, &domain.PasswordResetToken{}, &domain.RecoveryCode{}, &domain.Passkey{}, &domain.ExternalIdentity{}, &domain.TierGrant{}, &domain.Invoice{}}
+
+// ErasureGracePeriod is how long a deletion request can still be cancelled.
+// ACCOUNT_DELETION_GRACE_DAYS=0 erases accounts immediately.
+func ErasureGracePeriod() time.Duration {
+	days := 14
+	if v := os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			days = n
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// EraseAccount permanently removes a user and everything they own: the
+// Stripe subscription is cancelled, all rows are hard-deleted in one
+// transaction, stored images are purged, a tombstone is written and a
+// confirmation email is sent.
+func EraseAccount(ctx context.Context, userID uint) error {
+	var user domain.User
+	if err := database.DB.Unscoped().First(&user, userID).Error; err != nil {
+		return fmt.Errorf("user %d not found: %w", userID, err)
+	}
+
+	// Stop billing first; if this fails we must not lose the subscription ID
+	if user.SubscriptionID != "" && user.SubscriptionStatus != "canceled" {
+		if err := subscription.CancelImmediately(user.SubscriptionID); err != nil {
+			return fmt.Errorf("failed to cancel subscription: %w", err)
+		}
+	}
+
+	var images []struct {
+		ImageURL     string
+		ThumbnailURL string
+	}
+	if err := database.DB.Unscoped().Model(&domain.Wine{}).Where("user_id = ?", userID).
+		Select("image_url", "thumbnail_url").Find(&images).Error; err != nil {
+		return fmt.Errorf("failed to load images: %w", err)
+	}
+
+	requestedAt := time.Now()
+	if user.DeletionDueAt != nil {
+		requestedAt = user.DeletionDueAt.Add(-ErasureGracePeriod())
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		wineIDs := tx.Unscoped().Model(&domain.Wine{}).Select("id").Where("user_id = ?", userID)
+		for _, model := range trash.WineOwned {
+			if err := tx.Unscoped().Where("wine_id IN (?)", wineIDs).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		for _, model := range userOwned {
+			if err := tx.Unscoped().Where("user_id = ?", userID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := auth.EndSessions(tx, userID); err != nil {
+			return err
+		}
+		// Failed logins are counted by a hash of the address. Counts kept in
+		// memory lapse within LOCKOUT_WINDOW.
+		if err := tx.Where("key = ?", auth.AccountLimitKey(user.Email)).Delete(&domain.RateLimitEntry{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Delete(&domain.User{}, userID).Error; err != nil {
+			return err
+		}
+		if err := anonymize(tx, user); err != nil {
+			return err
+		}
+		return tx.Create(&domain.AccountErasure{
+			UserID:      userID,
+			EmailHash:   domain.HashEmail(user.Email),
+			RequestedAt: requestedAt,
+			ErasedAt:    time.Now(),
+		}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to erase data: %w", err)
+	}
+
+	// Anything that fails here is picked up by storage garbage collection
+	for _, img := range images {
+		for _, ref := range []string{img.ImageURL, img.ThumbnailURL} {
+			if err := storage.DeleteImage(ref); err != nil {
+				log.Printf("Erasure of user %d: failed to delete %s: %v", userID, ref, err)
+			}
+		}
+	}
+
+	if err := mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Your Winetrackr account has been deleted",
+		Body: "Hi,\n\n" +
+			"As requested, your Winetrackr account and all data associated with it have been permanently deleted, " +
+			"including your wines, reviews, tasting notes and photos. Any subscription has been cancelled.\n\n" +
+			"Thank you for using Winetrackr.\n",
+	}); err != nil {
+		log.Printf("Erasure of user %d: confirmation email failed: %v", userID, err)
+	}
+
+	log.Printf("Erased account of user %d", userID)
+	return nil
+}
+
+// anonymize strips the user from records that outlive the account: Stripe
+// events lose their payload, audit log entries their detail, and trial and
+// promotion redemptions keep only the email hash that stops a second claim
+func anonymize(tx *gorm.DB, user domain.User) error {
+	if user.StripeCustomerID != "" {
+		if err := tx.Model(&domain.StripeEvent{}).Where("customer_id = ?", user.StripeCustomerID).
+			Updates(map[string]interface{}{"payload": nil, "customer_id": "", "error": ""}).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Model(&domain.AdminAuditLog{}).Where("target_user_id = ?", user.ID).
+		Update("detail", "").Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&domain.AdminAuditLog{}).Where("admin_id = ?", user.ID).
+		Update("admin_email", "").Error; err != nil {
+		return err
+	}
+	return tx.Model(&domain.Redemption{}).Where("user_id = ?", user.ID).
+		Updates(map[string]interface{}{"user_id": 0, "checkout_session_id": nil}).Error
+}
+
+// ScheduleAccountErasure erases accounts whose grace period has ended
+func ScheduleAccountErasure() {
+	jobs.Every("account-erasure", jobs.Duration("ACCOUNT_ERASURE_INTERVAL", time.Hour), func(ctx context.Context) error {
+		var due []domain.User
+		if err := database.DB.Where("deletion_due_at IS NOT NULL AND deletion_due_at <= ?", time.Now()).Find(&due).Error; err != nil {
+			return err
+		}
+		for _, user := range due {
+			if err := EraseAccount(ctx, user.ID); err != nil {
+				log.Printf("Erasure of user %d failed, will retry: %v", user.ID, err)
+			}
+		}
+		return nil
+	})
+}
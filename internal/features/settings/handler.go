@@ -4,11 +4,18 @@ import (
 	"encoding/csv"
 	"fmt"
 	"html/template"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 	"wine-cellar/internal/domain"
+	"wine-cellar/internal/features/auth"
+	"wine-cellar/internal/features/calendar"
+	"wine-cellar/internal/features/subscription"
 	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/mailer"
+	"wine-cellar/internal/shared/plans"
 	"wine-cellar/internal/shared/ui"
 
 	"github.com/gorilla/csrf"
@@ -26,6 +33,14 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		var passkeys []domain.Passkey
+		database.DB.Where("user_id = ?", userID).Order("created_at").Find(&passkeys)
+
+		activeSessions, err := auth.ActiveSessions(r, userID)
+		if err != nil {
+			log.Printf("Could not list sessions of user %d: %v", userID, err)
+		}
+
 		// Note: Path to templates is relative to the project root
 		tmpl, err := template.New("settings.html").Funcs(ui.FuncMap).ParseFiles(
 			"internal/features/settings/settings.html",
@@ -39,17 +54,50 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		data := struct {
-			User      domain.User
-			LoggedIn  bool
-			UserEmail string
-			IsDev     bool
-			CSRFField template.HTML
+			User         domain.User
+			Plan         plans.Plan
+			LoggedIn     bool
+			UserEmail    string
+			IsDev        bool
+			CalendarURL  string
+			JustVerified bool
+			Passkeys     []domain.Passkey
+			Sessions     []auth.ActiveSession
+			// Days a deletion request can be cancelled, 0 if immediate
+			DeletionGraceDays int
+			PaymentNotice     *subscription.PaymentNotice // Set while a payment is failing
+			TrialDays         int                         // Free trial still available, 0 if none
+			PromoInvalid      bool
+			Pricing           subscription.Pricing
+			CurrentPrice      *subscription.Price // Nil without a subscription to a catalog price
+			SwitchTo          *subscription.Price // The other billing interval, if offered
+			Switched          bool
+			Archived          int64 // Wines archived for being over the plan's limit
+			Invoices          []subscription.BillingInvoice
+			CSRFField         template.HTML
+			CSRFToken         string
 		}{
-			User:      user,
-			LoggedIn:  true,
-			UserEmail: userEmail,
-			IsDev:     isDev,
-			CSRFField: csrf.TemplateField(r),
+			User:              user,
+			Plan:              plans.For(user),
+			PaymentNotice:     subscription.PaymentProblem(user),
+			TrialDays:         subscription.AvailableTrialDays(user),
+			PromoInvalid:      r.URL.Query().Get("promo") == "invalid",
+			Pricing:           subscription.PricingForUser(user),
+			CurrentPrice:      subscription.CurrentPrice(user),
+			SwitchTo:          subscription.SwitchOption(user),
+			Switched:          r.URL.Query().Get("switched") == "1",
+			Archived:          plans.ArchivedCount(database.DB, user.ID),
+			Invoices:          subscription.BillingHistory(user.ID),
+			LoggedIn:          true,
+			UserEmail:         userEmail,
+			IsDev:             isDev,
+			CalendarURL:       calendar.FeedURL(r, user.CalendarToken),
+			JustVerified:      r.URL.Query().Get("verified") == "1",
+			Passkeys:          passkeys,
+			Sessions:          activeSessions,
+			DeletionGraceDays: int(ErasureGracePeriod().Hours() / 24),
+			CSRFField:         csrf.TemplateField(r),
+			CSRFToken:         csrf.Token(r),
 		}
 
 		tmpl.Execute(w, data)
@@ -68,6 +116,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 				}
 				user.SubscriptionTier = debugTier
 				database.DB.Save(&user)
+				plans.ApplyLimit(database.DB, user.ID, user.SubscriptionTier)
 				http.Redirect(w, r, "/settings", http.StatusSeeOther)
 				return
 			}
@@ -145,27 +194,56 @@ func DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userID := r.Context().Value("user_id").(uint)
+	userEmail := r.Context().Value("email").(string)
 
-	// Start transaction
-	tx := database.DB.Begin()
+	grace := ErasureGracePeriod()
+	if grace == 0 {
+		if err := EraseAccount(r.Context(), userID); err != nil {
+			log.Printf("Erasure of user %d failed: %v", userID, err)
+			http.Error(w, "Could not delete account, please try again later", http.StatusInternalServerError)
+			return
+		}
+
+		// Clear session (redirect to logout handler or do it here)
+		// For simplicity, we'll just redirect to logout which handles session clearing
+		http.Redirect(w, r, "/logout", http.StatusSeeOther)
+		return
+	}
 
-	// Delete all wines belonging to user
-	if err := tx.Where("user_id = ?", userID).Delete(&domain.Wine{}).Error; err != nil {
-		tx.Rollback()
-		http.Error(w, "Could not delete wines", http.StatusInternalServerError)
+	dueAt := time.Now().Add(grace)
+	if err := database.DB.Model(&domain.User{}).Where("id = ?", userID).Update("deletion_due_at", dueAt).Error; err != nil {
+		http.Error(w, "Could not schedule account deletion", http.StatusInternalServerError)
 		return
 	}
 
-	// Delete user
-	if err := tx.Delete(&domain.User{}, userID).Error; err != nil {
-		tx.Rollback()
-		http.Error(w, "Could not delete user", http.StatusInternalServerError)
+	if err := mailer.Send(r.Context(), mailer.Message{
+		To:      userEmail,
+		Subject: "Your Winetrackr account is scheduled for deletion",
+		Body: "Hi,\n\n" +
+			"We received a request to delete your Winetrackr account. Your account and all of its data will be " +
+			"permanently deleted on " + dueAt.Format("2 January 2006") + ".\n\n" +
+			"Changed your mind? Log in and cancel the deletion from your settings:\n" +
+			mailer.AppURL("/settings") + "\n",
+	}); err != nil {
+		log.Printf("Deletion notice for user %d failed: %v", userID, err)
+	}
+
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+// CancelDeletionHandler withdraws a pending account deletion
+func CancelDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	tx.Commit()
+	userID := r.Context().Value("user_id").(uint)
+
+	if err := database.DB.Model(&domain.User{}).Where("id = ?", userID).Update("deletion_due_at", nil).Error; err != nil {
+		http.Error(w, "Could not cancel account deletion", http.StatusInternalServerError)
+		return
+	}
 
-	// Clear session (redirect to logout handler or do it here)
-	// For simplicity, we'll just redirect to logout which handles session clearing
-	http.Redirect(w, r, "/logout", http.StatusSeeOther)
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
 }
@@ -0,0 +1,221 @@
+package subscription
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/jobs"
+	"wine-cellar/internal/shared/mailer"
+)
+
+// A failing payment moves a subscription through these states:
+//
+//	active -> past_due:      a payment failed; Pro is kept until GraceEndsAt
+//	past_due -> downgraded:  the grace period ended; the tier drops to free
+//	                         but PaymentFailedAt stays, so the banner remains
+//	past_due or downgraded -> active: an invoice was paid; Pro is restored
+//	any -> canceled:         the subscription ended; the failure is forgotten
+
+// PaymentGracePeriod is how long Pro is kept after a failed payment.
+// PAYMENT_GRACE_DAYS=0 downgrades at the next check.
+func PaymentGracePeriod() time.Duration {
+	days := 7
+	if v := os.Getenv("PAYMENT_GRACE_DAYS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			days = n
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// PaymentNotice is what the in-app banner shows while a payment is failing
+type PaymentNotice struct {
+	GraceEndsAt *time.Time // Nil once the user has been downgraded
+	Downgraded  bool
+}
+
+// PaymentProblem returns the banner for the user, or nil when their payments
+// are fine
+func PaymentProblem(user domain.User) *PaymentNotice {
+	if user.PaymentFailedAt == nil {
+		return nil
+	}
+	if user.GraceEndsAt != nil && time.Now().Before(*user.GraceEndsAt) {
+		return &PaymentNotice{GraceEndsAt: user.GraceEndsAt}
+	}
+	return &PaymentNotice{Downgraded: true}
+}
+
+// startGrace records the first failed payment. A grace period that is
+// already running is kept.
+func startGrace(user *domain.User, failedAt time.Time) {
+	if user.PaymentFailedAt != nil {
+		return
+	}
+	graceEndsAt := failedAt.Add(PaymentGracePeriod())
+	user.PaymentFailedAt = &failedAt
+	user.GraceEndsAt = &graceEndsAt
+}
+
+// clearPaymentProblem forgets a failed payment. It reports whether there was
+// one, so the user can be told their plan is back.
+func clearPaymentProblem(user *domain.User) bool {
+	failing := user.PaymentFailedAt != nil
+	user.PaymentFailedAt = nil
+	user.GraceEndsAt = nil
+	return failing
+}
+
+func handleInvoicePaymentFailed(ctx context.Context, customerID, invoiceID string, attemptCount, nextAttempt int64) error {
+	var user domain.User
+	if result := database.DB.Where("stripe_customer_id = ?", customerID).First(&user); result.Error != nil {
+		log.Printf("User not found for customer ID %s: %v", customerID, result.Error)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return errUnknownCustomer
+		}
+		return result.Error
+	}
+
+	// One email per failed attempt, whether or not a past_due update got
+	// here first, and never for the same attempt twice
+	startGrace(&user, time.Now())
+	notice := fmt.Sprintf("%s#%d", invoiceID, attemptCount)
+	notify := user.PaymentNotifiedFor != notice
+	user.PaymentNotifiedFor = notice
+	if user.SubscriptionStatus == "active" || user.SubscriptionStatus == "trialing" {
+		user.SubscriptionStatus = "past_due"
+	}
+	if err := database.DB.Save(&user).Error; err != nil {
+		return err
+	}
+	log.Printf("Payment attempt %d failed for user %d", attemptCount, user.ID)
+
+	body := "Hi,\n\nWe couldn't take the payment for your Winetrackr Connoisseur subscription.\n\n"
+	if nextAttempt > 0 {
+		body += fmt.Sprintf("We'll try again on %s. ", time.Unix(nextAttempt, 0).Format("January 2, 2006"))
+	}
+	if user.GraceEndsAt != nil && user.SubscriptionTier == "pro" {
+		body += fmt.Sprintf("To keep your Connoisseur features, please update your payment method before %s:\n\n",
+			user.GraceEndsAt.Format("January 2, 2006"))
+	} else {
+		body += "Please update your payment method to get your Connoisseur features back:\n\n"
+	}
+	body += mailer.AppURL("/settings") + "\n\nYour wines and notes are safe either way.\n"
+
+	if notify {
+		sendBillingEmail(ctx, user, "Your Winetrackr payment failed", body)
+	}
+	return nil
+}
+
+func handleInvoicePaid(ctx context.Context, customerID string) error {
+	var user domain.User
+	if result := database.DB.Where("stripe_customer_id = ?", customerID).First(&user); result.Error != nil {
+		log.Printf("User not found for customer ID %s: %v", customerID, result.Error)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return errUnknownCustomer
+		}
+		return result.Error
+	}
+
+	if !clearPaymentProblem(&user) {
+		return nil // A regular renewal
+	}
+	if user.SubscriptionStatus == "past_due" || user.SubscriptionStatus == "unpaid" {
+		user.SubscriptionStatus = "active"
+	}
+	user.SubscriptionTier = paidTier(user)
+	if tier, ok := grantedTier(user.ID); ok {
+		user.SubscriptionTier = tier
+	}
+	if err := saveSubscription(database.DB, &user); err != nil {
+		return err
+	}
+	log.Printf("Payment recovered for user %d", user.ID)
+
+	sendBillingEmail(ctx, user, "Your Winetrackr payment went through",
+		"Hi,\n\nThanks, your payment was received and your Connoisseur subscription is active again.\n")
+	return nil
+}
+
+func handleTrialWillEnd(ctx context.Context, customerID string, trialEnd int64) error {
+	var user domain.User
+	if result := database.DB.Where("stripe_customer_id = ?", customerID).First(&user); result.Error != nil {
+		log.Printf("User not found for customer ID %s: %v", customerID, result.Error)
+		return nil
+	}
+
+	sendBillingEmail(ctx, user, "Your Winetrackr trial ends soon",
+		fmt.Sprintf("Hi,\n\nYour Connoisseur trial ends on %s, when your subscription starts. "+
+			"You can review your payment method or cancel from your settings:\n\n%s\n",
+			time.Unix(trialEnd, 0).Format("January 2, 2006"), mailer.AppURL("/settings")))
+	return nil
+}
+
+// ScheduleDunning downgrades users whose grace period has ended, every
+// PAYMENT_GRACE_CHECK_INTERVAL (default 1h)
+func ScheduleDunning() {
+	jobs.Every("payment-grace", jobs.Duration("PAYMENT_GRACE_CHECK_INTERVAL", time.Hour), downgradeAfterGrace)
+}
+
+func downgradeAfterGrace(ctx context.Context) error {
+	var due []domain.User
+	if err := database.DB.WithContext(ctx).
+		Where("grace_ends_at IS NOT NULL AND grace_ends_at <= ?", time.Now()).Find(&due).Error; err != nil {
+		return err
+	}
+
+	for _, user := range due {
+		user.GraceEndsAt = nil
+		wasPro := user.SubscriptionTier == "pro"
+		user.SubscriptionTier = "free"
+		if tier, ok := grantedTier(user.ID); ok {
+			user.SubscriptionTier = tier
+		}
+		if err := saveSubscription(database.DB.WithContext(ctx), &user); err != nil {
+			log.Printf("Could not downgrade user %d after failed payment: %v", user.ID, err)
+			continue
+		}
+		log.Printf("User %d downgraded after the payment grace period", user.ID)
+
+		if wasPro && user.SubscriptionTier == "free" {
+			sendBillingEmail(ctx, user, "Your Winetrackr account is now on the Free plan",
+				"Hi,\n\nWe still couldn't take the payment for your Connoisseur subscription, so your account has moved to the Free plan. "+
+					"Your wines, reviews and tasting notes are kept; wines over the Free plan's limit are archived until you upgrade again.\n\n"+
+					"Update your payment method to get Connoisseur back straight away:\n\n"+mailer.AppURL("/settings")+"\n")
+		}
+	}
+	return nil
+}
+
+// emailsOffKey marks a context in which billing emails are not sent
+type emailsOffKey struct{}
+
+// withoutEmails returns a context in which handlers change state but don't
+// email users, e.g. when events are replayed
+func withoutEmails(ctx context.Context) context.Context {
+	return context.WithValue(ctx, emailsOffKey{}, true)
+}
+
+func sendBillingEmail(ctx context.Context, user domain.User, subject, body string) {
+	if off, _ := ctx.Value(emailsOffKey{}).(bool); off {
+		log.Printf("Billing email %q to user %d not sent", subject, user.ID)
+		return
+	}
+	if err := mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: subject,
+		Body:    body,
+	}); err != nil {
+		log.Printf("Billing email %q to user %d failed: %v", subject, user.ID, err)
+	}
+}
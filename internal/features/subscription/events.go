@@ -0,0 +1,270 @@
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"wine-cellar/internal/domain"
+)
+
+// errBadPayload means the event could not be parsed; processing it again
+// won't help
+var errBadPayload = errors.New("malformed event payload")
+
+// errUnknownCustomer means no user has the event's customer yet, usually
+// because checkout.session.completed hasn't arrived. The event fails, so
+// Stripe delivers it again once the checkout has been processed.
+var errUnknownCustomer = errors.New("no user for the customer yet")
+
+// orderedEvents set state from the event alone, so an older event must not
+// be applied after a newer one of the same group for the same customer
+var orderedEvents = map[string]string{
+	"checkout.session.completed":    "subscription",
+	"customer.subscription.updated": "subscription",
+	"customer.subscription.deleted": "subscription",
+	"invoice.payment_failed":        "invoice",
+	"invoice.paid":                  "invoice",
+}
+
+// claimTimeout is how long an event stays claimed by a delivery that is
+// processing it. A claim older than that is assumed to have died with its
+// process and can be taken over.
+const claimTimeout = 5 * time.Minute
+
+// recordEvent stores a verified event and claims it for processing. It
+// reports false when the event was already processed, e.g. because Stripe
+// retried the delivery, or another delivery of it is being processed.
+func recordEvent(db *gorm.DB, event stripe.Event, payload []byte) (domain.StripeEvent, bool, error) {
+	now := time.Now()
+	stored := domain.StripeEvent{
+		ID:         event.ID,
+		Type:       event.Type,
+		CustomerID: eventCustomer(event),
+		Created:    time.Unix(event.Created, 0),
+		Payload:    payload,
+		ClaimedAt:  &now,
+	}
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&stored)
+	if result.Error != nil {
+		return stored, false, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return stored, true, nil
+	}
+
+	// Seen before; only process it again if that attempt failed
+	claimed, err := claimEvent(db, event.ID, true)
+	if err != nil {
+		return stored, false, err
+	}
+	if err := db.First(&stored, "id = ?", event.ID).Error; err != nil {
+		return stored, false, err
+	}
+	return stored, claimed, nil
+}
+
+// claimEvent atomically marks a stored event as being processed, so two
+// deliveries can't both apply it. With unprocessed set, an event that was
+// already processed isn't claimed either.
+func claimEvent(db *gorm.DB, id string, unprocessed bool) (bool, error) {
+	now := time.Now()
+	query := db.Model(&domain.StripeEvent{}).
+		Where("id = ? AND (claimed_at IS NULL OR claimed_at < ?)", id, now.Add(-claimTimeout))
+	if unprocessed {
+		query = query.Where("processed_at IS NULL")
+	}
+	result := query.Update("claimed_at", now)
+	return result.RowsAffected == 1, result.Error
+}
+
+// processEvent applies a stored event and records the outcome. Ordered events
+// older than one already applied for the same customer are skipped as stale.
+func processEvent(ctx context.Context, db *gorm.DB, stored *domain.StripeEvent) error {
+	var event stripe.Event
+	if err := json.Unmarshal(stored.Payload, &event); err != nil || event.Data == nil {
+		return finishEvent(db, stored, "", errBadPayload)
+	}
+
+	if !handledEvents[event.Type] {
+		return finishEvent(db, stored, "ignored", nil)
+	}
+
+	// Every invoice event updates the billing history, even one too old
+	// to change the subscription
+	if strings.HasPrefix(event.Type, "invoice.") {
+		if err := cacheInvoice(db, event); err != nil {
+			return finishEvent(db, stored, "", err)
+		}
+	}
+
+	stale, err := staleEvent(db, stored)
+	if err != nil {
+		return finishEvent(db, stored, "", err)
+	}
+	if stale {
+		log.Printf("Skipping stale %s event %s for customer %s", stored.Type, stored.ID, stored.CustomerID)
+		return finishEvent(db, stored, "stale", nil)
+	}
+
+	return finishEvent(db, stored, "processed", applyEvent(ctx, event))
+}
+
+// staleEvent reports whether a newer event of the same group for the same
+// customer has already been processed
+func staleEvent(db *gorm.DB, stored *domain.StripeEvent) (bool, error) {
+	group, ok := orderedEvents[stored.Type]
+	if !ok || stored.CustomerID == "" {
+		return false, nil
+	}
+	var types []string
+	for t, g := range orderedEvents {
+		if g == group {
+			types = append(types, t)
+		}
+	}
+	var newer int64
+	err := db.Model(&domain.StripeEvent{}).
+		Where("customer_id = ? AND id <> ? AND type IN ? AND outcome = ? AND created > ?",
+			stored.CustomerID, stored.ID, types, "processed", stored.Created).
+		Count(&newer).Error
+	return newer > 0, err
+}
+
+// finishEvent records the outcome of processing and releases the claim, so
+// a failed event can be processed again by the next delivery
+func finishEvent(db *gorm.DB, stored *domain.StripeEvent, outcome string, err error) error {
+	stored.ClaimedAt = nil
+	updates := map[string]interface{}{"error": "", "claimed_at": nil}
+	if err != nil {
+		updates["error"] = err.Error()
+	} else {
+		now := time.Now()
+		stored.ProcessedAt = &now
+		stored.Outcome = outcome
+		updates["processed_at"] = now
+		updates["outcome"] = outcome
+	}
+	if dbErr := db.Model(stored).Updates(updates).Error; dbErr != nil {
+		log.Printf("Could not record outcome of Stripe event %s: %v", stored.ID, dbErr)
+	}
+	return err
+}
+
+// eventCustomer returns the Stripe customer the event is about, if any
+func eventCustomer(event stripe.Event) string {
+	if event.Data == nil {
+		return ""
+	}
+	switch customer := event.Data.Object["customer"].(type) {
+	case string:
+		return customer
+	case map[string]interface{}: // Expanded customer object
+		id, _ := customer["id"].(string)
+		return id
+	}
+	return ""
+}
+
+// ReplayOptions selects the stored events to process again
+type ReplayOptions struct {
+	EventID    string
+	Type       string
+	CustomerID string
+	Since      time.Time
+	DryRun     bool // Only report what would be processed
+	SendEmails bool // Send the emails the handlers send; by default only state is replayed
+}
+
+// ReplayReport summarises a replay
+type ReplayReport struct {
+	Selected  int
+	Processed int
+	Stale     int
+	Ignored   int
+	Failed    int
+}
+
+// ReplayEvents processes stored events again in the order Stripe created
+// them, e.g. after fixing a bug in a handler. Ordering still applies: an
+// event is skipped when a newer one for the same customer was processed.
+// Users aren't emailed again unless opts.SendEmails is set.
+func ReplayEvents(db *gorm.DB, opts ReplayOptions, logf func(format string, args ...interface{})) (ReplayReport, error) {
+	var report ReplayReport
+
+	ctx := context.Background()
+	if !opts.SendEmails {
+		ctx = withoutEmails(ctx)
+	}
+
+	query := db.Model(&domain.StripeEvent{}).Order("created ASC, id ASC")
+	if opts.EventID != "" {
+		query = query.Where("id = ?", opts.EventID)
+	}
+	if opts.Type != "" {
+		query = query.Where("type = ?", opts.Type)
+	}
+	if opts.CustomerID != "" {
+		query = query.Where("customer_id = ?", opts.CustomerID)
+	}
+	if !opts.Since.IsZero() {
+		query = query.Where("created >= ?", opts.Since)
+	}
+
+	var events []domain.StripeEvent
+	if err := query.Find(&events).Error; err != nil {
+		return report, err
+	}
+	report.Selected = len(events)
+
+	for i := range events {
+		stored := &events[i]
+		if opts.DryRun {
+			logf("Would replay %s %s (customer %s, created %s, last outcome %q)",
+				stored.ID, stored.Type, stored.CustomerID, stored.Created.Format(time.RFC3339), stored.Outcome)
+			continue
+		}
+
+		// Skip an event a webhook delivery is processing right now
+		claimed, err := claimEvent(db, stored.ID, false)
+		if err != nil {
+			return report, fmt.Errorf("claim %s: %w", stored.ID, err)
+		}
+		if !claimed {
+			report.Failed++
+			logf("Skipping %s %s, it is being processed", stored.ID, stored.Type)
+			continue
+		}
+
+		// Clear the previous outcome so it doesn't count against itself
+		if err := db.Model(stored).Updates(map[string]interface{}{"processed_at": nil, "outcome": ""}).Error; err != nil {
+			return report, fmt.Errorf("reset %s: %w", stored.ID, err)
+		}
+		stored.ProcessedAt = nil
+		stored.Outcome = ""
+
+		if err := processEvent(ctx, db, stored); err != nil {
+			report.Failed++
+			logf("Replaying %s %s failed: %v", stored.ID, stored.Type, err)
+			continue
+		}
+		switch stored.Outcome {
+		case "processed":
+			report.Processed++
+		case "stale":
+			report.Stale++
+		case "ignored":
+			report.Ignored++
+		}
+		logf("Replayed %s %s: %s", stored.ID, stored.Type, stored.Outcome)
+	}
+	return report, nil
+}
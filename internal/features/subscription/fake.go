@@ -0,0 +1,612 @@
+package subscription
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/ui"
+
+	"github.com/gorilla/csrf"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/webhook"
+)
+
+// fakePrices are used with the fake provider when STRIPE_PRICES is not set
+var fakePrices = []Price{
+	{ID: "price_fake_month", Interval: "month", Currency: "USD", Amount: 5},
+	{ID: "price_fake_year", Interval: "year", Currency: "USD", Amount: 50},
+}
+
+// FakeProvider simulates Stripe in-process: checkout and the billing portal
+// are pages under /fake-billing, and every change is delivered to
+// WebhookHandler as a signed event, so the app goes through the same steps
+// as with Stripe. State is kept in memory and lost on restart.
+type FakeProvider struct {
+	mu            sync.Mutex
+	secret        string
+	promoCodes    map[string]string // Upper case code to ID
+	sessions      map[string]*fakeCheckout
+	subscriptions map[string]*fakeSubscription
+	invoices      map[string]*fakeInvoice
+	next          int
+	dropEvents    bool
+}
+
+type fakeCheckout struct {
+	ID             string
+	Params         CheckoutParams
+	Status         string // "open", "complete" or "expired"
+	CustomerID     string
+	SubscriptionID string
+}
+
+type fakeSubscription struct {
+	ID           string
+	CustomerID   string
+	PriceID      string
+	Status       string
+	AttemptCount int64  // Failed attempts of the open invoice
+	OpenInvoice  string // ID of the unpaid invoice being retried
+	Created      time.Time
+}
+
+type fakeInvoice struct {
+	ID             string
+	Number         string
+	CustomerID     string
+	SubscriptionID string
+	Currency       string
+	Amount         int64 // In the currency's smallest unit
+	Status         string
+	Created        time.Time
+}
+
+// Label is the invoice's amount with its currency
+func (i *fakeInvoice) Label() string {
+	return formatAmount(i.Currency, fromMinorUnits(i.Currency, i.Amount))
+}
+
+// NewFakeProvider signs its events with STRIPE_WEBHOOK_SECRET, or a fixed
+// secret when unset, and accepts the promotion codes listed in
+// FAKE_BILLING_PROMO_CODES (comma-separated)
+func NewFakeProvider() *FakeProvider {
+	f := &FakeProvider{
+		secret:        os.Getenv("STRIPE_WEBHOOK_SECRET"),
+		promoCodes:    map[string]string{},
+		sessions:      map[string]*fakeCheckout{},
+		subscriptions: map[string]*fakeSubscription{},
+		invoices:      map[string]*fakeInvoice{},
+	}
+	if f.secret == "" {
+		f.secret = "whsec_fake"
+	}
+	for _, code := range strings.Split(os.Getenv("FAKE_BILLING_PROMO_CODES"), ",") {
+		if code = strings.TrimSpace(code); code != "" {
+			f.promoCodes[strings.ToUpper(code)] = "promo_fake_" + strings.ToUpper(code)
+		}
+	}
+	return f
+}
+
+// newID returns a unique ID with Stripe's prefix for the kind of object
+func (f *FakeProvider) newID(prefix string) string {
+	f.next++
+	return fmt.Sprintf("%s_fake_%d", prefix, f.next)
+}
+
+func (f *FakeProvider) CreateCheckout(params CheckoutParams) (Checkout, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	checkout := &fakeCheckout{ID: f.newID("cs"), Params: params, Status: "open"}
+	f.sessions[checkout.ID] = checkout
+	return Checkout{ID: checkout.ID, URL: "/fake-billing/checkout?session=" + checkout.ID}, nil
+}
+
+func (f *FakeProvider) GetCheckout(sessionID string) (RemoteCheckout, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	checkout, ok := f.sessions[sessionID]
+	if !ok {
+		return RemoteCheckout{}, fmt.Errorf("no such checkout session: %s", sessionID)
+	}
+	return RemoteCheckout{
+		ID:                checkout.ID,
+		Status:            checkout.Status,
+		ClientReferenceID: checkout.Params.ClientReferenceID,
+		CustomerID:        checkout.CustomerID,
+		SubscriptionID:    checkout.SubscriptionID,
+		Metadata:          checkout.Params.Metadata,
+	}, nil
+}
+
+func (f *FakeProvider) ExpireCheckout(sessionID string) error {
+	f.mu.Lock()
+	checkout, ok := f.sessions[sessionID]
+	if !ok || checkout.Status != "open" {
+		f.mu.Unlock()
+		return fmt.Errorf("no open checkout session: %s", sessionID)
+	}
+	checkout.Status = "expired"
+	f.mu.Unlock()
+
+	return f.deliver("checkout.session.expired", map[string]interface{}{
+		"object":              "checkout.session",
+		"id":                  checkout.ID,
+		"client_reference_id": checkout.Params.ClientReferenceID,
+		"status":              "expired",
+		"metadata":            checkout.Params.Metadata,
+	})
+}
+
+func (f *FakeProvider) CreatePortal(customerID, returnURL string) (string, error) {
+	return "/fake-billing/portal?return=" + url.QueryEscape(returnURL), nil
+}
+
+func (f *FakeProvider) CancelSubscription(subscriptionID string) error {
+	f.mu.Lock()
+	sub, ok := f.subscriptions[subscriptionID]
+	if !ok || sub.Status == "canceled" {
+		f.mu.Unlock()
+		return nil
+	}
+	sub.Status = "canceled"
+	object := sub.object()
+	f.mu.Unlock()
+
+	return f.deliver("customer.subscription.deleted", object)
+}
+
+func (f *FakeProvider) GetSubscription(subscriptionID string) (SubscriptionPrice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, ok := f.subscriptions[subscriptionID]
+	if !ok {
+		return SubscriptionPrice{}, fmt.Errorf("no such subscription: %s", subscriptionID)
+	}
+	current := SubscriptionPrice{PriceID: sub.PriceID}
+	if p, ok := findPrice(sub.PriceID); ok {
+		current.Interval = p.Interval
+	}
+	return current, nil
+}
+
+func (f *FakeProvider) ChangePrice(subscriptionID, priceID string) (SubscriptionPrice, error) {
+	price, ok := findPrice(priceID)
+	if !ok {
+		return SubscriptionPrice{}, fmt.Errorf("no such price: %s", priceID)
+	}
+
+	f.mu.Lock()
+	sub, ok := f.subscriptions[subscriptionID]
+	if !ok || sub.Status == "canceled" {
+		f.mu.Unlock()
+		return SubscriptionPrice{}, fmt.Errorf("no such subscription: %s", subscriptionID)
+	}
+	sub.PriceID = price.ID
+	object := sub.object()
+	// The prorated difference is invoiced straight away, trials have
+	// nothing to prorate
+	var invoice map[string]interface{}
+	if sub.Status == "active" {
+		invoice = f.invoice(sub, true)
+	}
+	f.mu.Unlock()
+
+	if err := f.deliver("customer.subscription.updated", object); err != nil {
+		return SubscriptionPrice{}, err
+	}
+	if invoice != nil {
+		if err := f.deliver("invoice.paid", invoice); err != nil {
+			return SubscriptionPrice{}, err
+		}
+	}
+	return SubscriptionPrice{PriceID: price.ID, Interval: price.Interval}, nil
+}
+
+func (f *FakeProvider) FindPromotionCode(code string) (PromotionCode, error) {
+	id, ok := f.promoCodes[strings.ToUpper(code)]
+	if !ok {
+		return PromotionCode{}, errPromoInvalid
+	}
+	return PromotionCode{ID: id, Code: code}, nil
+}
+
+func (f *FakeProvider) ParseWebhook(payload []byte, signature string) (stripe.Event, error) {
+	return webhook.ConstructEventWithOptions(payload, signature, f.secret, webhook.ConstructEventOptions{
+		IgnoreAPIVersionMismatch: true,
+	})
+}
+
+func (f *FakeProvider) ListSubscriptions(customerID string) ([]RemoteSubscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var subs []RemoteSubscription
+	for _, sub := range f.subscriptions {
+		if sub.CustomerID != customerID {
+			continue
+		}
+		remote := RemoteSubscription{ID: sub.ID, Status: sub.Status, PriceID: sub.PriceID, Created: sub.Created}
+		if p, ok := findPrice(sub.PriceID); ok {
+			remote.Interval = p.Interval
+		}
+		subs = append(subs, remote)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Created.After(subs[j].Created) })
+	return subs, nil
+}
+
+// CompleteCheckout pays for a checkout session, as if the user had entered
+// their card at Stripe, and returns the URL to send them back to
+func (f *FakeProvider) CompleteCheckout(sessionID string) (string, error) {
+	f.mu.Lock()
+	checkout, ok := f.sessions[sessionID]
+	if !ok || checkout.Status != "open" {
+		f.mu.Unlock()
+		return "", fmt.Errorf("no open checkout session: %s", sessionID)
+	}
+
+	customerID := checkout.Params.CustomerID
+	if customerID == "" {
+		customerID = f.newID("cus")
+	}
+	sub := &fakeSubscription{
+		ID:         f.newID("sub"),
+		CustomerID: customerID,
+		PriceID:    checkout.Params.PriceID,
+		Status:     "active",
+		Created:    time.Now(),
+	}
+	if checkout.Params.TrialDays > 0 {
+		sub.Status = "trialing"
+	}
+	f.subscriptions[sub.ID] = sub
+	checkout.Status = "complete"
+	checkout.CustomerID = sub.CustomerID
+	checkout.SubscriptionID = sub.ID
+	object := sub.object()
+	var invoice map[string]interface{}
+	if sub.Status == "active" {
+		invoice = f.invoice(sub, true)
+	}
+	f.mu.Unlock()
+
+	completed := map[string]interface{}{
+		"object":              "checkout.session",
+		"id":                  checkout.ID,
+		"client_reference_id": checkout.Params.ClientReferenceID,
+		"customer":            sub.CustomerID,
+		"subscription":        sub.ID,
+		"metadata":            checkout.Params.Metadata,
+	}
+	if err := f.deliver("checkout.session.completed", completed); err != nil {
+		return "", err
+	}
+	if err := f.deliver("customer.subscription.updated", object); err != nil {
+		return "", err
+	}
+	if invoice != nil {
+		if err := f.deliver("invoice.paid", invoice); err != nil {
+			return "", err
+		}
+	}
+	return checkout.Params.SuccessURL, nil
+}
+
+// FailPayment simulates a renewal whose payment is declined
+func (f *FakeProvider) FailPayment(subscriptionID string) error {
+	f.mu.Lock()
+	sub, ok := f.subscriptions[subscriptionID]
+	if !ok || sub.Status == "canceled" {
+		f.mu.Unlock()
+		return fmt.Errorf("no such subscription: %s", subscriptionID)
+	}
+	sub.Status = "past_due"
+	sub.AttemptCount++
+	object := sub.object()
+	invoice := f.invoice(sub, false)
+	f.mu.Unlock()
+
+	if err := f.deliver("invoice.payment_failed", invoice); err != nil {
+		return err
+	}
+	return f.deliver("customer.subscription.updated", object)
+}
+
+// PayInvoice simulates a renewal, or a retry of a failed one, being paid
+func (f *FakeProvider) PayInvoice(subscriptionID string) error {
+	f.mu.Lock()
+	sub, ok := f.subscriptions[subscriptionID]
+	if !ok || sub.Status == "canceled" {
+		f.mu.Unlock()
+		return fmt.Errorf("no such subscription: %s", subscriptionID)
+	}
+	sub.Status = "active"
+	invoice := f.invoice(sub, true)
+	sub.AttemptCount = 0
+	object := sub.object()
+	f.mu.Unlock()
+
+	if err := f.deliver("invoice.paid", invoice); err != nil {
+		return err
+	}
+	return f.deliver("customer.subscription.updated", object)
+}
+
+// object is the subscription as Stripe would send it in an event
+func (s *fakeSubscription) object() map[string]interface{} {
+	price := map[string]interface{}{"id": s.PriceID}
+	if p, ok := findPrice(s.PriceID); ok {
+		price["currency"] = strings.ToLower(p.Currency)
+		price["recurring"] = map[string]interface{}{"interval": p.Interval}
+	}
+	return map[string]interface{}{
+		"object":   "subscription",
+		"id":       s.ID,
+		"customer": s.CustomerID,
+		"status":   s.Status,
+		"items": map[string]interface{}{
+			"data": []interface{}{
+				map[string]interface{}{"id": "si_" + strings.TrimPrefix(s.ID, "sub_"), "price": price},
+			},
+		},
+	}
+}
+
+// invoice returns the subscription's open invoice, or issues a new one, as
+// Stripe would send it. A paid invoice is closed; an unpaid one stays open
+// for the next attempt. The caller holds f.mu.
+func (f *FakeProvider) invoice(s *fakeSubscription, paid bool) map[string]interface{} {
+	inv, ok := f.invoices[s.OpenInvoice]
+	if !ok {
+		inv = &fakeInvoice{
+			ID:             f.newID("in"),
+			Number:         fmt.Sprintf("FAKE-%04d", len(f.invoices)+1),
+			CustomerID:     s.CustomerID,
+			SubscriptionID: s.ID,
+			Currency:       "USD",
+			Created:        time.Now(),
+		}
+		if p, ok := findPrice(s.PriceID); ok {
+			inv.Currency = p.Currency
+			inv.Amount = toMinorUnits(p.Currency, p.Amount)
+		}
+		f.invoices[inv.ID] = inv
+	}
+	inv.Status = "open"
+	s.OpenInvoice = inv.ID
+	var amountPaid int64
+	if paid {
+		inv.Status = "paid"
+		s.OpenInvoice = ""
+		amountPaid = inv.Amount
+	}
+
+	invoice := map[string]interface{}{
+		"object":             "invoice",
+		"id":                 inv.ID,
+		"number":             inv.Number,
+		"customer":           inv.CustomerID,
+		"subscription":       inv.SubscriptionID,
+		"status":             inv.Status,
+		"currency":           strings.ToLower(inv.Currency),
+		"amount_due":         inv.Amount,
+		"amount_paid":        amountPaid,
+		"attempt_count":      s.AttemptCount,
+		"hosted_invoice_url": "/fake-billing/invoice?id=" + inv.ID,
+		"created":            inv.Created.Unix(),
+	}
+	if s.Status == "past_due" {
+		invoice["next_payment_attempt"] = time.Now().Add(3 * 24 * time.Hour).Unix()
+	}
+	return invoice
+}
+
+// DropEvents stops delivering events until it is called with false, as if
+// /webhook/stripe were down, so the reconciliation job has drift to fix
+func (f *FakeProvider) DropEvents(drop bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dropEvents = drop
+}
+
+// deliver signs an event the way Stripe does and hands it to
+// WebhookHandler
+func (f *FakeProvider) deliver(eventType string, object map[string]interface{}) error {
+	f.mu.Lock()
+	id := f.newID("evt")
+	drop := f.dropEvents
+	f.mu.Unlock()
+	if drop {
+		log.Printf("Fake billing dropped %s event %s", eventType, id)
+		return nil
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":          id,
+		"object":      "event",
+		"type":        eventType,
+		"created":     time.Now().Unix(),
+		"api_version": stripe.APIVersion,
+		"data":        map[string]interface{}{"object": object},
+	})
+	if err != nil {
+		return err
+	}
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: f.secret})
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook/stripe", bytes.NewReader(payload))
+	req.Header.Set("Stripe-Signature", signed.Header)
+	rec := httptest.NewRecorder()
+	WebhookHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		return fmt.Errorf("fake %s event %s was answered with %d", eventType, id, rec.Code)
+	}
+	log.Printf("Fake billing delivered %s event %s", eventType, id)
+	return nil
+}
+
+// CheckoutHandler is the fake's stand-in for Stripe Checkout
+func (f *FakeProvider) CheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(uint)
+	sessionID := r.FormValue("session")
+
+	f.mu.Lock()
+	checkout, ok := f.sessions[sessionID]
+	open := ok && checkout.Status == "open"
+	f.mu.Unlock()
+	if !open || checkout.Params.ClientReferenceID != strconv.Itoa(int(userID)) {
+		http.Error(w, "Checkout session not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		// Like Stripe, going back leaves the session open until the app
+		// expires it
+		if r.FormValue("action") != "pay" {
+			http.Redirect(w, r, checkout.Params.CancelURL, http.StatusSeeOther)
+			return
+		}
+		successURL, err := f.CompleteCheckout(sessionID)
+		if err != nil {
+			log.Printf("Fake checkout %s failed: %v", sessionID, err)
+			http.Error(w, "Checkout failed", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, successURL, http.StatusSeeOther)
+		return
+	}
+
+	price, _ := findPrice(checkout.Params.PriceID)
+	f.render(w, r, fakePage{Checkout: checkout, Price: price})
+}
+
+// PortalHandler is the fake's stand-in for the Stripe billing portal. It can
+// cancel the subscription and simulate renewals that fail or succeed.
+func (f *FakeProvider) PortalHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(uint)
+
+	var user domain.User
+	if result := database.DB.First(&user, userID); result.Error != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	returnURL := portalReturn(r.FormValue("return"))
+
+	f.mu.Lock()
+	sub, ok := f.subscriptions[user.SubscriptionID]
+	page := fakePage{Portal: true, ReturnURL: returnURL}
+	if ok {
+		current := *sub
+		page.Subscription = &current
+	}
+	f.mu.Unlock()
+
+	if r.Method == http.MethodPost {
+		if !ok {
+			http.Error(w, "No subscription to manage", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch r.FormValue("action") {
+		case "cancel":
+			err = f.CancelSubscription(sub.ID)
+		case "fail":
+			err = f.FailPayment(sub.ID)
+		case "pay":
+			err = f.PayInvoice(sub.ID)
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Fake portal action %s failed: %v", r.FormValue("action"), err)
+			http.Error(w, "Action failed", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/fake-billing/portal?return="+url.QueryEscape(returnURL), http.StatusSeeOther)
+		return
+	}
+
+	f.render(w, r, page)
+}
+
+// portalReturn keeps the portal's way back on this site. CreatePortal is
+// given a URL under DOMAIN, which becomes its path; anything that isn't a
+// path on this host, such as "//evil.example", goes to /settings.
+func portalReturn(returnURL string) string {
+	domainURL := os.Getenv("DOMAIN")
+	if !strings.HasPrefix(domainURL, "http") {
+		domainURL = "https://" + domainURL
+	}
+	path := strings.TrimPrefix(returnURL, domainURL)
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/settings"
+	}
+	return path
+}
+
+// InvoiceHandler is the fake's stand-in for Stripe's hosted invoice page
+func (f *FakeProvider) InvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(uint)
+
+	var user domain.User
+	if result := database.DB.First(&user, userID); result.Error != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	f.mu.Lock()
+	inv, ok := f.invoices[r.FormValue("id")]
+	var current fakeInvoice
+	if ok {
+		current = *inv
+	}
+	f.mu.Unlock()
+	if !ok || current.CustomerID != user.StripeCustomerID {
+		http.Error(w, "Invoice not found", http.StatusNotFound)
+		return
+	}
+
+	f.render(w, r, fakePage{Invoice: &current, ReturnURL: "/settings#billing"})
+}
+
+// fakePage is the checkout, portal or invoice page
+type fakePage struct {
+	Checkout     *fakeCheckout
+	Price        Price
+	Portal       bool
+	Subscription *fakeSubscription // Nil when the user has none
+	Invoice      *fakeInvoice
+	ReturnURL    string
+	CSRFField    template.HTML
+}
+
+func (f *FakeProvider) render(w http.ResponseWriter, r *http.Request, page fakePage) {
+	tmpl, err := template.New("fake.html").Funcs(ui.FuncMap).ParseFiles("internal/features/subscription/fake.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page.CSRFField = csrf.TemplateField(r)
+	tmpl.Execute(w, page)
+}
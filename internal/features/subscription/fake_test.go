@@ -0,0 +1,24 @@
+package subscription
+
+import "testing"
+
+func TestPortalReturn(t *testing.T) {
+	t.Setenv("DOMAIN", "winetrackr.example")
+	tests := map[string]string{
+		"https://winetrackr.example/settings": "/settings",
+		"/settings?tab=billing":               "/settings?tab=billing",
+		"":                                    "/settings",
+		"settings":                            "/settings",
+		"//evil.example/settings":             "/settings",
+		"/\\evil.example":                     "/settings",
+		"https://evil.example/settings":       "/settings",
+		"https://winetrackr.example.evil.example/":  "/settings",
+		"https://winetrackr.example//evil.example/": "/settings",
+		"javascript:alert(1)":                       "/settings",
+	}
+	for returnURL, want := range tests {
+		if got := portalReturn(returnURL); got != want {
+			t.Errorf("portalReturn(%q) = %q, want %q", returnURL, got, want)
+		}
+	}
+}
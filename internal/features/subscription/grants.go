@@ -0,0 +1,126 @@
+package subscription
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/jobs"
+	"wine-cellar/internal/shared/plans"
+)
+
+// ActiveGrant returns the grant currently in effect for the user, or nil
+func ActiveGrant(db *gorm.DB, userID uint) (*domain.TierGrant, error) {
+	var grant domain.TierGrant
+	err := db.Where("user_id = ? AND ended_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", userID, time.Now()).
+		Order("created_at DESC").First(&grant).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+// GrantTier gives the user a tier until expiresAt (nil for no end date),
+// replacing any grant already in effect
+func GrantTier(db *gorm.DB, userID uint, tier, reason, grantedBy string, expiresAt *time.Time) (*domain.TierGrant, error) {
+	grant := &domain.TierGrant{
+		UserID:    userID,
+		Tier:      tier,
+		Reason:    reason,
+		GrantedBy: grantedBy,
+		ExpiresAt: expiresAt,
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&domain.TierGrant{}).Where("user_id = ? AND ended_at IS NULL", userID).
+			Update("ended_at", time.Now()).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(grant).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&domain.User{}).Where("id = ?", userID).Update("subscription_tier", tier).Error; err != nil {
+			return err
+		}
+		return plans.ApplyLimit(tx, userID, tier)
+	})
+	return grant, err
+}
+
+// EndGrant stops a grant and puts the user back on the tier their Stripe
+// subscription pays for
+func EndGrant(db *gorm.DB, grant *domain.TierGrant) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(grant).Where("ended_at IS NULL").Update("ended_at", now)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		var user domain.User
+		if err := tx.First(&user, grant.UserID).Error; err != nil {
+			return err
+		}
+		tier := paidTier(user)
+		if err := tx.Model(&user).Update("subscription_tier", tier).Error; err != nil {
+			return err
+		}
+		return plans.ApplyLimit(tx, user.ID, tier)
+	})
+}
+
+// ScheduleGrantExpiry ends expired grants every TIER_GRANT_EXPIRY_INTERVAL
+// (default 1h)
+func ScheduleGrantExpiry() {
+	jobs.Every("tier-grant-expiry", jobs.Duration("TIER_GRANT_EXPIRY_INTERVAL", time.Hour), expireGrants)
+}
+
+func expireGrants(ctx context.Context) error {
+	var grants []domain.TierGrant
+	if err := database.DB.WithContext(ctx).Where("ended_at IS NULL AND expires_at <= ?", time.Now()).
+		Find(&grants).Error; err != nil {
+		return err
+	}
+
+	for i := range grants {
+		if err := EndGrant(database.DB.WithContext(ctx), &grants[i]); err != nil {
+			log.Printf("Could not end tier grant %d: %v", grants[i].ID, err)
+			continue
+		}
+		log.Printf("Tier grant %d for user %d expired", grants[i].ID, grants[i].UserID)
+	}
+	return nil
+}
+
+// paidTier is the tier the user's Stripe subscription entitles them to,
+// including during the grace period after a failed payment
+func paidTier(user domain.User) string {
+	switch {
+	case user.SubscriptionStatus == "active" || user.SubscriptionStatus == "trialing":
+		return "pro"
+	case user.SubscriptionStatus == "past_due" && user.GraceEndsAt != nil && time.Now().Before(*user.GraceEndsAt):
+		return "pro"
+	}
+	return "free"
+}
+
+// grantedTier returns the tier of an active grant, so that webhooks don't
+// override what an admin has given
+func grantedTier(userID uint) (string, bool) {
+	grant, err := ActiveGrant(database.DB, userID)
+	if err != nil {
+		log.Printf("Could not look up tier grant of user %d: %v", userID, err)
+		return "", false
+	}
+	if grant == nil {
+		return "", false
+	}
+	return grant.Tier, true
+}
@@ -1,27 +1,38 @@
 package subscription
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"wine-cellar/internal/domain"
 	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/plans"
 
 	"github.com/stripe/stripe-go/v74"
-	"github.com/stripe/stripe-go/v74/billingportal/session"
-	checkoutsession "github.com/stripe/stripe-go/v74/checkout/session"
-	"github.com/stripe/stripe-go/v74/webhook"
+	"gorm.io/gorm"
 )
 
 func Init() {
 	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	billing = newProvider()
+	catalog = loadPrices()
+	if len(catalog) == 0 && Fake() != nil {
+		catalog = fakePrices
+	}
 }
 
+// checkoutTTL is how long a checkout session can be paid. Stripe accepts 30
+// minutes to 24 hours; the trial and promotion code are held that long.
+const checkoutTTL = time.Hour
+
 func CreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(uint)
 	userEmail := r.Context().Value("email").(string)
@@ -29,30 +40,100 @@ func CreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
 	if !strings.HasPrefix(domainURL, "http") {
 		domainURL = "https://" + domainURL
 	}
-	priceID := os.Getenv("STRIPE_PRICE_ID")
 
-	params := &stripe.CheckoutSessionParams{
-		CustomerEmail:      stripe.String(userEmail),
-		ClientReferenceID:  stripe.String(strconv.Itoa(int(userID))),
-		Mode:               stripe.String(string(stripe.CheckoutSessionModeSubscription)),
-		SuccessURL:         stripe.String(domainURL + "/?success=true"),
-		CancelURL:          stripe.String(domainURL + "/?canceled=true"),
-		LineItems: []*stripe.CheckoutSessionLineItemParams{
-			{
-				Price:    stripe.String(priceID),
-				Quantity: stripe.Int64(1),
-			},
-		},
+	var user domain.User
+	if result := database.DB.First(&user, userID); result.Error != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	// A second checkout would start a second subscription; intervals are
+	// switched from the settings page instead
+	if user.SubscriptionID != "" && user.SubscriptionStatus != "canceled" && user.SubscriptionStatus != "incomplete_expired" {
+		http.Redirect(w, r, "/settings#subscription", http.StatusSeeOther)
+		return
+	}
+
+	price, ok := findPrice(r.FormValue("price"))
+	if !ok {
+		price, ok = defaultPrice(user.Currency)
 	}
+	if !ok {
+		log.Println("No prices configured, set STRIPE_PRICES or STRIPE_PRICE_ID")
+		http.Error(w, "Subscriptions are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	// An earlier checkout the user abandoned would hold the offers of this
+	// one
+	releaseCheckouts(user)
 
-	s, err := checkoutsession.New(params)
+	params := CheckoutParams{
+		Email:             userEmail,
+		CustomerID:        user.StripeCustomerID,
+		ClientReferenceID: strconv.Itoa(int(userID)),
+		PriceID:           price.ID,
+		Metadata:          map[string]string{"price_id": price.ID},
+		SuccessURL:        domainURL + "/?success=true",
+		CancelURL:         domainURL + "/subscription/checkout/canceled",
+		ExpiresAt:         time.Now().Add(checkoutTTL),
+	}
+
+	if days := AvailableTrialDays(user); days > 0 {
+		params.TrialDays = days
+		params.Metadata["trial_days"] = strconv.Itoa(days)
+	}
+
+	if code := strings.TrimSpace(r.FormValue("promotion_code")); code != "" {
+		promo, err := findPromotionCode(user, code)
+		if errors.Is(err, errPromoInvalid) || errors.Is(err, errPromoUsed) {
+			http.Redirect(w, r, "/settings?promo=invalid#subscription", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("Finding promotion code: %v", err)
+			http.Error(w, "Error checking promotion code", http.StatusInternalServerError)
+			return
+		}
+		params.PromotionCodeID = promo.ID
+		params.Metadata["promotion_code"] = promo.Code
+	}
+
+	checkout, err := billing.CreateCheckout(params)
 	if err != nil {
-		log.Printf("checkoutsession.New: %v", err)
+		log.Printf("Creating checkout: %v", err)
+		http.Error(w, "Error creating checkout session", http.StatusInternalServerError)
+		return
+	}
+	if err := holdRedemptions(user, checkout, params.ExpiresAt, params.Metadata); err != nil {
+		log.Printf("Holding the offers of checkout %s: %v", checkout.ID, err)
+		if err := billing.ExpireCheckout(checkout.ID); err != nil {
+			log.Printf("Could not expire checkout %s: %v", checkout.ID, err)
+		}
 		http.Error(w, "Error creating checkout session", http.StatusInternalServerError)
 		return
 	}
+	// Reconciliation finds the customer through it if the webhook is missed
+	if err := database.DB.Model(&user).Update("checkout_session_id", checkout.ID).Error; err != nil {
+		log.Printf("Could not store checkout %s of user %d: %v", checkout.ID, userID, err)
+	}
+
+	http.Redirect(w, r, checkout.URL, http.StatusSeeOther)
+}
+
+// CheckoutCanceledHandler is where checkout sends users who go back. Their
+// checkout is expired, so its trial and promotion code can be used again.
+func CheckoutCanceledHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(uint)
+
+	var user domain.User
+	if result := database.DB.First(&user, userID); result.Error != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
 
-	http.Redirect(w, r, s.URL, http.StatusSeeOther)
+	releaseCheckouts(user)
+	http.Redirect(w, r, "/?canceled=true", http.StatusSeeOther)
 }
 
 func CreatePortalSession(w http.ResponseWriter, r *http.Request) {
@@ -73,19 +154,23 @@ func CreatePortalSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	params := &stripe.BillingPortalSessionParams{
-		Customer:  stripe.String(user.StripeCustomerID),
-		ReturnURL: stripe.String(domainURL + "/settings"),
-	}
-
-	s, err := session.New(params)
+	url, err := billing.CreatePortal(user.StripeCustomerID, domainURL+"/settings")
 	if err != nil {
-		log.Printf("session.New: %v", err)
+		log.Printf("Creating portal session: %v", err)
 		http.Error(w, "Error creating portal session", http.StatusInternalServerError)
 		return
 	}
 
-	http.Redirect(w, r, s.URL, http.StatusSeeOther)
+	http.Redirect(w, r, url, http.StatusSeeOther)
+}
+
+// CancelImmediately ends a subscription without waiting for the billing
+// period to finish. Used when an account is erased.
+func CancelImmediately(subscriptionID string) error {
+	if subscriptionID == "" {
+		return nil
+	}
+	return billing.CancelSubscription(subscriptionID)
 }
 
 func WebhookHandler(w http.ResponseWriter, r *http.Request) {
@@ -99,52 +184,123 @@ func WebhookHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify the signature
-	endpointSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
-	if endpointSecret == "" {
+	event, err := billing.ParseWebhook(payload, r.Header.Get("Stripe-Signature"))
+	if errors.Is(err, errNoWebhookSecret) {
 		log.Println("STRIPE_WEBHOOK_SECRET is not set")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	
-	// Use ConstructEventWithOptions to ignore API version mismatch
-	event, err := webhook.ConstructEventWithOptions(payload, r.Header.Get("Stripe-Signature"), endpointSecret, webhook.ConstructEventOptions{
-		IgnoreAPIVersionMismatch: true,
-	})
 	if err != nil {
 		log.Printf("Error verifying webhook signature: %v\n", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Webhook received: %s", event.Type)
+	log.Printf("Webhook received: %s %s", event.Type, event.ID)
+
+	stored, process, err := recordEvent(database.DB, event, payload)
+	if err != nil {
+		log.Printf("Error storing webhook event %s: %v", event.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !process && stored.ProcessedAt == nil {
+		// Another delivery is processing it; Stripe will try again
+		log.Printf("Webhook event %s is already being processed", event.ID)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if !process {
+		log.Printf("Skipping duplicate webhook event %s", event.ID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 
+	if err := processEvent(r.Context(), database.DB, &stored); err != nil {
+		log.Printf("Error processing webhook event %s: %v", event.ID, err)
+		if errors.Is(err, errBadPayload) {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handledEvents are the event types processEvent acts on. All invoice events
+// are cached for the billing history; applyEvent acts on the others.
+var handledEvents = map[string]bool{
+	"checkout.session.completed":           true,
+	"checkout.session.expired":             true,
+	"customer.subscription.updated":        true,
+	"customer.subscription.deleted":        true,
+	"customer.subscription.trial_will_end": true,
+	"invoice.created":                      true,
+	"invoice.finalized":                    true,
+	"invoice.updated":                      true,
+	"invoice.payment_failed":               true,
+	"invoice.paid":                         true,
+	"invoice.voided":                       true,
+	"invoice.marked_uncollectible":         true,
+}
+
+// applyEvent updates the user an event is about
+func applyEvent(ctx context.Context, event stripe.Event) error {
 	switch event.Type {
 	case "checkout.session.completed":
 		var session struct {
-			ClientReferenceID string `json:"client_reference_id"`
-			Customer          string `json:"customer"`
-			Subscription      string `json:"subscription"`
+			ID                string            `json:"id"`
+			ClientReferenceID string            `json:"client_reference_id"`
+			Customer          string            `json:"customer"`
+			Subscription      string            `json:"subscription"`
+			Metadata          map[string]string `json:"metadata"`
 		}
 		if err := json.Unmarshal(event.Data.Raw, &session); err != nil {
 			log.Printf("Error parsing checkout.session.completed JSON: %v\n", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			return errBadPayload
 		}
 		log.Printf("Processing checkout session: Ref=%s, Cus=%s, Sub=%s", session.ClientReferenceID, session.Customer, session.Subscription)
-		handleCheckoutSessionCompleted(session.ClientReferenceID, session.Customer, session.Subscription)
+		return handleCheckoutSessionCompleted(session.ID, session.ClientReferenceID, session.Customer, session.Subscription, session.Metadata)
+
+	case "checkout.session.expired":
+		var session struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(event.Data.Raw, &session); err != nil {
+			log.Printf("Error parsing checkout.session.expired JSON: %v\n", err)
+			return errBadPayload
+		}
+		log.Printf("Processing expired checkout session: %s", session.ID)
+		return releaseRedemptions(session.ID)
 
 	case "customer.subscription.updated":
 		var subscription struct {
 			Customer string `json:"customer"`
 			Status   string `json:"status"`
+			Items    struct {
+				Data []struct {
+					Price struct {
+						ID        string `json:"id"`
+						Recurring struct {
+							Interval string `json:"interval"`
+						} `json:"recurring"`
+					} `json:"price"`
+				} `json:"data"`
+			} `json:"items"`
 		}
 		if err := json.Unmarshal(event.Data.Raw, &subscription); err != nil {
 			log.Printf("Error parsing customer.subscription.updated JSON: %v\n", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			return errBadPayload
+		}
+		var priceID, interval string
+		if len(subscription.Items.Data) > 0 {
+			priceID = subscription.Items.Data[0].Price.ID
+			interval = subscription.Items.Data[0].Price.Recurring.Interval
 		}
-		log.Printf("Processing subscription update: Cus=%s, Status=%s", subscription.Customer, subscription.Status)
-		handleSubscriptionUpdated(subscription.Customer, subscription.Status)
+		log.Printf("Processing subscription update: Cus=%s, Status=%s, Price=%s", subscription.Customer, subscription.Status, priceID)
+		return handleSubscriptionUpdated(subscription.Customer, subscription.Status, priceID, interval)
 
 	case "customer.subscription.deleted":
 		var subscription struct {
@@ -153,64 +309,160 @@ func WebhookHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		if err := json.Unmarshal(event.Data.Raw, &subscription); err != nil {
 			log.Printf("Error parsing customer.subscription.deleted JSON: %v\n", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			return errBadPayload
 		}
 		log.Printf("Processing subscription deletion: Cus=%s", subscription.Customer)
-		handleSubscriptionDeleted(subscription.Customer)
-	}
+		return handleSubscriptionDeleted(subscription.Customer)
 
-	w.WriteHeader(http.StatusOK)
+	case "customer.subscription.trial_will_end":
+		var subscription struct {
+			Customer string `json:"customer"`
+			TrialEnd int64  `json:"trial_end"`
+		}
+		if err := json.Unmarshal(event.Data.Raw, &subscription); err != nil {
+			log.Printf("Error parsing customer.subscription.trial_will_end JSON: %v\n", err)
+			return errBadPayload
+		}
+		log.Printf("Processing trial ending: Cus=%s", subscription.Customer)
+		return handleTrialWillEnd(ctx, subscription.Customer, subscription.TrialEnd)
+
+	case "invoice.payment_failed", "invoice.paid":
+		var invoice struct {
+			ID                 string `json:"id"`
+			Customer           string `json:"customer"`
+			Subscription       string `json:"subscription"`
+			AttemptCount       int64  `json:"attempt_count"`
+			NextPaymentAttempt int64  `json:"next_payment_attempt"`
+		}
+		if err := json.Unmarshal(event.Data.Raw, &invoice); err != nil {
+			log.Printf("Error parsing %s JSON: %v\n", event.Type, err)
+			return errBadPayload
+		}
+		if invoice.Subscription == "" {
+			return nil // Not a subscription invoice
+		}
+		log.Printf("Processing %s: Cus=%s, Attempt=%d", event.Type, invoice.Customer, invoice.AttemptCount)
+		if event.Type == "invoice.paid" {
+			return handleInvoicePaid(ctx, invoice.Customer)
+		}
+		return handleInvoicePaymentFailed(ctx, invoice.Customer, invoice.ID, invoice.AttemptCount, invoice.NextPaymentAttempt)
+	}
+	return nil
 }
 
-func handleCheckoutSessionCompleted(clientReferenceID, customerID, subscriptionID string) {
+func handleCheckoutSessionCompleted(sessionID, clientReferenceID, customerID, subscriptionID string, metadata map[string]string) error {
 	userID, _ := strconv.Atoi(clientReferenceID)
 
 	var user domain.User
 	if result := database.DB.First(&user, userID); result.Error != nil {
 		log.Printf("User not found for ID %d: %v", userID, result.Error)
-		return
+		return nil
 	}
 
 	user.StripeCustomerID = customerID
 	user.SubscriptionID = subscriptionID
+	// Reconcile only looks up checkouts that haven't been applied
+	if user.CheckoutSessionID == sessionID {
+		user.CheckoutSessionID = ""
+	}
 	user.SubscriptionTier = "pro"
 	user.SubscriptionStatus = "active"
+	if price, ok := findPrice(metadata["price_id"]); ok {
+		user.StripePriceID = price.ID
+		user.BillingInterval = price.Interval
+	}
+	if metadata["trial_days"] != "" {
+		user.SubscriptionStatus = "trialing"
+	}
 
-	database.DB.Save(&user)
+	if err := saveSubscription(database.DB, &user); err != nil {
+		return err
+	}
+	if err := recordRedemptions(user, sessionID, metadata); err != nil {
+		return err
+	}
 	log.Printf("User %d upgraded to Pro", userID)
+	return nil
 }
 
-func handleSubscriptionUpdated(customerID, status string) {
+func handleSubscriptionUpdated(customerID, status, priceID, interval string) error {
 	var user domain.User
 	if result := database.DB.Where("stripe_customer_id = ?", customerID).First(&user); result.Error != nil {
 		log.Printf("User not found for customer ID %s: %v", customerID, result.Error)
-		return
+		return nil
 	}
 
 	user.SubscriptionStatus = status
-	if status == "active" || status == "trialing" {
+	// Keep the known price when the event has no items
+	if priceID != "" {
+		user.StripePriceID = priceID
+		user.BillingInterval = interval
+	}
+	switch status {
+	case "active", "trialing":
+		clearPaymentProblem(&user)
 		user.SubscriptionTier = "pro"
-	} else {
-		// past_due, canceled, unpaid
-		// We might want to keep them as pro for a grace period, but for simplicity:
-		if status == "canceled" || status == "unpaid" {
-			user.SubscriptionTier = "free"
-		}
+	case "past_due":
+		// Pro is kept for the grace period, see dunning.go
+		startGrace(&user, time.Now())
+		user.SubscriptionTier = paidTier(user)
+	case "unpaid":
+		// Stripe gave up retrying; the banner stays until an invoice is paid
+		user.GraceEndsAt = nil
+		user.SubscriptionTier = "free"
+	case "canceled", "incomplete_expired":
+		clearPaymentProblem(&user)
+		user.SubscriptionTier = "free"
+	case "incomplete", "paused":
+		// The first payment hasn't gone through, or a trial ended without
+		// a payment method; Pro returns when Stripe activates it
+		clearPaymentProblem(&user)
+		user.SubscriptionTier = "free"
+	default:
+		user.SubscriptionTier = paidTier(user)
 	}
-	database.DB.Save(&user)
+	if tier, ok := grantedTier(user.ID); ok {
+		user.SubscriptionTier = tier
+	}
+	return saveSubscription(database.DB, &user)
 }
 
-func handleSubscriptionDeleted(customerID string) {
+func handleSubscriptionDeleted(customerID string) error {
 	var user domain.User
 	if result := database.DB.Where("stripe_customer_id = ?", customerID).First(&user); result.Error != nil {
 		log.Printf("User not found for customer ID %s: %v", customerID, result.Error)
-		return
+		return nil
 	}
 
 	user.SubscriptionTier = "free"
 	user.SubscriptionStatus = "canceled"
 	user.SubscriptionID = ""
-	database.DB.Save(&user)
+	user.StripePriceID = ""
+	user.BillingInterval = ""
+	clearPaymentProblem(&user)
+	if tier, ok := grantedTier(user.ID); ok {
+		user.SubscriptionTier = tier
+		if err := saveSubscription(database.DB, &user); err != nil {
+			return err
+		}
+		log.Printf("User %d canceled, keeping granted %s tier", user.ID, tier)
+		return nil
+	}
+	if err := saveSubscription(database.DB, &user); err != nil {
+		return err
+	}
 	log.Printf("User %d downgraded to Free", user.ID)
+	return nil
+}
+
+// saveSubscription stores the user and, in the same transaction, archives
+// the wines over their new plan's limit or reactivates archived ones when
+// there is room again. If either fails the event fails and is retried.
+func saveSubscription(db *gorm.DB, user *domain.User) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(user).Error; err != nil {
+			return err
+		}
+		return plans.ApplyLimit(tx, user.ID, user.SubscriptionTier)
+	})
 }
@@ -0,0 +1,129 @@
+package subscription
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+)
+
+// historyLength is the number of invoices shown in the billing history
+const historyLength = 24
+
+// zeroDecimalCurrencies have no minor unit, so Stripe amounts in them are
+// whole units
+var zeroDecimalCurrencies = map[string]bool{
+	"JPY": true,
+	"KRW": true,
+}
+
+// fromMinorUnits converts a Stripe amount to the currency's main unit
+func fromMinorUnits(currency string, amount int64) float64 {
+	if zeroDecimalCurrencies[currency] {
+		return float64(amount)
+	}
+	return float64(amount) / 100
+}
+
+// toMinorUnits converts an amount to the unit Stripe uses for the currency
+func toMinorUnits(currency string, amount float64) int64 {
+	if zeroDecimalCurrencies[currency] {
+		return int64(amount)
+	}
+	return int64(amount*100 + 0.5)
+}
+
+// cacheInvoice stores the invoice an invoice.* event carries. Events arrive
+// out of order, so one older than the last event applied to the invoice is
+// ignored, and one for a customer without a user yet is retried.
+func cacheInvoice(db *gorm.DB, event stripe.Event) error {
+	var invoice struct {
+		ID               string `json:"id"`
+		Customer         string `json:"customer"`
+		Number           string `json:"number"`
+		Status           string `json:"status"`
+		Currency         string `json:"currency"`
+		AmountDue        int64  `json:"amount_due"`
+		AmountPaid       int64  `json:"amount_paid"`
+		HostedInvoiceURL string `json:"hosted_invoice_url"`
+		InvoicePDF       string `json:"invoice_pdf"`
+		Created          int64  `json:"created"`
+	}
+	if err := json.Unmarshal(event.Data.Raw, &invoice); err != nil {
+		log.Printf("Error parsing %s JSON: %v\n", event.Type, err)
+		return errBadPayload
+	}
+	if invoice.ID == "" {
+		return errBadPayload
+	}
+
+	var user domain.User
+	if result := db.Where("stripe_customer_id = ?", invoice.Customer).First(&user); result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			log.Printf("Invoice %s deferred, no user for customer ID %s", invoice.ID, invoice.Customer)
+			return errUnknownCustomer
+		}
+		return result.Error
+	}
+
+	cached := domain.Invoice{
+		UserID:           user.ID,
+		StripeInvoiceID:  invoice.ID,
+		Number:           invoice.Number,
+		Status:           invoice.Status,
+		Currency:         strings.ToUpper(invoice.Currency),
+		AmountDue:        invoice.AmountDue,
+		AmountPaid:       invoice.AmountPaid,
+		HostedInvoiceURL: invoice.HostedInvoiceURL,
+		InvoicePDF:       invoice.InvoicePDF,
+		IssuedAt:         time.Unix(invoice.Created, 0),
+		EventCreated:     time.Unix(event.Created, 0),
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "stripe_invoice_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"user_id", "number", "status", "currency", "amount_due",
+			"amount_paid", "hosted_invoice_url", "invoice_pdf", "issued_at", "event_created", "updated_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "invoices.event_created <= excluded.event_created"},
+		}},
+	}).Create(&cached).Error
+}
+
+// BillingInvoice is an invoice in the billing history
+type BillingInvoice struct {
+	domain.Invoice
+}
+
+// Amount is the amount paid, or due while the invoice is unpaid
+func (i BillingInvoice) Amount() string {
+	amount := i.AmountPaid
+	if i.Status != "paid" {
+		amount = i.AmountDue
+	}
+	return formatAmount(i.Currency, fromMinorUnits(i.Currency, amount))
+}
+
+// BillingHistory returns the user's most recent invoices, newest first.
+// Drafts aren't final yet and are left out.
+func BillingHistory(userID uint) []BillingInvoice {
+	var invoices []domain.Invoice
+	if err := database.DB.Where("user_id = ? AND status <> ?", userID, "draft").
+		Order("issued_at DESC, id DESC").Limit(historyLength).Find(&invoices).Error; err != nil {
+		log.Printf("Could not load invoices of user %d: %v", userID, err)
+		return nil
+	}
+
+	history := make([]BillingInvoice, len(invoices))
+	for i, invoice := range invoices {
+		history[i] = BillingInvoice{invoice}
+	}
+	return history
+}
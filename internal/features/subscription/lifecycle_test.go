@@ -0,0 +1,296 @@
+package subscription
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/mailer"
+	"wine-cellar/internal/shared/plans"
+)
+
+// setup gives the test an empty database and the fake billing provider
+func setup(t *testing.T) *FakeProvider {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(database.Models...); err != nil {
+		t.Fatal(err)
+	}
+	database.DB = db
+
+	t.Setenv("STRIPE_WEBHOOK_SECRET", "")
+	t.Setenv("STRIPE_TRIAL_DAYS", "")
+	t.Setenv("PAYMENT_GRACE_DAYS", "")
+	fake := NewFakeProvider()
+	previous, previousCatalog := billing, catalog
+	SetProvider(fake)
+	catalog = fakePrices
+	t.Cleanup(func() { billing, catalog = previous, previousCatalog })
+	return fake
+}
+
+// captureMail replaces the mailer for the test and returns the messages
+// sent through it
+func captureMail(t *testing.T) <-chan mailer.Message {
+	t.Helper()
+	sent := make(chan mailer.Message, 10)
+	previous := mailer.Default
+	mailer.Default = captureMailer(sent)
+	t.Cleanup(func() { mailer.Default = previous })
+	return sent
+}
+
+type captureMailer chan mailer.Message
+
+func (m captureMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m <- msg
+	return nil
+}
+
+// subjects drains the messages sent so far
+func subjects(sent <-chan mailer.Message) []string {
+	var got []string
+	for {
+		select {
+		case msg := <-sent:
+			got = append(got, msg.Subject)
+		default:
+			return got
+		}
+	}
+}
+
+// createUserWithWines returns a free user with wines over the free limit,
+// the extra ones archived
+func createUserWithWines(t *testing.T, wines int) domain.User {
+	t.Helper()
+	user := domain.User{Email: "ana@example.com", EmailVerified: true, SubscriptionTier: "free"}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < wines; i++ {
+		wine := domain.Wine{UserID: user.ID, Name: fmt.Sprintf("Wine %d", i+1)}
+		if err := database.DB.Create(&wine).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := plans.ApplyLimit(database.DB, user.ID, "free"); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// startCheckout posts the upgrade form as the user and returns the ID of
+// the checkout session it redirects to
+func startCheckout(t *testing.T, user domain.User) string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/create-checkout-session?price=price_fake_month", nil)
+	ctx := context.WithValue(r.Context(), "user_id", user.ID)
+	ctx = context.WithValue(ctx, "email", user.Email)
+	w := httptest.NewRecorder()
+	CreateCheckoutSession(w, r.WithContext(ctx))
+
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(location, "/fake-billing/checkout?session=") {
+		t.Fatalf("checkout: %d %s %s", w.Code, location, w.Body.String())
+	}
+	return strings.TrimPrefix(location, "/fake-billing/checkout?session=")
+}
+
+// lifecycleState is what each step of the lifecycle is checked against
+type lifecycleState struct {
+	tier     string
+	status   string
+	failing  bool // PaymentFailedAt is set
+	grace    bool // GraceEndsAt is set
+	invoices map[string]int
+	archived int64
+}
+
+func checkState(t *testing.T, step string, userID uint, want lifecycleState) domain.User {
+	t.Helper()
+	var user domain.User
+	if err := database.DB.First(&user, userID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.SubscriptionTier != want.tier || user.SubscriptionStatus != want.status {
+		t.Errorf("%s: tier %q status %q, want %q %q", step, user.SubscriptionTier, user.SubscriptionStatus, want.tier, want.status)
+	}
+	if (user.PaymentFailedAt != nil) != want.failing || (user.GraceEndsAt != nil) != want.grace {
+		t.Errorf("%s: payment failed at %v, grace ends at %v, want failing %t grace %t",
+			step, user.PaymentFailedAt, user.GraceEndsAt, want.failing, want.grace)
+	}
+
+	var invoices []domain.Invoice
+	database.DB.Where("user_id = ?", userID).Find(&invoices)
+	got := map[string]int{}
+	for _, inv := range invoices {
+		got[inv.Status]++
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want.invoices) {
+		t.Errorf("%s: invoices by status %v, want %v", step, got, want.invoices)
+	}
+
+	if n := plans.ArchivedCount(database.DB, userID); n != want.archived {
+		t.Errorf("%s: %d wines archived, want %d", step, n, want.archived)
+	}
+	return user
+}
+
+func TestSubscriptionLifecycle(t *testing.T) {
+	fake := setup(t)
+	sent := captureMail(t)
+	user := createUserWithWines(t, plans.Free.MaxWines+2)
+	checkState(t, "free", user.ID, lifecycleState{tier: "free", invoices: map[string]int{}, archived: 2})
+
+	sessionID := startCheckout(t, user)
+	if _, err := fake.CompleteCheckout(sessionID); err != nil {
+		t.Fatal(err)
+	}
+	user = checkState(t, "checkout", user.ID, lifecycleState{
+		tier: "pro", status: "active", invoices: map[string]int{"paid": 1}, archived: 0,
+	})
+	if user.StripePriceID != "price_fake_month" || user.BillingInterval != "month" || user.SubscriptionID == "" {
+		t.Fatalf("checkout stored price %q interval %q subscription %q", user.StripePriceID, user.BillingInterval, user.SubscriptionID)
+	}
+	customerID, subscriptionID := user.StripeCustomerID, user.SubscriptionID
+
+	if err := fake.FailPayment(subscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	user = checkState(t, "payment failed", user.ID, lifecycleState{
+		tier: "pro", status: "past_due", failing: true, grace: true, invoices: map[string]int{"paid": 1, "open": 1}, archived: 0,
+	})
+	graceEndsAt := *user.GraceEndsAt
+	if want := time.Now().Add(PaymentGracePeriod()); graceEndsAt.Before(want.Add(-time.Minute)) || graceEndsAt.After(want) {
+		t.Errorf("grace ends at %v, want about %v", graceEndsAt, want)
+	}
+
+	// A retry that fails again keeps the grace period it started with
+	if err := fake.FailPayment(subscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	user = checkState(t, "retry failed", user.ID, lifecycleState{
+		tier: "pro", status: "past_due", failing: true, grace: true, invoices: map[string]int{"paid": 1, "open": 1}, archived: 0,
+	})
+	if !user.GraceEndsAt.Equal(graceEndsAt) {
+		t.Errorf("retry moved the grace period to %v, want %v", user.GraceEndsAt, graceEndsAt)
+	}
+	if got := subjects(sent); len(got) != 2 || got[0] != "Your Winetrackr payment failed" || got[1] != got[0] {
+		t.Errorf("emails %q, want one per failed attempt", got)
+	}
+
+	// The grace period runs out
+	database.DB.Model(&user).Update("grace_ends_at", time.Now().Add(-time.Minute))
+	if err := downgradeAfterGrace(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, "grace ended", user.ID, lifecycleState{
+		tier: "free", status: "past_due", failing: true, invoices: map[string]int{"paid": 1, "open": 1}, archived: 2,
+	})
+
+	if err := fake.PayInvoice(subscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, "paid", user.ID, lifecycleState{
+		tier: "pro", status: "active", invoices: map[string]int{"paid": 2}, archived: 0,
+	})
+
+	if err := fake.CancelSubscription(subscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	user = checkState(t, "canceled", user.ID, lifecycleState{
+		tier: "free", status: "canceled", invoices: map[string]int{"paid": 2}, archived: 2,
+	})
+	if user.SubscriptionID != "" || user.StripePriceID != "" || user.BillingInterval != "" {
+		t.Errorf("canceled user keeps subscription %q price %q interval %q", user.SubscriptionID, user.StripePriceID, user.BillingInterval)
+	}
+	want := []string{
+		"Your Winetrackr account is now on the Free plan",
+		"Your Winetrackr payment went through",
+	}
+	if got := subjects(sent); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("emails %q, want %q", got, want)
+	}
+
+	// The user subscribes again while the webhook is down
+	fake.DropEvents(true)
+	if _, err := fake.CompleteCheckout(startCheckout(t, user)); err != nil {
+		t.Fatal(err)
+	}
+	fake.DropEvents(false)
+	checkState(t, "webhook missed", user.ID, lifecycleState{
+		tier: "free", status: "canceled", invoices: map[string]int{"paid": 2}, archived: 2,
+	})
+	reconcile(t, 1)
+	user = checkState(t, "reconciled", user.ID, lifecycleState{
+		tier: "pro", status: "active", invoices: map[string]int{"paid": 2}, archived: 0,
+	})
+	if user.StripeCustomerID != customerID || user.SubscriptionID == "" || user.CheckoutSessionID != "" {
+		t.Errorf("reconciled customer %q subscription %q checkout %q, want customer %q kept and the checkout cleared",
+			user.StripeCustomerID, user.SubscriptionID, user.CheckoutSessionID, customerID)
+	}
+	reconcile(t, 0)
+}
+
+// reconcile runs Reconcile over all users and checks how many drifted, all
+// of them fixed
+func reconcile(t *testing.T, drifted int) {
+	t.Helper()
+	report, err := Reconcile(context.Background(), database.DB, ReconcileOptions{}, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Drifted != drifted || report.Fixed != drifted || report.Failed != 0 {
+		t.Errorf("reconciliation drifted %d fixed %d failed %d, want %d drifted and fixed",
+			report.Drifted, report.Fixed, report.Failed, drifted)
+	}
+}
+
+func TestReconcileCheckoutOnAnotherCustomer(t *testing.T) {
+	fake := setup(t)
+	captureMail(t)
+	user := createUserWithWines(t, plans.Free.MaxWines+2)
+	database.DB.Model(&user).Updates(map[string]interface{}{"stripe_customer_id": "cus_old", "subscription_status": "canceled"})
+
+	// A checkout that made a new customer, whose completion was missed
+	checkout, err := fake.CreateCheckout(CheckoutParams{
+		Email:             user.Email,
+		ClientReferenceID: strconv.Itoa(int(user.ID)),
+		PriceID:           "price_fake_month",
+		Metadata:          map[string]string{"price_id": "price_fake_month"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.DB.Model(&user).Update("checkout_session_id", checkout.ID)
+	fake.DropEvents(true)
+	if _, err := fake.CompleteCheckout(checkout.ID); err != nil {
+		t.Fatal(err)
+	}
+	fake.DropEvents(false)
+
+	reconcile(t, 1)
+	user = checkState(t, "reconciled", user.ID, lifecycleState{
+		tier: "pro", status: "active", invoices: map[string]int{}, archived: 0,
+	})
+	if remote, _ := fake.GetCheckout(checkout.ID); user.StripeCustomerID != remote.CustomerID || user.SubscriptionID != remote.SubscriptionID {
+		t.Errorf("reconciled customer %q subscription %q, want the checkout's %q %q",
+			user.StripeCustomerID, user.SubscriptionID, remote.CustomerID, remote.SubscriptionID)
+	}
+}
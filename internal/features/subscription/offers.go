@@ -0,0 +1,147 @@
+package subscription
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm/clause"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+)
+
+var (
+	errPromoInvalid = errors.New("promotion code is not valid")
+	errPromoUsed    = errors.New("promotion code was already used")
+)
+
+// TrialDays is the free trial offered with a first subscription, set with
+// STRIPE_TRIAL_DAYS (default 0, no trial)
+func TrialDays() int {
+	days, err := strconv.Atoi(os.Getenv("STRIPE_TRIAL_DAYS"))
+	if err != nil || days < 0 {
+		return 0
+	}
+	return days
+}
+
+// AvailableTrialDays returns the trial the user can still claim, 0 when
+// there is no trial or this account or email address has had one
+func AvailableTrialDays(user domain.User) int {
+	days := TrialDays()
+	if days == 0 {
+		return 0
+	}
+	if redeemed(user, "trial", "") {
+		return 0
+	}
+	return days
+}
+
+// redeemed reports whether the user, or an earlier account with the same
+// email address, used the trial or the promotion code, or holds it in a
+// checkout that is still open
+func redeemed(user domain.User, kind, code string) bool {
+	query := database.DB.Model(&domain.Redemption{}).
+		Where("(user_id = ? OR email_hash = ?) AND kind = ?", user.ID, domain.HashEmail(user.Email), kind).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now())
+	if code != "" {
+		query = query.Where("UPPER(code) = ?", strings.ToUpper(code))
+	}
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		log.Printf("Could not look up redemptions of user %d: %v", user.ID, err)
+		return true // Don't hand out offers twice when unsure
+	}
+	return count > 0
+}
+
+// findPromotionCode returns the active promotion code the user entered,
+// unless they have used it before
+func findPromotionCode(user domain.User, code string) (PromotionCode, error) {
+	if redeemed(user, "promo", code) {
+		return PromotionCode{}, errPromoUsed
+	}
+	return billing.FindPromotionCode(code)
+}
+
+// redemptionsFor returns the trial and promotion code of a checkout, as
+// passed along in the session metadata
+func redemptionsFor(user domain.User, checkoutSessionID string, metadata map[string]string) []domain.Redemption {
+	var redemptions []domain.Redemption
+	if metadata["trial_days"] != "" {
+		redemptions = append(redemptions, domain.Redemption{Kind: "trial"})
+	}
+	if code := metadata["promotion_code"]; code != "" {
+		redemptions = append(redemptions, domain.Redemption{Kind: "promo", Code: code})
+	}
+	for i := range redemptions {
+		redemptions[i].UserID = user.ID
+		redemptions[i].EmailHash = domain.HashEmail(user.Email)
+		redemptions[i].CheckoutSessionID = checkoutSessionID
+	}
+	return redemptions
+}
+
+// holdRedemptions reserves the trial and promotion code of a checkout until
+// it expires, so they can't be claimed through a second open checkout
+func holdRedemptions(user domain.User, checkout Checkout, expiresAt time.Time, metadata map[string]string) error {
+	redemptions := redemptionsFor(user, checkout.ID, metadata)
+	if len(redemptions) == 0 {
+		return nil
+	}
+	for i := range redemptions {
+		redemptions[i].ExpiresAt = &expiresAt
+	}
+	return database.DB.Create(&redemptions).Error
+}
+
+// recordRedemptions stores the trial and promotion code of a completed
+// checkout for good, replacing the hold taken when it was created
+func recordRedemptions(user domain.User, checkoutSessionID string, metadata map[string]string) error {
+	for _, redemption := range redemptionsFor(user, checkoutSessionID, metadata) {
+		// A replayed event must not record the same checkout twice
+		err := database.DB.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "kind"}, {Name: "checkout_session_id"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"expires_at": nil}),
+		}).Create(&redemption).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseRedemptions drops the holds of a checkout that expired unpaid.
+// Completed redemptions are kept.
+func releaseRedemptions(checkoutSessionID string) error {
+	return database.DB.Where("checkout_session_id = ? AND expires_at IS NOT NULL", checkoutSessionID).
+		Delete(&domain.Redemption{}).Error
+}
+
+// releaseCheckouts expires the user's open checkouts and drops their holds.
+// A checkout that can't be expired, e.g. because it was just paid, keeps its
+// hold until it lapses.
+func releaseCheckouts(user domain.User) {
+	var sessionIDs []string
+	err := database.DB.Model(&domain.Redemption{}).
+		Where("user_id = ? AND expires_at > ?", user.ID, time.Now()).
+		Distinct().Pluck("checkout_session_id", &sessionIDs).Error
+	if err != nil {
+		log.Printf("Could not look up open checkouts of user %d: %v", user.ID, err)
+		return
+	}
+	for _, id := range sessionIDs {
+		if err := billing.ExpireCheckout(id); err != nil {
+			log.Printf("Could not expire checkout %s of user %d: %v", id, user.ID, err)
+			continue
+		}
+		if err := releaseRedemptions(id); err != nil {
+			log.Printf("Could not release the offers of checkout %s: %v", id, err)
+		}
+	}
+}
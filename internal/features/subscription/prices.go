@@ -0,0 +1,258 @@
+package subscription
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/stripe-go/v74"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/plans"
+)
+
+// Price is a Connoisseur price in the catalog
+type Price struct {
+	ID       string // Stripe price ID
+	Interval string // "month" or "year", as Stripe names them
+	Currency string // ISO code, upper case
+	Amount   float64
+}
+
+// catalog is loaded by Init
+var catalog []Price
+
+// loadPrices reads STRIPE_PRICES, a comma-separated list of
+// interval:currency:amount:price_id entries, e.g.
+// month:USD:5:price_123,year:USD:50:price_456,month:EUR:5:price_789.
+// Without it STRIPE_PRICE_ID is the only price, at $5 a month.
+func loadPrices() []Price {
+	var prices []Price
+	for _, entry := range strings.Split(os.Getenv("STRIPE_PRICES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 4 {
+			log.Printf("STRIPE_PRICES entry %q skipped: expected interval:currency:amount:price_id", entry)
+			continue
+		}
+		interval := strings.ToLower(parts[0])
+		amount, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil || amount <= 0 || (interval != "month" && interval != "year") || parts[3] == "" {
+			log.Printf("STRIPE_PRICES entry %q skipped: invalid interval, amount or price ID", entry)
+			continue
+		}
+		prices = append(prices, Price{
+			ID:       parts[3],
+			Interval: interval,
+			Currency: strings.ToUpper(parts[1]),
+			Amount:   amount,
+		})
+	}
+
+	if len(prices) == 0 && os.Getenv("STRIPE_PRICE_ID") != "" {
+		prices = append(prices, Price{ID: os.Getenv("STRIPE_PRICE_ID"), Interval: "month", Currency: "USD", Amount: 5})
+	}
+	return prices
+}
+
+// currencySymbols are written before the amount; the Scandinavian crowns
+// follow it as "kr", anything else is prefixed with its code
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+}
+
+// formatAmount writes an amount the way the rest of the app shows prices,
+// leaving out the cents of whole amounts
+func formatAmount(currency string, amount float64) string {
+	number := fmt.Sprintf("%.2f", amount)
+	if amount == math.Trunc(amount) {
+		number = fmt.Sprintf("%.0f", amount)
+	}
+
+	switch currency {
+	case "SEK", "NOK", "DKK":
+		return number + " kr"
+	}
+	if symbol, ok := currencySymbols[currency]; ok {
+		return symbol + number
+	}
+	return currency + " " + number
+}
+
+// Label is the amount with its currency, e.g. "$5"
+func (p Price) Label() string {
+	return formatAmount(p.Currency, p.Amount)
+}
+
+// findPrice looks up a price in the catalog by its Stripe ID
+func findPrice(id string) (Price, bool) {
+	for _, p := range catalog {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Price{}, false
+}
+
+// Pricing is what the pricing cards show, in one currency
+type Pricing struct {
+	Currency   string
+	Currencies []string // Every currency in the catalog
+	Monthly    *Price
+	Annual     *Price
+	Free       plans.Plan
+	Pro        plans.Plan
+}
+
+// PricingFor returns the catalog's prices in the currency. Currencies
+// without prices fall back to the first one in the catalog.
+func PricingFor(currency string) Pricing {
+	pricing := Pricing{Free: plans.Free, Pro: plans.Pro}
+
+	seen := map[string]bool{}
+	for _, p := range catalog {
+		if !seen[p.Currency] {
+			seen[p.Currency] = true
+			pricing.Currencies = append(pricing.Currencies, p.Currency)
+		}
+	}
+	pricing.Currency = strings.ToUpper(currency)
+	if !seen[pricing.Currency] {
+		pricing.Currency = "USD"
+		if len(pricing.Currencies) > 0 {
+			pricing.Currency = pricing.Currencies[0]
+		}
+	}
+
+	for i := range catalog {
+		p := &catalog[i]
+		if p.Currency != pricing.Currency {
+			continue
+		}
+		if p.Interval == "month" && pricing.Monthly == nil {
+			pricing.Monthly = p
+		}
+		if p.Interval == "year" && pricing.Annual == nil {
+			pricing.Annual = p
+		}
+	}
+	return pricing
+}
+
+// FreeLabel is the free plan's price in the pricing currency
+func (p Pricing) FreeLabel() string {
+	return formatAmount(p.Currency, 0)
+}
+
+// Available reports whether there is anything to subscribe to
+func (p Pricing) Available() bool {
+	return p.Monthly != nil || p.Annual != nil
+}
+
+// AnnualSavings is the percentage saved by paying yearly instead of twelve
+// monthly payments, 0 when there is nothing to compare
+func (p Pricing) AnnualSavings() int {
+	if p.Monthly == nil || p.Annual == nil {
+		return 0
+	}
+	saved := 100 - p.Annual.Amount/(12*p.Monthly.Amount)*100
+	if saved < 1 {
+		return 0
+	}
+	return int(math.Round(saved))
+}
+
+// defaultPrice is what checkout uses when no price was picked: monthly if
+// there is one, in the currency closest to the user's
+func defaultPrice(currency string) (Price, bool) {
+	pricing := PricingFor(currency)
+	if pricing.Monthly != nil {
+		return *pricing.Monthly, true
+	}
+	if pricing.Annual != nil {
+		return *pricing.Annual, true
+	}
+	return Price{}, false
+}
+
+// CurrentPrice returns the catalog price the user is subscribed to, nil
+// without a subscription or when the price was removed from the catalog
+func CurrentPrice(user domain.User) *Price {
+	if user.SubscriptionID == "" || user.StripePriceID == "" {
+		return nil
+	}
+	if p, ok := findPrice(user.StripePriceID); ok {
+		return &p
+	}
+	return nil
+}
+
+// SwitchOption returns the price in the other billing interval the user can
+// switch to. Stripe can't change a subscription's currency, so only prices
+// in the current one are offered.
+func SwitchOption(user domain.User) *Price {
+	current := CurrentPrice(user)
+	if current == nil {
+		return nil
+	}
+	pricing := PricingFor(current.Currency)
+	if pricing.Currency != current.Currency {
+		return nil
+	}
+	if current.Interval == "month" {
+		return pricing.Annual
+	}
+	return pricing.Monthly
+}
+
+// PricingForUser picks the currency to show the user prices in: their
+// subscription's, or else their display currency
+func PricingForUser(user domain.User) Pricing {
+	if current := CurrentPrice(user); current != nil {
+		return PricingFor(current.Currency)
+	}
+	return PricingFor(user.Currency)
+}
+
+// BackfillPrices stores the price and billing interval of subscribers from
+// before the price catalog, so that CurrentPrice and SwitchOption work for
+// them. It runs once in the background; users that fail are tried again at
+// the next start.
+func BackfillPrices() {
+	if _, ok := billing.(stripeProvider); ok && stripe.Key == "" {
+		return
+	}
+	go func() {
+		var users []domain.User
+		if err := database.DB.Where("subscription_id <> '' AND (stripe_price_id = '' OR billing_interval = '')").
+			Find(&users).Error; err != nil {
+			log.Printf("Could not look up subscribers without a price: %v", err)
+			return
+		}
+		for _, user := range users {
+			current, err := billing.GetSubscription(user.SubscriptionID)
+			if err != nil || current.PriceID == "" {
+				log.Printf("Could not fetch the price of subscription %s (user %d): %v", user.SubscriptionID, user.ID, err)
+				continue
+			}
+			if err := database.DB.Model(&user).Updates(map[string]interface{}{
+				"stripe_price_id":  current.PriceID,
+				"billing_interval": current.Interval,
+			}).Error; err != nil {
+				log.Printf("Could not store the price of user %d: %v", user.ID, err)
+				continue
+			}
+			log.Printf("Stored price %s of user %d", current.PriceID, user.ID)
+		}
+	}()
+}
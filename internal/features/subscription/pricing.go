@@ -0,0 +1,61 @@
+package subscription
+
+import (
+	"html/template"
+	"net/http"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/features/auth"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/plans"
+	"wine-cellar/internal/shared/ui"
+
+	"github.com/gorilla/csrf"
+)
+
+// PricingHandler shows the plans with the catalog's prices. Visitors see
+// them in the currency picked with ?currency=, logged in users in their
+// own and can go straight to checkout.
+func PricingHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.New("pricing.html").Funcs(ui.FuncMap).ParseFiles(
+		"internal/features/subscription/pricing.html",
+		"templates/pricing_plans.html",
+		"templates/header.html",
+		"templates/footer.html",
+		"templates/analytics.html",
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	userID, email, loggedIn := auth.GetSessionUser(r)
+
+	pricing := PricingFor(r.URL.Query().Get("currency"))
+	tier := ""
+	if loggedIn {
+		var user domain.User
+		if result := database.DB.First(&user, userID); result.Error == nil {
+			tier = plans.For(user).Tier
+			if r.URL.Query().Get("currency") == "" {
+				pricing = PricingForUser(user)
+			}
+		}
+	}
+
+	data := struct {
+		Pricing   Pricing
+		Tier      string
+		LoggedIn  bool
+		UserEmail string
+		CSRFField template.HTML
+	}{
+		Pricing:   pricing,
+		Tier:      tier,
+		LoggedIn:  loggedIn,
+		UserEmail: email,
+		CSRFField: csrf.TemplateField(r),
+	}
+
+	tmpl.Execute(w, data)
+}
@@ -0,0 +1,133 @@
+package subscription
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// BillingProvider is what the subscription flow needs from the payment
+// provider. Stripe takes the payments; the fake runs in-process for offline
+// development and tests. Both send Stripe-shaped webhook events, so
+// WebhookHandler applies them the same way.
+type BillingProvider interface {
+	// CreateCheckout starts a subscription and returns the session to send
+	// the user to
+	CreateCheckout(params CheckoutParams) (Checkout, error)
+	// GetCheckout returns a checkout session, whatever its status
+	GetCheckout(sessionID string) (RemoteCheckout, error)
+	// ExpireCheckout closes an open checkout session so it can no longer be
+	// paid. Sessions that are already closed are an error.
+	ExpireCheckout(sessionID string) error
+	// CreatePortal returns the URL of the customer's billing portal
+	CreatePortal(customerID, returnURL string) (string, error)
+	// CancelSubscription ends a subscription straight away, without
+	// prorating. Subscriptions that no longer exist are not an error.
+	CancelSubscription(subscriptionID string) error
+	// GetSubscription returns the price a subscription is on
+	GetSubscription(subscriptionID string) (SubscriptionPrice, error)
+	// ChangePrice moves a subscription to another price, invoicing the
+	// prorated difference immediately
+	ChangePrice(subscriptionID, priceID string) (SubscriptionPrice, error)
+	// FindPromotionCode returns the active promotion code, or
+	// errPromoInvalid
+	FindPromotionCode(code string) (PromotionCode, error)
+	// ParseWebhook verifies the signature of a webhook delivery and parses
+	// its event
+	ParseWebhook(payload []byte, signature string) (stripe.Event, error)
+	// ListSubscriptions returns all of the customer's subscriptions,
+	// canceled ones included, newest first
+	ListSubscriptions(customerID string) ([]RemoteSubscription, error)
+}
+
+// CheckoutParams describe the subscription a checkout starts
+type CheckoutParams struct {
+	Email             string
+	CustomerID        string // Customer to bill; empty to create one with Email
+	ClientReferenceID string // Our user ID, echoed back in checkout.session.completed
+	PriceID           string
+	TrialDays         int    // 0 for no trial
+	PromotionCodeID   string // Empty for no discount
+	Metadata          map[string]string
+	SuccessURL        string
+	CancelURL         string
+	ExpiresAt         time.Time // When the session can no longer be paid
+}
+
+// Checkout is an open checkout session
+type Checkout struct {
+	ID  string
+	URL string
+}
+
+// RemoteCheckout is a checkout session as the billing provider has it
+type RemoteCheckout struct {
+	ID                string
+	Status            string // "open", "complete" or "expired"
+	ClientReferenceID string
+	CustomerID        string // Empty until the checkout completes
+	SubscriptionID    string
+	Metadata          map[string]string
+}
+
+// PromotionCode is a discount code entered at checkout
+type PromotionCode struct {
+	ID   string
+	Code string
+}
+
+// SubscriptionPrice is the price a subscription is on
+type SubscriptionPrice struct {
+	PriceID  string
+	Interval string
+}
+
+// RemoteSubscription is a subscription as the billing provider has it
+type RemoteSubscription struct {
+	ID       string
+	Status   string // Stripe's status, e.g. "active" or "canceled"
+	PriceID  string
+	Interval string
+	Created  time.Time
+}
+
+// errNoWebhookSecret means webhooks can't be verified until
+// STRIPE_WEBHOOK_SECRET is set
+var errNoWebhookSecret = errors.New("STRIPE_WEBHOOK_SECRET is not set")
+
+// billing is set by Init
+var billing BillingProvider = stripeProvider{}
+
+// newProvider picks the provider named by BILLING_PROVIDER, "stripe" by
+// default. The fake takes no payments, so it is refused outside
+// APP_ENV=dev.
+func newProvider() BillingProvider {
+	switch name := os.Getenv("BILLING_PROVIDER"); name {
+	case "", "stripe":
+		return stripeProvider{}
+	case "fake":
+		if os.Getenv("APP_ENV") != "dev" {
+			log.Fatal("BILLING_PROVIDER=fake is only allowed with APP_ENV=dev")
+		}
+		log.Println("Using the fake billing provider, no payments are taken")
+		return NewFakeProvider()
+	default:
+		log.Fatalf("Unknown BILLING_PROVIDER %q, expected stripe or fake", name)
+		return nil
+	}
+}
+
+// SetProvider replaces the billing provider, e.g. with a FakeProvider in
+// tests
+func SetProvider(p BillingProvider) {
+	billing = p
+}
+
+// Fake returns the billing provider if it is the fake one, otherwise nil
+func Fake() *FakeProvider {
+	fake, _ := billing.(*FakeProvider)
+	return fake
+}
@@ -0,0 +1,236 @@
+package subscription
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+	"gorm.io/gorm"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/jobs"
+)
+
+// ScheduleReconciliation runs Reconcile for every customer once per
+// SUBSCRIPTION_RECONCILE_INTERVAL (default 24h, "off" to disable), catching
+// webhooks that were missed
+func ScheduleReconciliation() {
+	if _, ok := billing.(stripeProvider); ok && stripe.Key == "" {
+		log.Println("Job subscription-reconcile disabled, STRIPE_SECRET_KEY is not set")
+		return
+	}
+	jobs.Every("subscription-reconcile", jobs.Duration("SUBSCRIPTION_RECONCILE_INTERVAL", 24*time.Hour), func(ctx context.Context) error {
+		report, err := Reconcile(ctx, database.DB, ReconcileOptions{}, log.Printf)
+		if err != nil {
+			return err
+		}
+		log.Printf("Subscription reconciliation: checked %d, drifted %d, fixed %d, failed %d",
+			report.Checked, report.Drifted, report.Fixed, report.Failed)
+		return nil
+	})
+}
+
+// ReconcileOptions select the users Reconcile checks
+type ReconcileOptions struct {
+	CustomerID string // Only check this Stripe customer
+	DryRun     bool   // Only report drift
+}
+
+// Discrepancy is a field where a user's local subscription differs from the
+// billing provider's
+type Discrepancy struct {
+	UserID     uint
+	CustomerID string
+	Field      string // "checkout", "subscription_id", "status", "price", "interval" or "tier"
+	Local      string
+	Remote     string
+}
+
+// ReconcileReport summarises a reconciliation
+type ReconcileReport struct {
+	Checked       int
+	Drifted       int // Users with at least one discrepancy
+	Fixed         int
+	Failed        int
+	Discrepancies []Discrepancy
+}
+
+// Reconcile compares every customer's subscription with the billing
+// provider and fixes drift, e.g. after a webhook was missed. Users' last
+// checkout is checked too, in case its checkout.session.completed was
+// missed. Fixes go through the webhook
+// handlers, so grace periods, tier grants and the wine limit are applied as
+// if the missed event had arrived.
+func Reconcile(ctx context.Context, db *gorm.DB, opts ReconcileOptions, logf func(format string, args ...interface{})) (ReconcileReport, error) {
+	var report ReconcileReport
+
+	query := db.WithContext(ctx).Where("(stripe_customer_id <> '' OR checkout_session_id <> '')").Order("id")
+	if opts.CustomerID != "" {
+		query = query.Where("stripe_customer_id = ?", opts.CustomerID)
+	}
+	var users []domain.User
+	if err := query.Find(&users).Error; err != nil {
+		return report, err
+	}
+
+	for _, user := range users {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		report.Checked++
+
+		// The checkout is cleared once applied, so a paid one still stored
+		// means its checkout.session.completed was missed. It is checked
+		// first: the subscription it started may be on another customer.
+		var diffs []Discrepancy
+		if user.CheckoutSessionID != "" {
+			checkout, err := billing.GetCheckout(user.CheckoutSessionID)
+			if err != nil {
+				// The customer is still checked, the checkout may be gone
+				logf("Could not look up checkout %s of user %d: %v", user.CheckoutSessionID, user.ID, err)
+				if user.StripeCustomerID == "" {
+					report.Failed++
+					continue
+				}
+			} else if checkout.Status == "complete" && checkout.ClientReferenceID == strconv.Itoa(int(user.ID)) {
+				diffs = append(diffs, Discrepancy{UserID: user.ID, CustomerID: checkout.CustomerID, Field: "checkout", Local: "open", Remote: "complete"})
+				if opts.DryRun {
+					user.StripeCustomerID = checkout.CustomerID
+				} else {
+					if err := handleCheckoutSessionCompleted(checkout.ID, checkout.ClientReferenceID, checkout.CustomerID, checkout.SubscriptionID, checkout.Metadata); err != nil {
+						report.Failed++
+						logf("Could not apply checkout %s of user %d: %v", checkout.ID, user.ID, err)
+						continue
+					}
+					if err := db.First(&user, user.ID).Error; err != nil {
+						report.Failed++
+						logf("Could not reload user %d: %v", user.ID, err)
+						continue
+					}
+				}
+			} else if checkout.Status == "expired" && !opts.DryRun {
+				// An abandoned checkout is not looked up again
+				if err := db.Model(&user).Update("checkout_session_id", "").Error; err != nil {
+					logf("Could not forget expired checkout %s of user %d: %v", checkout.ID, user.ID, err)
+				}
+			}
+		}
+		if user.StripeCustomerID == "" {
+			continue
+		}
+
+		subs, err := billing.ListSubscriptions(user.StripeCustomerID)
+		if err != nil {
+			report.Failed++
+			logf("Could not list subscriptions of customer %s (user %d): %v", user.StripeCustomerID, user.ID, err)
+			continue
+		}
+
+		current := currentSubscription(subs)
+		remaining := compareSubscription(user, current)
+		diffs = append(diffs, remaining...)
+		if len(diffs) == 0 {
+			continue
+		}
+		report.Drifted++
+		report.Discrepancies = append(report.Discrepancies, diffs...)
+		for _, d := range diffs {
+			logf("User %d (customer %s) %s differs: local %q, provider %q", d.UserID, d.CustomerID, d.Field, d.Local, d.Remote)
+		}
+		if opts.DryRun {
+			continue
+		}
+
+		if len(remaining) > 0 {
+			if err := fixSubscription(user, current); err != nil {
+				report.Failed++
+				logf("Could not fix subscription of user %d: %v", user.ID, err)
+				continue
+			}
+		}
+		var fixed domain.User
+		if err := db.First(&fixed, user.ID).Error; err != nil {
+			report.Failed++
+			logf("Could not reload user %d: %v", user.ID, err)
+			continue
+		}
+		if left := compareSubscription(fixed, current); len(left) > 0 {
+			report.Failed++
+			logf("User %d still differs after the fix: %s is %q, provider %q", user.ID, left[0].Field, left[0].Local, left[0].Remote)
+			continue
+		}
+		report.Fixed++
+	}
+	return report, nil
+}
+
+// currentSubscription picks the subscription a customer is billed for: the
+// newest one that hasn't ended. Nil means the customer has none.
+func currentSubscription(subs []RemoteSubscription) *RemoteSubscription {
+	for i := range subs {
+		switch subs[i].Status {
+		case "canceled", "incomplete_expired":
+			continue
+		}
+		return &subs[i]
+	}
+	return nil
+}
+
+// compareSubscription lists where the user differs from what the webhook
+// handlers would have stored for the provider's subscription
+func compareSubscription(user domain.User, current *RemoteSubscription) []Discrepancy {
+	want := user
+	if current != nil {
+		want.SubscriptionID = current.ID
+		want.SubscriptionStatus = current.Status
+		if current.PriceID != "" {
+			want.StripePriceID = current.PriceID
+			want.BillingInterval = current.Interval
+		}
+		if current.Status == "past_due" {
+			startGrace(&want, time.Now())
+		}
+	} else {
+		want.SubscriptionID = ""
+		want.StripePriceID = ""
+		want.BillingInterval = ""
+		if user.SubscriptionStatus != "" {
+			want.SubscriptionStatus = "canceled"
+		}
+	}
+	want.SubscriptionTier = paidTier(want)
+	if tier, ok := grantedTier(user.ID); ok {
+		want.SubscriptionTier = tier
+	}
+
+	var diffs []Discrepancy
+	add := func(field, local, remote string) {
+		if local != remote {
+			diffs = append(diffs, Discrepancy{UserID: user.ID, CustomerID: user.StripeCustomerID, Field: field, Local: local, Remote: remote})
+		}
+	}
+	add("subscription_id", user.SubscriptionID, want.SubscriptionID)
+	add("status", user.SubscriptionStatus, want.SubscriptionStatus)
+	add("price", user.StripePriceID, want.StripePriceID)
+	add("interval", user.BillingInterval, want.BillingInterval)
+	add("tier", user.SubscriptionTier, want.SubscriptionTier)
+	return diffs
+}
+
+// fixSubscription applies the provider's subscription the way the webhook
+// for it would have
+func fixSubscription(user domain.User, current *RemoteSubscription) error {
+	if current == nil {
+		return handleSubscriptionDeleted(user.StripeCustomerID)
+	}
+	if user.SubscriptionID != current.ID {
+		if err := database.DB.Model(&user).Update("subscription_id", current.ID).Error; err != nil {
+			return err
+		}
+	}
+	return handleSubscriptionUpdated(user.StripeCustomerID, current.Status, current.PriceID, current.Interval)
+}
@@ -0,0 +1,222 @@
+package subscription
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/billingportal/session"
+	checkoutsession "github.com/stripe/stripe-go/v74/checkout/session"
+	"github.com/stripe/stripe-go/v74/promotioncode"
+	stripesubscription "github.com/stripe/stripe-go/v74/subscription"
+	"github.com/stripe/stripe-go/v74/webhook"
+)
+
+// stripeProvider bills through the Stripe API, using the key set by Init
+type stripeProvider struct{}
+
+func (stripeProvider) CreateCheckout(p CheckoutParams) (Checkout, error) {
+	params := &stripe.CheckoutSessionParams{
+		ClientReferenceID: stripe.String(p.ClientReferenceID),
+		Mode:              stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		SuccessURL:        stripe.String(p.SuccessURL),
+		CancelURL:         stripe.String(p.CancelURL),
+		ExpiresAt:         stripe.Int64(p.ExpiresAt.Unix()),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{
+				Price:    stripe.String(p.PriceID),
+				Quantity: stripe.Int64(1),
+			},
+		},
+	}
+	// Stripe takes either; a returning subscriber keeps their customer
+	if p.CustomerID != "" {
+		params.Customer = stripe.String(p.CustomerID)
+	} else {
+		params.CustomerEmail = stripe.String(p.Email)
+	}
+	if p.TrialDays > 0 {
+		params.SubscriptionData = &stripe.CheckoutSessionSubscriptionDataParams{
+			TrialPeriodDays: stripe.Int64(int64(p.TrialDays)),
+		}
+	}
+	if p.PromotionCodeID != "" {
+		params.Discounts = []*stripe.CheckoutSessionDiscountParams{
+			{PromotionCode: stripe.String(p.PromotionCodeID)},
+		}
+	}
+	for key, value := range p.Metadata {
+		params.AddMetadata(key, value)
+	}
+
+	s, err := checkoutsession.New(params)
+	if err != nil {
+		return Checkout{}, fmt.Errorf("checkoutsession.New: %w", err)
+	}
+	return Checkout{ID: s.ID, URL: s.URL}, nil
+}
+
+func (stripeProvider) GetCheckout(sessionID string) (RemoteCheckout, error) {
+	s, err := checkoutsession.Get(sessionID, nil)
+	if err != nil {
+		return RemoteCheckout{}, fmt.Errorf("checkoutsession.Get: %w", err)
+	}
+	checkout := RemoteCheckout{
+		ID:                s.ID,
+		Status:            string(s.Status),
+		ClientReferenceID: s.ClientReferenceID,
+		Metadata:          s.Metadata,
+	}
+	if s.Customer != nil {
+		checkout.CustomerID = s.Customer.ID
+	}
+	if s.Subscription != nil {
+		checkout.SubscriptionID = s.Subscription.ID
+	}
+	return checkout, nil
+}
+
+func (stripeProvider) ExpireCheckout(sessionID string) error {
+	if _, err := checkoutsession.Expire(sessionID, nil); err != nil {
+		return fmt.Errorf("checkoutsession.Expire: %w", err)
+	}
+	return nil
+}
+
+func (stripeProvider) CreatePortal(customerID, returnURL string) (string, error) {
+	params := &stripe.BillingPortalSessionParams{
+		Customer:  stripe.String(customerID),
+		ReturnURL: stripe.String(returnURL),
+	}
+
+	s, err := session.New(params)
+	if err != nil {
+		return "", fmt.Errorf("session.New: %w", err)
+	}
+	return s.URL, nil
+}
+
+func (stripeProvider) CancelSubscription(subscriptionID string) error {
+	_, err := stripesubscription.Cancel(subscriptionID, &stripe.SubscriptionCancelParams{
+		InvoiceNow: stripe.Bool(false),
+		Prorate:    stripe.Bool(false),
+	})
+	if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.Code == stripe.ErrorCodeResourceMissing {
+		// Already gone on Stripe's side
+		return nil
+	}
+	return err
+}
+
+func (stripeProvider) GetSubscription(subscriptionID string) (SubscriptionPrice, error) {
+	sub, err := stripesubscription.Get(subscriptionID, nil)
+	if err != nil {
+		return SubscriptionPrice{}, fmt.Errorf("subscription.Get: %w", err)
+	}
+	var current SubscriptionPrice
+	if sub.Items != nil && len(sub.Items.Data) > 0 && sub.Items.Data[0].Price != nil {
+		price := sub.Items.Data[0].Price
+		current.PriceID = price.ID
+		if price.Recurring != nil {
+			current.Interval = string(price.Recurring.Interval)
+		}
+	}
+	return current, nil
+}
+
+// ChangePrice swaps the price of the subscription's only item. Stripe
+// credits the unused part of the current period against the new price and,
+// with always_invoice, charges the difference now. A credit larger than the
+// new price stays on the customer's balance for later invoices.
+func (stripeProvider) ChangePrice(subscriptionID, priceID string) (SubscriptionPrice, error) {
+	sub, err := stripesubscription.Get(subscriptionID, nil)
+	if err != nil {
+		return SubscriptionPrice{}, fmt.Errorf("subscription.Get: %w", err)
+	}
+	if sub.Items == nil || len(sub.Items.Data) != 1 {
+		return SubscriptionPrice{}, fmt.Errorf("subscription %s does not have exactly one item", sub.ID)
+	}
+
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				ID:    stripe.String(sub.Items.Data[0].ID),
+				Price: stripe.String(priceID),
+			},
+		},
+		ProrationBehavior: stripe.String("always_invoice"),
+	}
+	updated, err := stripesubscription.Update(sub.ID, params)
+	if err != nil {
+		return SubscriptionPrice{}, fmt.Errorf("subscription.Update: %w", err)
+	}
+
+	changed := SubscriptionPrice{PriceID: priceID}
+	if updated.Items != nil && len(updated.Items.Data) > 0 && updated.Items.Data[0].Price != nil {
+		price := updated.Items.Data[0].Price
+		changed.PriceID = price.ID
+		if price.Recurring != nil {
+			changed.Interval = string(price.Recurring.Interval)
+		}
+	}
+	return changed, nil
+}
+
+func (stripeProvider) FindPromotionCode(code string) (PromotionCode, error) {
+	params := &stripe.PromotionCodeListParams{
+		Code:   stripe.String(code),
+		Active: stripe.Bool(true),
+	}
+	params.Limit = stripe.Int64(1)
+	iter := promotioncode.List(params)
+	if iter.Next() {
+		promo := iter.PromotionCode()
+		return PromotionCode{ID: promo.ID, Code: promo.Code}, nil
+	}
+	if err := iter.Err(); err != nil {
+		return PromotionCode{}, fmt.Errorf("promotioncode.List: %w", err)
+	}
+	return PromotionCode{}, errPromoInvalid
+}
+
+func (stripeProvider) ParseWebhook(payload []byte, signature string) (stripe.Event, error) {
+	endpointSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+	if endpointSecret == "" {
+		return stripe.Event{}, errNoWebhookSecret
+	}
+
+	// Use ConstructEventWithOptions to ignore API version mismatch
+	return webhook.ConstructEventWithOptions(payload, signature, endpointSecret, webhook.ConstructEventOptions{
+		IgnoreAPIVersionMismatch: true,
+	})
+}
+
+func (stripeProvider) ListSubscriptions(customerID string) ([]RemoteSubscription, error) {
+	params := &stripe.SubscriptionListParams{
+		Customer: stripe.String(customerID),
+		Status:   stripe.String("all"),
+	}
+	var subs []RemoteSubscription
+	iter := stripesubscription.List(params)
+	for iter.Next() {
+		sub := iter.Subscription()
+		remote := RemoteSubscription{
+			ID:      sub.ID,
+			Status:  string(sub.Status),
+			Created: time.Unix(sub.Created, 0),
+		}
+		if sub.Items != nil && len(sub.Items.Data) > 0 && sub.Items.Data[0].Price != nil {
+			price := sub.Items.Data[0].Price
+			remote.PriceID = price.ID
+			if price.Recurring != nil {
+				remote.Interval = string(price.Recurring.Interval)
+			}
+		}
+		subs = append(subs, remote)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("subscription.List: %w", err)
+	}
+	return subs, nil
+}
@@ -0,0 +1,60 @@
+package subscription
+
+import (
+	"log"
+	"net/http"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+)
+
+// SwitchPriceHandler moves the user's subscription to another price in the
+// catalog, e.g. from monthly to annual billing. The provider prorates the
+// change, see BillingProvider.ChangePrice.
+func SwitchPriceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(uint)
+
+	var user domain.User
+	if result := database.DB.First(&user, userID); result.Error != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	if user.SubscriptionID == "" || (user.SubscriptionStatus != "active" && user.SubscriptionStatus != "trialing") {
+		http.Error(w, "No active subscription to change", http.StatusBadRequest)
+		return
+	}
+
+	option := SwitchOption(user)
+	if option == nil || option.ID != r.FormValue("price") {
+		http.Error(w, "This plan is not available", http.StatusBadRequest)
+		return
+	}
+
+	changed, err := billing.ChangePrice(user.SubscriptionID, option.ID)
+	if err != nil {
+		log.Printf("Changing price of user %d: %v", user.ID, err)
+		http.Error(w, "Error changing plan", http.StatusInternalServerError)
+		return
+	}
+
+	// The customer.subscription.updated webhook records the same, this
+	// just shows the new plan without waiting for it
+	if changed.Interval == "" {
+		changed.Interval = option.Interval
+	}
+	if err := database.DB.Model(&user).Updates(map[string]interface{}{
+		"stripe_price_id":  changed.PriceID,
+		"billing_interval": changed.Interval,
+	}).Error; err != nil {
+		log.Printf("Could not record new price of user %d: %v", user.ID, err)
+	}
+	log.Printf("User %d switched to price %s", user.ID, option.ID)
+
+	http.Redirect(w, r, "/settings?switched=1#subscription", http.StatusSeeOther)
+}
@@ -0,0 +1,65 @@
+package add
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/plans"
+)
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	idStr := r.FormValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	// Verify ownership of the wine
+	userID := r.Context().Value("user_id").(uint)
+	var wine domain.Wine
+	if result := database.DB.Where("user_id = ?", userID).First(&wine, id); result.Error != nil {
+		http.Error(w, "Wine not found", http.StatusNotFound)
+		return
+	}
+	if plans.DenyArchived(w, r, wine) {
+		return
+	}
+
+	date := r.FormValue("date")
+	title := r.FormValue("title")
+
+	// Simple validation
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		http.Error(w, "A valid date is required", http.StatusBadRequest)
+		return
+	}
+	if title == "" {
+		title = "Tasting"
+	}
+
+	newEvent := domain.TastingEvent{
+		WineID: wine.ID,
+		Date:   date,
+		Title:  title,
+	}
+
+	database.DB.Create(&newEvent)
+
+	http.Redirect(w, r, fmt.Sprintf("/details/%d", wine.ID), http.StatusSeeOther)
+}
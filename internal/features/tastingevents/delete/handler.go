@@ -0,0 +1,60 @@
+package delete
+
+import (
+	"net/http"
+	"strconv"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/plans"
+)
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	idStr := r.FormValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(uint)
+
+	// Verify ownership through the wine
+	var event domain.TastingEvent
+	if result := database.DB.First(&event, id); result.Error != nil {
+		http.Error(w, "Tasting event not found", http.StatusNotFound)
+		return
+	}
+
+	var wine domain.Wine
+	if result := database.DB.First(&wine, event.WineID); result.Error != nil {
+		http.Error(w, "Wine not found", http.StatusNotFound)
+		return
+	}
+
+	if wine.UserID != userID {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if plans.DenyArchived(w, r, wine) {
+		return
+	}
+
+	if result := database.DB.Delete(&event); result.Error != nil {
+		http.Error(w, "Error deleting tasting event", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/details/"+strconv.Itoa(int(wine.ID)), http.StatusSeeOther)
+}
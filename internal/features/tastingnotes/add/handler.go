@@ -29,19 +29,6 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check subscription tier
-	userID := r.Context().Value("user_id").(uint)
-	var user domain.User
-	if result := database.DB.First(&user, userID); result.Error != nil {
-		http.Error(w, "User not found", http.StatusInternalServerError)
-		return
-	}
-
-	if user.SubscriptionTier != "pro" {
-		http.Error(w, "Tasting notes are only available for Connoisseur users", http.StatusForbidden)
-		return
-	}
-
 	note := r.FormValue("note")
 
 	// Simple validation
@@ -1,7 +1,6 @@
 package add
 
 import (
-	"encoding/base64"
 	"fmt"
 	"html/template"
 	"io"
@@ -10,7 +9,10 @@ import (
 	"strconv"
 
 	"wine-cellar/internal/domain"
+	"wine-cellar/internal/features/wines/history"
 	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/imaging"
+	"wine-cellar/internal/shared/plans"
 	"wine-cellar/internal/shared/storage"
 	"wine-cellar/internal/shared/ui"
 
@@ -27,8 +29,8 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var wineCount int64
-	database.DB.Model(&domain.Wine{}).Where("user_id = ?", userID).Count(&wineCount)
+	plan := plans.For(user)
+	wineCount := plans.WineCount(userID)
 
 	if r.Method == http.MethodGet {
 		tmpl, err := template.New("add.html").Funcs(ui.FuncMap).ParseFiles("internal/features/wines/add/add.html", "templates/header.html", "templates/footer.html", "templates/analytics.html")
@@ -42,6 +44,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			LoggedIn     bool
 			UserEmail    string
 			WineCount    int64
+			MaxWines     int
 			IsFreeTier   bool
 			LimitReached bool
 			CSRFField    template.HTML
@@ -51,8 +54,9 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			LoggedIn:     true,
 			UserEmail:    userEmail,
 			WineCount:    wineCount,
-			IsFreeTier:   user.SubscriptionTier == "free",
-			LimitReached: user.SubscriptionTier == "free" && wineCount >= 10,
+			MaxWines:     plan.MaxWines,
+			IsFreeTier:   !plan.Unlimited(),
+			LimitReached: !plan.CanAddWine(wineCount),
 			CSRFField:    csrf.TemplateField(r),
 		}
 		tmpl.Execute(w, data)
@@ -60,8 +64,8 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == http.MethodPost {
-		if user.SubscriptionTier == "free" && wineCount >= 10 {
-			http.Error(w, "Free tier limit reached. Please upgrade to add more wines.", http.StatusForbidden)
+		if !plan.CanAddWine(wineCount) {
+			plans.Deny(w, r, user, fmt.Sprintf("You have reached the limit of %d wines on the %s plan.", plan.MaxWines, plan.Name))
 			return
 		}
 
@@ -86,31 +90,38 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		imageURL := ""
-		
+		thumbnailURL := ""
+
 		// Handle image upload
 		file, _, err := r.FormFile("image")
 		if err == nil {
 			defer file.Close()
+			if !plan.Allows(plans.Photos) {
+				plans.DenyFeature(w, r, user, plans.Photos)
+				return
+			}
 			// Read file content
 			fileBytes, err := io.ReadAll(file)
 			if err == nil {
-				mimeType := http.DetectContentType(fileBytes)
-				
-				// Try to upload to R2 first
-				if storage.IsConfigured() {
-					url, err := storage.UploadImage(fileBytes, mimeType, userID)
-					if err != nil {
-						log.Printf("R2 upload failed, falling back to base64: %v", err)
-						// Fallback to base64
-						base64Str := base64.StdEncoding.EncodeToString(fileBytes)
-						imageURL = fmt.Sprintf("data:%s;base64,%s", mimeType, base64Str)
-					} else {
-						imageURL = url
-					}
-				} else {
-					// R2 not configured, use base64
-					base64Str := base64.StdEncoding.EncodeToString(fileBytes)
-					imageURL = fmt.Sprintf("data:%s;base64,%s", mimeType, base64Str)
+				processed, err := imaging.Process(fileBytes)
+				if err != nil {
+					log.Printf("Rejected image upload: %v", err)
+					http.Error(w, "Uploaded file is not a supported image", http.StatusBadRequest)
+					return
+				}
+
+				imageURL, err = storage.SaveImage(processed.Image, processed.ContentType, userID)
+				if err != nil {
+					log.Printf("Image upload failed: %v", err)
+					http.Error(w, "Could not store image", http.StatusInternalServerError)
+					return
+				}
+				thumbnailURL, err = storage.SaveImage(processed.Thumbnail, processed.ContentType, userID)
+				if err != nil {
+					log.Printf("Thumbnail upload failed: %v", err)
+					storage.DeleteImage(imageURL)
+					http.Error(w, "Could not store image", http.StatusInternalServerError)
+					return
 				}
 			}
 		}
@@ -134,11 +145,19 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			Quantity:       quantity,
 			Price:          price,
 			DrinkingWindow: r.FormValue("drinking_window"),
+			DeliveryDate:   r.FormValue("delivery_date"),
 			ImageURL:       imageURL,
+			ThumbnailURL:   thumbnailURL,
 			UserID:         userID,
 		}
 
-		database.DB.Create(&newWine)
+		if err := history.Create(database.DB, &newWine, userEmail); err != nil {
+			log.Printf("Failed to create wine: %v", err)
+			storage.DeleteImage(imageURL)
+			storage.DeleteImage(thumbnailURL)
+			http.Error(w, "Could not save wine", http.StatusInternalServerError)
+			return
+		}
 
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	}
@@ -0,0 +1,111 @@
+package archive
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"gorm.io/gorm"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/plans"
+	"wine-cellar/internal/shared/ui"
+)
+
+// Handler lets users over their plan's limit choose which wines stay active.
+// The others are archived: still listed and viewable, but read-only.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(uint)
+	userEmail := r.Context().Value("email").(string)
+
+	var user domain.User
+	if result := database.DB.First(&user, userID); result.Error != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+	plan := plans.For(user)
+
+	if r.Method == http.MethodPost {
+		if plan.Unlimited() {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+
+		var keep []uint
+		for _, idStr := range r.Form["keep"] {
+			id, err := strconv.Atoi(idStr)
+			if err != nil {
+				http.Error(w, "Invalid ID", http.StatusBadRequest)
+				return
+			}
+			keep = append(keep, uint(id))
+		}
+		if len(keep) > plan.MaxWines {
+			http.Error(w, fmt.Sprintf("The %s plan allows %d active wines", plan.Name, plan.MaxWines), http.StatusBadRequest)
+			return
+		}
+
+		if err := database.DB.Transaction(func(tx *gorm.DB) error {
+			archive := tx.Model(&domain.Wine{}).Where("user_id = ? AND archived_at IS NULL", userID)
+			if len(keep) > 0 {
+				archive = archive.Where("id NOT IN ?", keep)
+			}
+			if err := archive.UpdateColumn("archived_at", time.Now()).Error; err != nil {
+				return err
+			}
+			if len(keep) == 0 {
+				return nil
+			}
+			return tx.Model(&domain.Wine{}).Where("user_id = ? AND id IN ?", userID, keep).
+				UpdateColumn("archived_at", nil).Error
+		}); err != nil {
+			http.Error(w, "Could not update archive", http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, "/archive?saved=1", http.StatusSeeOther)
+		return
+	}
+
+	var wines []domain.Wine
+	if err := database.DB.Preload("Reviews").Preload("TastingNotes").Where("user_id = ?", userID).
+		Order("archived_at IS NOT NULL, name").Find(&wines).Error; err != nil {
+		http.Error(w, "Could not load wines", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.New("archive.html").Funcs(ui.FuncMap).ParseFiles("internal/features/wines/archive/archive.html", "templates/header.html", "templates/footer.html", "templates/analytics.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Wines     []domain.Wine
+		Plan      plans.Plan
+		Archived  int64
+		Saved     bool
+		LoggedIn  bool
+		UserEmail string
+		CSRFField template.HTML
+	}{
+		Wines:     wines,
+		Plan:      plan,
+		Archived:  plans.ArchivedCount(database.DB, userID),
+		Saved:     r.URL.Query().Get("saved") != "",
+		LoggedIn:  true,
+		UserEmail: userEmail,
+		CSRFField: csrf.TemplateField(r),
+	}
+
+	tmpl.Execute(w, data)
+}
@@ -1,15 +1,18 @@
 package delete
 
 import (
+	"log"
 	"net/http"
 	"strconv"
 
 	"wine-cellar/internal/domain"
+	"wine-cellar/internal/features/wines/history"
 	"wine-cellar/internal/shared/database"
 )
 
 func Handler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(uint)
+	userEmail := r.Context().Value("email").(string)
 
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -45,5 +48,9 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := history.RecordEvent(database.DB, uint(id), userEmail, history.EventDeleted); err != nil {
+		log.Printf("Failed to record deletion of wine %d: %v", id, err)
+	}
+
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
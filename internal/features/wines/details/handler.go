@@ -7,9 +7,12 @@ import (
 	"strings"
 
 	"github.com/gorilla/csrf"
+	"gorm.io/gorm"
 
 	"wine-cellar/internal/domain"
+	"wine-cellar/internal/features/wines/history"
 	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/plans"
 	"wine-cellar/internal/shared/ui"
 )
 
@@ -30,7 +33,9 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var wine domain.Wine
-	result := database.DB.Preload("Reviews").Preload("TastingNotes").Where("user_id = ?", userID).First(&wine, id)
+	result := database.DB.Preload("Reviews").Preload("TastingNotes").Preload("TastingEvents", func(db *gorm.DB) *gorm.DB {
+		return db.Order("date asc")
+	}).Where("user_id = ?", userID).First(&wine, id)
 	if result.Error != nil {
 		http.NotFound(w, r)
 		return
@@ -42,6 +47,12 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	revisions, err := history.Timeline(database.DB, wine.ID)
+	if err != nil {
+		http.Error(w, "Could not load history", http.StatusInternalServerError)
+		return
+	}
+
 	tmpl, err := template.New("details.html").Funcs(ui.FuncMap).ParseFiles("internal/features/wines/details/details.html", "templates/header.html", "templates/footer.html", "templates/analytics.html")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -51,12 +62,16 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		Wine      domain.Wine
 		User      domain.User
+		Plan      plans.Plan
+		History   []history.Revision
 		LoggedIn  bool
 		UserEmail string
 		CSRFField template.HTML
 	}{
 		Wine:      wine,
 		User:      user,
+		Plan:      plans.For(user),
+		History:   revisions,
 		LoggedIn:  true,
 		UserEmail: userEmail,
 		CSRFField: csrf.TemplateField(r),
@@ -1,7 +1,6 @@
 package edit
 
 import (
-	"encoding/base64"
 	"fmt"
 	"html/template"
 	"io"
@@ -11,7 +10,10 @@ import (
 	"strings"
 
 	"wine-cellar/internal/domain"
+	"wine-cellar/internal/features/wines/history"
 	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/imaging"
+	"wine-cellar/internal/shared/plans"
 	"wine-cellar/internal/shared/storage"
 	"wine-cellar/internal/shared/ui"
 
@@ -40,6 +42,9 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			http.NotFound(w, r)
 			return
 		}
+		if plans.DenyArchived(w, r, wine) {
+			return
+		}
 
 		var user domain.User
 		if result := database.DB.First(&user, userID); result.Error != nil {
@@ -89,6 +94,9 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			http.NotFound(w, r)
 			return
 		}
+		if plans.DenyArchived(w, r, wine) {
+			return
+		}
 
 		vintageStr := r.FormValue("vintage")
 		vintage, _ := strconv.Atoi(vintageStr)
@@ -108,6 +116,8 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			bottleSize = "75cl"
 		}
 
+		before := history.Take(wine)
+		oldImageURL, oldThumbnailURL := wine.ImageURL, wine.ThumbnailURL
 		wine.Name = r.FormValue("name")
 		wine.Producer = r.FormValue("producer")
 		wine.Vintage = vintage
@@ -121,41 +131,61 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		wine.Quantity = quantity
 		wine.Price = price
 		wine.DrinkingWindow = r.FormValue("drinking_window")
+		wine.DeliveryDate = r.FormValue("delivery_date")
 		
 		// Handle image upload
 		file, _, err := r.FormFile("image")
 		if err == nil {
 			defer file.Close()
+			var user domain.User
+			if result := database.DB.First(&user, userID); result.Error != nil {
+				http.Error(w, "User not found", http.StatusInternalServerError)
+				return
+			}
+			if !plans.For(user).Allows(plans.Photos) {
+				plans.DenyFeature(w, r, user, plans.Photos)
+				return
+			}
 			// Read file content
 			fileBytes, err := io.ReadAll(file)
 			if err == nil {
-				mimeType := http.DetectContentType(fileBytes)
-				
-				// Delete old image from R2 if it exists
-				if wine.ImageURL != "" && storage.IsConfigured() {
-					storage.DeleteImage(wine.ImageURL)
+				processed, err := imaging.Process(fileBytes)
+				if err != nil {
+					log.Printf("Rejected image upload: %v", err)
+					http.Error(w, "Uploaded file is not a supported image", http.StatusBadRequest)
+					return
+				}
+
+				imageKey, err := storage.SaveImage(processed.Image, processed.ContentType, userID)
+				if err != nil {
+					log.Printf("Image upload failed: %v", err)
+					http.Error(w, "Could not store image", http.StatusInternalServerError)
+					return
 				}
-				
-				// Try to upload to R2 first
-				if storage.IsConfigured() {
-					url, err := storage.UploadImage(fileBytes, mimeType, userID)
-					if err != nil {
-						log.Printf("R2 upload failed, falling back to base64: %v", err)
-						// Fallback to base64
-						base64Str := base64.StdEncoding.EncodeToString(fileBytes)
-						wine.ImageURL = fmt.Sprintf("data:%s;base64,%s", mimeType, base64Str)
-					} else {
-						wine.ImageURL = url
-					}
-				} else {
-					// R2 not configured, use base64
-					base64Str := base64.StdEncoding.EncodeToString(fileBytes)
-					wine.ImageURL = fmt.Sprintf("data:%s;base64,%s", mimeType, base64Str)
+				thumbnailKey, err := storage.SaveImage(processed.Thumbnail, processed.ContentType, userID)
+				if err != nil {
+					log.Printf("Thumbnail upload failed: %v", err)
+					storage.DeleteImage(imageKey)
+					http.Error(w, "Could not store image", http.StatusInternalServerError)
+					return
 				}
+
+				wine.ImageURL = imageKey
+				wine.ThumbnailURL = thumbnailKey
 			}
 		}
 
-		database.DB.Save(&wine)
+		if err := history.Save(database.DB, &wine, before, userEmail); err != nil {
+			log.Printf("Failed to save wine %d: %v", id, err)
+			http.Error(w, "Could not save wine", http.StatusInternalServerError)
+			return
+		}
+
+		// Delete old images only once the new ones are saved
+		if wine.ImageURL != oldImageURL {
+			storage.DeleteImage(oldImageURL)
+			storage.DeleteImage(oldThumbnailURL)
+		}
 
 		http.Redirect(w, r, fmt.Sprintf("/details/%d", id), http.StatusSeeOther)
 	}
@@ -168,6 +198,7 @@ func DeletePhotoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userID := r.Context().Value("user_id").(uint)
+	userEmail := r.Context().Value("email").(string)
 	idStr := r.FormValue("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
@@ -180,15 +211,24 @@ func DeletePhotoHandler(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-
-	// Delete image from R2 if it exists
-	if wine.ImageURL != "" && storage.IsConfigured() {
-		storage.DeleteImage(wine.ImageURL)
+	if plans.DenyArchived(w, r, wine) {
+		return
 	}
 
-	// Clear image URL in database
+	// Clear image URLs in database
+	before := history.Take(wine)
+	imageURL, thumbnailURL := wine.ImageURL, wine.ThumbnailURL
 	wine.ImageURL = ""
-	database.DB.Save(&wine)
+	wine.ThumbnailURL = ""
+	if err := history.Save(database.DB, &wine, before, userEmail); err != nil {
+		log.Printf("Failed to save wine %d: %v", id, err)
+		http.Error(w, "Could not delete photo", http.StatusInternalServerError)
+		return
+	}
+
+	// Delete images from storage if they exist
+	storage.DeleteImage(imageURL)
+	storage.DeleteImage(thumbnailURL)
 
 	http.Redirect(w, r, fmt.Sprintf("/edit/%d", id), http.StatusSeeOther)
 }
@@ -0,0 +1,51 @@
+package history
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/plans"
+)
+
+// RevertHandler restores a wine to a previous revision
+func RevertHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(uint)
+	userEmail := r.Context().Value("email").(string)
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	revision, err := strconv.Atoi(r.FormValue("revision"))
+	if err != nil || revision < 1 {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return
+	}
+
+	var wine domain.Wine
+	if result := database.DB.Where("user_id = ?", userID).First(&wine, id); result.Error != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if plans.DenyArchived(w, r, wine) {
+		return
+	}
+
+	if err := Revert(database.DB, &wine, revision, userEmail); err != nil {
+		log.Printf("Revert of wine %d to revision %d failed: %v", id, revision, err)
+		http.Error(w, "Could not revert wine", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/details/%d#history", id), http.StatusSeeOther)
+}
@@ -0,0 +1,216 @@
+package history
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"wine-cellar/internal/domain"
+)
+
+// Lifecycle events are stored as changes with one of these pseudo fields
+const (
+	EventCreated  = "created"
+	EventDeleted  = "deleted"
+	EventRestored = "restored"
+	EventReverted = "reverted"
+)
+
+// trackedFields are the domain.Wine fields recorded in the change log, in
+// display order, with their labels
+var trackedFields = []struct{ Name, Label string }{
+	{"Name", "Name"},
+	{"Producer", "Producer"},
+	{"Vintage", "Vintage"},
+	{"IsNonVintage", "Non Vintage"},
+	{"Grape", "Grape"},
+	{"Country", "Country"},
+	{"Region", "Region"},
+	{"Category", "Category"},
+	{"SubCategory", "Sub Category"},
+	{"Type", "Type"},
+	{"BottleSize", "Bottle Size"},
+	{"Quantity", "Quantity"},
+	{"Price", "Price"},
+	{"ABV", "ABV"},
+	{"Location", "Location"},
+	{"Rating", "Rating"},
+	{"DrinkingWindow", "Drinking Window"},
+	{"DeliveryDate", "Delivery Date"},
+	{"Notes", "Notes"},
+	{"ImageURL", "Photo"},
+	{"ThumbnailURL", "Thumbnail"},
+}
+
+// revisionAttempts bounds the retries when concurrent edits of a wine pick
+// the same revision number
+const revisionAttempts = 5
+
+var errRevisionTaken = errors.New("revision number already taken")
+
+// Photos are not reverted: replaced images are deleted from storage, so an
+// old key would point at nothing
+var notRevertible = map[string]bool{"ImageURL": true, "ThumbnailURL": true}
+
+// Snapshot captures the tracked fields of a wine
+type Snapshot map[string]string
+
+func Take(wine domain.Wine) Snapshot {
+	v := reflect.ValueOf(wine)
+	s := make(Snapshot, len(trackedFields))
+	for _, f := range trackedFields {
+		s[f.Name] = format(v.FieldByName(f.Name))
+	}
+	return s
+}
+
+// Create inserts a new wine and records it as revision 1
+func Create(db *gorm.DB, wine *domain.Wine, actor string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(wine).Error; err != nil {
+			return err
+		}
+		return record(tx, wine.ID, actor, Take(domain.Wine{}), Take(*wine), EventCreated, "")
+	})
+}
+
+// Save updates a wine and records every tracked field that differs from
+// before as one new revision
+func Save(db *gorm.DB, wine *domain.Wine, before Snapshot, actor string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(wine).Error; err != nil {
+			return err
+		}
+		return record(tx, wine.ID, actor, before, Take(*wine), "", "")
+	})
+}
+
+// RecordEvent logs a lifecycle event such as EventDeleted
+func RecordEvent(db *gorm.DB, wineID uint, actor, event string) error {
+	return record(db, wineID, actor, nil, nil, event, "")
+}
+
+// Revert restores the tracked fields of a wine to how they were right after
+// the given revision, recording the result as a new revision
+func Revert(db *gorm.DB, wine *domain.Wine, revision int, actor string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var later []domain.WineChange
+		if err := tx.Where("wine_id = ? AND revision > ?", wine.ID, revision).
+			Order("revision desc, id desc").Find(&later).Error; err != nil {
+			return err
+		}
+		if len(later) == 0 {
+			return errors.New("nothing to revert")
+		}
+
+		before := Take(*wine)
+		v := reflect.ValueOf(wine).Elem()
+		for _, c := range later {
+			if _, tracked := before[c.Field]; !tracked || notRevertible[c.Field] {
+				continue
+			}
+			if err := parse(v.FieldByName(c.Field), c.OldValue); err != nil {
+				return fmt.Errorf("revision %d, %s: %w", c.Revision, c.Field, err)
+			}
+		}
+
+		if err := tx.Save(wine).Error; err != nil {
+			return err
+		}
+		return record(tx, wine.ID, actor, before, Take(*wine), EventReverted, strconv.Itoa(revision))
+	})
+}
+
+// record writes one revision: an optional event row followed by a row per
+// changed field. Nothing is written if there is neither.
+func record(db *gorm.DB, wineID uint, actor string, before, after Snapshot, event, detail string) error {
+	var changes []domain.WineChange
+	if event != "" {
+		changes = append(changes, domain.WineChange{Field: event, NewValue: detail})
+	}
+	for _, f := range trackedFields {
+		if before[f.Name] != after[f.Name] {
+			changes = append(changes, domain.WineChange{Field: f.Name, OldValue: before[f.Name], NewValue: after[f.Name]})
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	for attempt := 1; ; attempt++ {
+		// A savepoint when called inside a transaction, so a lost race can
+		// be retried with the next number
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var last int
+			if err := tx.Model(&domain.WineChange{}).Where("wine_id = ?", wineID).
+				Select("COALESCE(MAX(revision), 0)").Scan(&last).Error; err != nil {
+				return err
+			}
+
+			for i := range changes {
+				changes[i].ID = 0
+				changes[i].WineID = wineID
+				changes[i].Revision = last + 1
+				changes[i].Position = i
+				changes[i].Actor = actor
+				changes[i].CreatedAt = now
+			}
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&changes)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected != int64(len(changes)) {
+				return errRevisionTaken
+			}
+			return nil
+		})
+		if !errors.Is(err, errRevisionTaken) || attempt == revisionAttempts {
+			return err
+		}
+	}
+}
+
+func format(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	default:
+		return v.String()
+	}
+}
+
+func parse(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		v.SetString(s)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package history
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+
+	"wine-cellar/internal/domain"
+)
+
+// Revision is a group of changes made together, as shown on the timeline
+type Revision struct {
+	Number     int
+	Actor      string
+	At         time.Time
+	Event      string // One of the Event constants, empty for plain edits
+	Detail     string // For EventReverted, the revision that was restored
+	Changes    []Change
+	Revertible bool // False for the current revision
+}
+
+// Change is a single field change formatted for display
+type Change struct {
+	Label    string
+	OldValue string
+	NewValue string
+}
+
+// Timeline returns the history of a wine, newest revision first
+func Timeline(db *gorm.DB, wineID uint) ([]Revision, error) {
+	var changes []domain.WineChange
+	if err := db.Where("wine_id = ?", wineID).Order("revision desc, id asc").Find(&changes).Error; err != nil {
+		return nil, err
+	}
+
+	labels := make(map[string]string, len(trackedFields))
+	for _, f := range trackedFields {
+		labels[f.Name] = f.Label
+	}
+
+	var revisions []Revision
+	for _, c := range changes {
+		if len(revisions) == 0 || revisions[len(revisions)-1].Number != c.Revision {
+			revisions = append(revisions, Revision{
+				Number:     c.Revision,
+				Actor:      c.Actor,
+				At:         c.CreatedAt,
+				Revertible: len(revisions) > 0,
+			})
+		}
+		rev := &revisions[len(revisions)-1]
+
+		label, tracked := labels[c.Field]
+		switch {
+		case !tracked:
+			rev.Event = c.Field
+			rev.Detail = c.NewValue
+		case c.Field == "ThumbnailURL":
+			// Always changes together with the photo
+		case c.Field == "ImageURL":
+			rev.Changes = append(rev.Changes, Change{Label: label, OldValue: photoState(c.OldValue), NewValue: photoState(c.NewValue)})
+		default:
+			rev.Changes = append(rev.Changes, Change{Label: label, OldValue: c.OldValue, NewValue: c.NewValue})
+		}
+	}
+	return revisions, nil
+}
+
+func photoState(ref string) string {
+	if ref == "" {
+		return "none"
+	}
+	return "uploaded"
+}
@@ -10,13 +10,15 @@ import (
 	"gorm.io/gorm"
 
 	"wine-cellar/internal/domain"
+	"wine-cellar/internal/features/subscription"
 	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/plans"
 	"wine-cellar/internal/shared/ui"
 )
 
 func Handler(w http.ResponseWriter, r *http.Request) {
 	// Note: We are using paths relative to the project root
-	tmpl, err := template.New("list.html").Funcs(ui.FuncMap).ParseFiles("internal/features/wines/list/list.html", "templates/header.html", "templates/footer.html", "templates/analytics.html")
+	tmpl, err := template.New("list.html").Funcs(ui.FuncMap).ParseFiles("internal/features/wines/list/list.html", "templates/header.html", "templates/footer.html", "templates/analytics.html", "templates/payment_banner.html")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -25,13 +27,13 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(uint)
 	userEmail := r.Context().Value("email").(string)
 
-	// Fetch user to check subscription tier
+	// Fetch user to check whether their plan includes search
 	var user domain.User
 	if err := database.DB.First(&user, userID).Error; err != nil {
 		http.Error(w, "User not found", http.StatusInternalServerError)
 		return
 	}
-	isPro := user.SubscriptionTier == "pro"
+	canSearch := plans.For(user).Allows(plans.Search)
 
 	// Search logic
 	searchQuery := r.FormValue("q")
@@ -44,7 +46,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	// Build base query
 	query := database.DB.Model(&domain.Wine{}).Where("user_id = ?", userID)
 
-	if isPro {
+	if canSearch {
 		if searchQuery != "" {
 			lowerSearchQuery := strings.ToLower(searchQuery)
 			likeQuery := "%" + lowerSearchQuery + "%"
@@ -206,7 +208,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	}
 	baseQueryString := v.Encode()
 
-	// Fetch filter options if Pro
+	// Fetch filter options if the plan includes search
 	var categories []string
 	var countries []string
 	var regions []string
@@ -214,7 +216,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	var vintages []int
 	var hasNV int64
 
-	if isPro {
+	if canSearch {
 		database.DB.Model(&domain.Wine{}).Where("user_id = ?", userID).Distinct("category").Pluck("category", &categories)
 		database.DB.Model(&domain.Wine{}).Where("user_id = ?", userID).Distinct("country").Pluck("country", &countries)
 		database.DB.Model(&domain.Wine{}).Where("user_id = ?", userID).Distinct("region").Pluck("region", &regions)
@@ -234,7 +236,10 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		Pages            []int
 		LoggedIn         bool
 		UserEmail        string
-		IsPro            bool
+		CanSearch        bool
+		PaymentNotice    *subscription.PaymentNotice
+		Archived         int64
+		Plan             plans.Plan
 		SearchQuery      string
 		FilterCategory   string
 		FilterCountry    string
@@ -262,7 +267,10 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		Pages:            pages,
 		LoggedIn:         true,
 		UserEmail:        userEmail,
-		IsPro:            isPro,
+		CanSearch:        canSearch,
+		PaymentNotice:    subscription.PaymentProblem(user),
+		Archived:         plans.ArchivedCount(database.DB, userID),
+		Plan:             plans.For(user),
 		SearchQuery:      searchQuery,
 		FilterCategory:   filterCategory,
 		FilterCountry:    filterCountry,
@@ -0,0 +1,170 @@
+package trash
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"gorm.io/gorm"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/features/wines/history"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/plans"
+	"wine-cellar/internal/shared/ui"
+)
+
+// Item is a wine in the trash together with the time it will be purged
+type Item struct {
+	Wine    domain.Wine
+	PurgeAt *time.Time
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(uint)
+	userEmail := r.Context().Value("email").(string)
+
+	var wines []domain.Wine
+	if err := database.DB.Unscoped().Preload("Reviews").Preload("TastingNotes").
+		Where("user_id = ? AND deleted_at IS NOT NULL", userID).
+		Order("deleted_at desc").Find(&wines).Error; err != nil {
+		http.Error(w, "Could not load trash", http.StatusInternalServerError)
+		return
+	}
+
+	retention := RetentionPeriod()
+	items := make([]Item, len(wines))
+	for i, wine := range wines {
+		items[i].Wine = wine
+		if retention > 0 {
+			purgeAt := wine.DeletedAt.Time.Add(retention)
+			items[i].PurgeAt = &purgeAt
+		}
+	}
+
+	tmpl, err := template.New("trash.html").Funcs(ui.FuncMap).ParseFiles("internal/features/wines/trash/trash.html", "templates/header.html", "templates/footer.html", "templates/analytics.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Items         []Item
+		RetentionDays int
+		LoggedIn      bool
+		UserEmail     string
+		CSRFField     template.HTML
+	}{
+		Items:         items,
+		RetentionDays: int(retention.Hours() / 24),
+		LoggedIn:      true,
+		UserEmail:     userEmail,
+		CSRFField:     csrf.TemplateField(r),
+	}
+
+	tmpl.Execute(w, data)
+}
+
+// errLimitReached rolls back a restore that would put the user over their
+// plan's limit
+var errLimitReached = errors.New("wine limit reached")
+
+func RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(uint)
+	userEmail := r.Context().Value("email").(string)
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var user domain.User
+	if result := database.DB.First(&user, userID); result.Error != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	// Restored wines count toward the plan's limit again, so it comes back
+	// unarchived. The limit is checked with the wine restored and in the same
+	// transaction, so concurrent restores or adds can't both get the last
+	// slot.
+	plan := plans.For(user)
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().Model(&domain.Wine{}).
+			Where("id = ? AND user_id = ? AND deleted_at IS NOT NULL", id, userID).
+			Updates(map[string]interface{}{"deleted_at": nil, "archived_at": nil})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		if !plan.CanAddWine(plans.CountWines(tx, userID) - 1) {
+			return errLimitReached
+		}
+		return nil
+	})
+	if errors.Is(err, errLimitReached) {
+		plans.Deny(w, r, user, fmt.Sprintf("You have reached the limit of %d wines on the %s plan. Upgrade to restore more wines.", plan.MaxWines, plan.Name))
+		return
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Wine not found or unauthorized", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not restore wine", http.StatusInternalServerError)
+		return
+	}
+
+	if err := history.RecordEvent(database.DB, uint(id), userEmail, history.EventRestored); err != nil {
+		log.Printf("Failed to record restore of wine %d: %v", id, err)
+	}
+
+	http.Redirect(w, r, "/details/"+strconv.Itoa(id), http.StatusSeeOther)
+}
+
+// PurgeHandler permanently deletes one wine from the trash, or all of them
+// when no ID is given
+func PurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(uint)
+
+	var ids []uint
+	if idStr := r.FormValue("id"); idStr != "" {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, uint(id))
+	} else if err := database.DB.Unscoped().Model(&domain.Wine{}).
+		Where("user_id = ? AND deleted_at IS NOT NULL", userID).Pluck("id", &ids).Error; err != nil {
+		http.Error(w, "Could not load trash", http.StatusInternalServerError)
+		return
+	}
+
+	if len(ids) > 0 {
+		if _, err := Purge(database.DB, userID, ids); err != nil {
+			http.Error(w, "Could not purge wines", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
@@ -0,0 +1,109 @@
+package trash
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/jobs"
+	"wine-cellar/internal/shared/storage"
+)
+
+// WineOwned lists the models that hang off a wine via wine_id. They are
+// removed together with the wine when it is purged.
+var WineOwned = []interface{}{&domain.Review{}, &domain.TastingNote{}, &domain.TastingEvent{}, &domain.WineChange{}}
+
+// RetentionPeriod is how long deleted wines stay in the trash.
+// TRASH_RETENTION_DAYS=0 keeps them until they are purged by hand.
+func RetentionPeriod() time.Duration {
+	days := 30
+	if v := os.Getenv("TRASH_RETENTION_DAYS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			days = n
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Purge permanently deletes the given trashed wines of a user together with
+// their reviews, notes, events and images. Wines that are not in the trash
+// are left alone. It returns the number of wines purged.
+func Purge(db *gorm.DB, userID uint, ids []uint) (int64, error) {
+	var wines []domain.Wine
+	if err := db.Unscoped().Where("user_id = ? AND id IN ? AND deleted_at IS NOT NULL", userID, ids).
+		Select("id", "image_url", "thumbnail_url").Find(&wines).Error; err != nil {
+		return 0, err
+	}
+	if len(wines) == 0 {
+		return 0, nil
+	}
+
+	wineIDs := make([]uint, len(wines))
+	for i, wine := range wines {
+		wineIDs[i] = wine.ID
+	}
+
+	var purged int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range WineOwned {
+			if err := tx.Unscoped().Where("wine_id IN ?", wineIDs).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		result := tx.Unscoped().Where("id IN ?", wineIDs).Delete(&domain.Wine{})
+		purged = result.RowsAffected
+		return result.Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Anything that fails here is picked up by storage garbage collection
+	for _, wine := range wines {
+		for _, ref := range []string{wine.ImageURL, wine.ThumbnailURL} {
+			if err := storage.DeleteImage(ref); err != nil {
+				log.Printf("Purge of wine %d: failed to delete %s: %v", wine.ID, ref, err)
+			}
+		}
+	}
+
+	return purged, nil
+}
+
+// ScheduleAutoPurge empties wines that have been in the trash for longer
+// than RetentionPeriod. It runs every TRASH_PURGE_INTERVAL (default 1h).
+func ScheduleAutoPurge() {
+	retention := RetentionPeriod()
+	if retention == 0 {
+		log.Printf("Job trash-purge disabled")
+		return
+	}
+
+	jobs.Every("trash-purge", jobs.Duration("TRASH_PURGE_INTERVAL", time.Hour), func(ctx context.Context) error {
+		var expired []domain.Wine
+		if err := database.DB.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at <= ?", time.Now().Add(-retention)).
+			Select("id", "user_id").Find(&expired).Error; err != nil {
+			return err
+		}
+
+		byUser := make(map[uint][]uint)
+		for _, wine := range expired {
+			byUser[wine.UserID] = append(byUser[wine.UserID], wine.ID)
+		}
+		for userID, ids := range byUser {
+			if _, err := Purge(database.DB, userID, ids); err != nil {
+				log.Printf("Purge of trash for user %d failed, will retry: %v", userID, err)
+			}
+		}
+		if len(expired) > 0 {
+			log.Printf("Purged %d expired wines from the trash", len(expired))
+		}
+		return nil
+	})
+}
@@ -2,15 +2,19 @@ package update
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 
 	"wine-cellar/internal/domain"
+	"wine-cellar/internal/features/wines/history"
 	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/plans"
 )
 
 func QuantityHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(uint)
+	userEmail := r.Context().Value("email").(string)
 
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -38,7 +42,11 @@ func QuantityHandler(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	if plans.DenyArchived(w, r, wine) {
+		return
+	}
 
+	before := history.Take(wine)
 	if action == "increment" {
 		wine.Quantity++
 	} else if action == "decrement" {
@@ -47,7 +55,11 @@ func QuantityHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	database.DB.Save(&wine)
+	if err := history.Save(database.DB, &wine, before, userEmail); err != nil {
+		log.Printf("Failed to update quantity of wine %d: %v", id, err)
+		http.Error(w, "Could not update quantity", http.StatusInternalServerError)
+		return
+	}
 
 	http.Redirect(w, r, fmt.Sprintf("/details/%d", id), http.StatusSeeOther)
 }
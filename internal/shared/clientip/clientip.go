@@ -0,0 +1,80 @@
+package clientip
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	once    sync.Once
+	trusted []*net.IPNet
+)
+
+// From returns the IP address of the client that sent r. X-Forwarded-For is
+// only believed when the request comes from a proxy listed in
+// TRUSTED_PROXIES (comma-separated IPs or CIDRs), otherwise any client could
+// pick its own address.
+func From(r *http.Request) string {
+	once.Do(loadTrusted)
+
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	if !isTrusted(remote) {
+		return remote
+	}
+
+	// Walk the chain from the nearest hop, skipping our own proxies
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !isTrusted(hop) {
+			return hop
+		}
+		remote = hop
+	}
+	return remote
+}
+
+func isTrusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadTrusted() {
+	for _, v := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			log.Printf("Ignoring invalid TRUSTED_PROXIES entry %q", v)
+			continue
+		}
+		trusted = append(trusted, n)
+	}
+}
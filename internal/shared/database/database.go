@@ -12,6 +12,9 @@ import (
 
 var DB *gorm.DB
 
+// Models are the tables InitDB migrates
+var Models = []interface{}{&domain.User{}, &domain.Wine{}, &domain.Review{}, &domain.TastingNote{}, &domain.TastingEvent{}, &domain.WineChange{}, &domain.PasswordResetToken{}, &domain.RecoveryCode{}, &domain.Passkey{}, &domain.ExternalIdentity{}, &domain.RateLimitEntry{}, &domain.Session{}, &domain.TierGrant{}, &domain.Redemption{}, &domain.AdminAuditLog{}, &domain.StripeEvent{}, &domain.Invoice{}, &domain.AccountErasure{}}
+
 func InitDB() {
 	var err error
 	dsn := os.Getenv("DATABASE_URL")
@@ -29,8 +32,25 @@ func InitDB() {
 		}
 	}
 
+	// Accounts created before email verification existed count as verified
+	grandfatherVerified := DB.Migrator().HasTable(&domain.User{}) && !DB.Migrator().HasColumn(&domain.User{}, "EmailVerified")
+
+	// Changes logged before positions existed are numbered by their ID, so
+	// the unique index on (wine_id, revision, position) can be created
+	if DB.Migrator().HasTable(&domain.WineChange{}) && !DB.Migrator().HasColumn(&domain.WineChange{}, "Position") {
+		if err := DB.Migrator().AddColumn(&domain.WineChange{}, "Position"); err != nil {
+			log.Fatal("Failed to add wine_changes.position: ", err)
+		}
+		DB.Exec("UPDATE wine_changes SET position = id")
+	}
+
 	// Auto Migrate the schema
-	DB.AutoMigrate(&domain.User{}, &domain.Wine{}, &domain.Review{}, &domain.TastingNote{})
+	DB.AutoMigrate(Models...)
+
+	if grandfatherVerified {
+		result := DB.Model(&domain.User{}).Where("1 = 1").Update("email_verified", true)
+		log.Printf("Marked %d existing users as verified", result.RowsAffected)
+	}
 }
 
 func Seed(db *gorm.DB) {
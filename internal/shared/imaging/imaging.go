@@ -0,0 +1,118 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+
+	// Register decoders for the formats we accept
+	_ "image/gif"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// MaxDimension is the longest edge of a stored label photo
+	MaxDimension = 1600
+	// ThumbnailDimension is the longest edge of the list view thumbnail
+	ThumbnailDimension = 320
+	// maxPixels guards against decompression bombs
+	maxPixels = 50_000_000
+
+	jpegQuality = 85
+)
+
+// ErrUnsupported is returned when the upload is not a decodable image
+var ErrUnsupported = errors.New("unsupported image format")
+
+// Result holds the re-encoded image and its thumbnail
+type Result struct {
+	Image       []byte
+	Thumbnail   []byte
+	ContentType string
+}
+
+// Process decodes an uploaded image, applies its EXIF orientation, scales it
+// down to MaxDimension and re-encodes it as JPEG. Re-encoding drops all
+// metadata, so EXIF (including GPS coordinates) never reaches storage.
+func Process(data []byte) (*Result, error) {
+	switch http.DetectContentType(data) {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+	default:
+		return nil, ErrUnsupported
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxPixels {
+		return nil, fmt.Errorf("image dimensions %dx%d not allowed", cfg.Width, cfg.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+
+	// Scaling first keeps the per-pixel rotation cheap; fit only looks at
+	// the longest edge so the order does not change the output size.
+	orientation := readOrientation(data)
+
+	full, err := encode(applyOrientation(fit(src, MaxDimension), orientation))
+	if err != nil {
+		return nil, err
+	}
+	thumb, err := encode(applyOrientation(fit(src, ThumbnailDimension), orientation))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Image:       full,
+		Thumbnail:   thumb,
+		ContentType: "image/jpeg",
+	}, nil
+}
+
+// fit scales img so that neither side exceeds max, preserving aspect ratio.
+// The result is always drawn onto an opaque white canvas so transparent
+// PNGs do not turn black when encoded as JPEG.
+func fit(img image.Image, max int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > max || h > max {
+		if w >= h {
+			h = h * max / w
+			w = max
+		} else {
+			w = w * max / h
+			h = max
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+func encode(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,50 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+// Every runs fn in the background once per interval until the process
+// exits. The first run happens after one interval so that startup is not
+// slowed down. Errors are logged; the job keeps its schedule.
+func Every(name string, interval time.Duration, fn func(ctx context.Context) error) {
+	if interval <= 0 {
+		log.Printf("Job %s disabled", name)
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			start := time.Now()
+			if err := fn(context.Background()); err != nil {
+				log.Printf("Job %s failed: %v", name, err)
+				continue
+			}
+			log.Printf("Job %s finished in %s", name, time.Since(start).Round(time.Millisecond))
+		}
+	}()
+	log.Printf("Job %s scheduled every %s", name, interval)
+}
+
+// Duration reads a duration such as "24h" from the environment. "0" or "off"
+// yield zero, which disables a job.
+func Duration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	if v == "off" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %s", key, v, fallback)
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,131 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers email
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+var Default Mailer = LogMailer{}
+
+// Init configures SMTP delivery from SMTP_HOST, SMTP_PORT, SMTP_USERNAME,
+// SMTP_PASSWORD and MAIL_FROM. Without SMTP_HOST, emails are only logged.
+// A local sink such as MailHog (SMTP_HOST=localhost SMTP_PORT=1025) works
+// without credentials.
+func Init() {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		log.Println("SMTP not configured - emails will be written to the log")
+		return
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Winetrackr <no-reply@" + host + ">"
+	}
+
+	Default = &SMTPMailer{
+		Addr:     net.JoinHostPort(host, port),
+		Host:     host,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     from,
+	}
+	log.Printf("SMTP mailer initialized (%s)", net.JoinHostPort(host, port))
+}
+
+// Send delivers msg through the default mailer
+func Send(ctx context.Context, msg Message) error {
+	return Default.Send(ctx, msg)
+}
+
+// SMTPMailer sends mail through an SMTP server, using STARTTLS when offered
+type SMTPMailer struct {
+	Addr     string
+	Host     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	if err := smtp.SendMail(m.Addr, auth, envelopeAddress(m.From), []string{headerValue(msg.To)}, m.format(msg)); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
+
+func (m *SMTPMailer) format(msg Message) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + headerValue(m.From) + "\r\n")
+	b.WriteString("To: " + headerValue(msg.To) + "\r\n")
+	b.WriteString("Subject: " + headerValue(msg.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// headerValue strips line breaks so user input cannot inject headers
+func headerValue(v string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(v)
+}
+
+// AppURL returns an absolute link into the app for use in emails
+func AppURL(path string) string {
+	base := os.Getenv("DOMAIN")
+	if base == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = "8080"
+		}
+		base = "http://localhost:" + port
+	} else if !strings.HasPrefix(base, "http") {
+		base = "https://" + base
+	}
+	return strings.TrimRight(base, "/") + path
+}
+
+// envelopeAddress extracts "a@b" from "Name <a@b>"
+func envelopeAddress(from string) string {
+	if i := strings.LastIndex(from, "<"); i >= 0 {
+		return strings.TrimSuffix(from[i+1:], ">")
+	}
+	return from
+}
+
+// LogMailer writes emails to the log instead of sending them
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, msg Message) error {
+	log.Printf("Email to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
@@ -0,0 +1,55 @@
+package plans
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+
+	"wine-cellar/internal/domain"
+)
+
+// ApplyLimit fits the user's wines to the tier's limit after the tier
+// changed. Wines over the limit are archived, keeping the most recently
+// changed ones active; the user can pick others on the archive page. When
+// there is room again, e.g. after upgrading, archived wines are reactivated.
+// Nothing is deleted, and reviews and tasting notes stay with their wines.
+func ApplyLimit(db *gorm.DB, userID uint, tier string) error {
+	plan := ForTier(tier)
+	if plan.Unlimited() {
+		return db.Model(&domain.Wine{}).
+			Where("user_id = ? AND archived_at IS NOT NULL", userID).
+			UpdateColumn("archived_at", nil).Error
+	}
+
+	var active []uint
+	if err := db.Model(&domain.Wine{}).Where("user_id = ? AND archived_at IS NULL", userID).
+		Order("updated_at DESC").Pluck("id", &active).Error; err != nil {
+		return err
+	}
+
+	if len(active) > plan.MaxWines {
+		return db.Model(&domain.Wine{}).Where("id IN ?", active[plan.MaxWines:]).
+			UpdateColumn("archived_at", time.Now()).Error
+	}
+
+	room := plan.MaxWines - len(active)
+	if room == 0 {
+		return nil
+	}
+	var archived []uint
+	if err := db.Model(&domain.Wine{}).Where("user_id = ? AND archived_at IS NOT NULL", userID).
+		Order("updated_at DESC").Limit(room).Pluck("id", &archived).Error; err != nil {
+		return err
+	}
+	if len(archived) == 0 {
+		return nil
+	}
+	return db.Model(&domain.Wine{}).Where("id IN ?", archived).UpdateColumn("archived_at", nil).Error
+}
+
+// ArchivedCount counts the user's archived wines
+func ArchivedCount(db *gorm.DB, userID uint) int64 {
+	var count int64
+	db.Model(&domain.Wine{}).Where("user_id = ? AND archived_at IS NOT NULL", userID).Count(&count)
+	return count
+}
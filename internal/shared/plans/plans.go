@@ -0,0 +1,120 @@
+// Package plans defines what each subscription tier includes. Handlers ask
+// the user's plan instead of comparing tier names, so limits live in one
+// place.
+package plans
+
+import (
+	"gorm.io/gorm"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+)
+
+// Feature is something a plan may or may not include
+type Feature string
+
+const (
+	Photos       Feature = "photos"
+	Reviews      Feature = "reviews"
+	TastingNotes Feature = "tasting_notes"
+	Search       Feature = "search" // Search and filters on the wine list
+	ShareLinks   Feature = "share_links"
+)
+
+// features is the display order for the upgrade page. ShareLinks is left
+// out until sharing exists, so it isn't sold before it can be used.
+var features = []Feature{Photos, Reviews, TastingNotes, Search}
+
+var featureNames = map[Feature]string{
+	Photos:       "Bottle photos",
+	Reviews:      "Reviews",
+	TastingNotes: "Tasting notes",
+	Search:       "Search and filters",
+	ShareLinks:   "Share links",
+}
+
+// Name is how the feature is described to users
+func (f Feature) Name() string {
+	return featureNames[f]
+}
+
+// Plan is a subscription tier and its limits
+type Plan struct {
+	Tier     string
+	Name     string
+	MaxWines int // 0 for no limit; wines in the trash or archived don't count
+	features map[Feature]bool
+}
+
+var (
+	Free = Plan{
+		Tier:     "free",
+		Name:     "Free",
+		MaxWines: 10,
+		features: map[Feature]bool{Photos: true},
+	}
+	Pro = Plan{
+		Tier: "pro",
+		Name: "Connoisseur",
+		features: map[Feature]bool{
+			Photos:       true,
+			Reviews:      true,
+			TastingNotes: true,
+			Search:       true,
+			ShareLinks:   true,
+		},
+	}
+)
+
+// ForTier returns the plan for a subscription tier. Unknown tiers get the
+// free plan.
+func ForTier(tier string) Plan {
+	if tier == Pro.Tier {
+		return Pro
+	}
+	return Free
+}
+
+// For returns the user's plan
+func For(user domain.User) Plan {
+	return ForTier(user.SubscriptionTier)
+}
+
+// Allows reports whether the plan includes the feature
+func (p Plan) Allows(f Feature) bool {
+	return p.features[f]
+}
+
+// Features lists what the plan includes
+func (p Plan) Features() []Feature {
+	var included []Feature
+	for _, f := range features {
+		if p.features[f] {
+			included = append(included, f)
+		}
+	}
+	return included
+}
+
+// Unlimited reports whether the plan has no wine limit
+func (p Plan) Unlimited() bool {
+	return p.MaxWines == 0
+}
+
+// CanAddWine reports whether a user with wineCount wines may add another
+func (p Plan) CanAddWine(wineCount int64) bool {
+	return p.Unlimited() || wineCount < int64(p.MaxWines)
+}
+
+// WineCount counts the user's wines toward the plan limit. Archived wines
+// don't count, they are already over it.
+func WineCount(userID uint) int64 {
+	return CountWines(database.DB, userID)
+}
+
+// CountWines is WineCount on db, e.g. inside a transaction
+func CountWines(db *gorm.DB, userID uint) int64 {
+	var count int64
+	db.Model(&domain.Wine{}).Where("user_id = ? AND archived_at IS NULL", userID).Count(&count)
+	return count
+}
@@ -0,0 +1,92 @@
+package plans
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+
+	"wine-cellar/internal/domain"
+	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/ui"
+
+	"github.com/gorilla/csrf"
+)
+
+// Require only lets users whose plan includes the feature through. It must be
+// wrapped by auth.Middleware.
+func Require(feature Feature, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uint)
+		var user domain.User
+		if err := database.DB.First(&user, userID).Error; err != nil {
+			http.Error(w, "User not found", http.StatusInternalServerError)
+			return
+		}
+
+		if !For(user).Allows(feature) {
+			DenyFeature(w, r, user, feature)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// DenyFeature shows the upgrade page for a feature the user's plan lacks
+func DenyFeature(w http.ResponseWriter, r *http.Request, user domain.User, feature Feature) {
+	Deny(w, r, user, feature.Name()+" are not included in the "+For(user).Name+" plan.")
+}
+
+// DenyArchived refuses changes to an archived wine. It reports whether the
+// request was refused.
+func DenyArchived(w http.ResponseWriter, r *http.Request, wine domain.Wine) bool {
+	if wine.ArchivedAt == nil {
+		return false
+	}
+	var user domain.User
+	if err := database.DB.First(&user, wine.UserID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return true
+	}
+	plan := For(user)
+	deny(w, r, user, fmt.Sprintf("%s is archived because your collection is over the %d wines of the %s plan. Archived wines are read-only until you upgrade or make this one of your active wines.", wine.Name, plan.MaxWines, plan.Name), true)
+	return true
+}
+
+// Deny shows the upgrade page with a 403 status, explaining why the request
+// was refused
+func Deny(w http.ResponseWriter, r *http.Request, user domain.User, reason string) {
+	deny(w, r, user, reason, false)
+}
+
+// deny renders the upgrade page, with a link to the archive page when the
+// request was about an archived wine
+func deny(w http.ResponseWriter, r *http.Request, user domain.User, reason string, archived bool) {
+	tmpl, err := template.New("upgrade.html").Funcs(ui.FuncMap).ParseFiles("templates/upgrade.html", "templates/header.html", "templates/footer.html", "templates/analytics.html")
+	if err != nil {
+		log.Printf("Could not load upgrade page: %v", err)
+		http.Error(w, reason, http.StatusForbidden)
+		return
+	}
+
+	data := struct {
+		Reason    string
+		Archived  bool
+		Current   Plan
+		Upgrade   Plan
+		LoggedIn  bool
+		UserEmail string
+		CSRFField template.HTML
+	}{
+		Reason:    reason,
+		Archived:  archived,
+		Current:   For(user),
+		Upgrade:   Pro,
+		LoggedIn:  true,
+		UserEmail: user.Email,
+		CSRFField: csrf.TemplateField(r),
+	}
+
+	w.WriteHeader(http.StatusForbidden)
+	tmpl.Execute(w, data)
+}
@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"wine-cellar/internal/domain"
+)
+
+// DBStore keeps entries in the database so that every instance of the app
+// sees the same counts
+type DBStore struct {
+	db *gorm.DB
+}
+
+func NewDBStore(db *gorm.DB) *DBStore {
+	return &DBStore{db: db}
+}
+
+func (s *DBStore) Fail(ctx context.Context, key string, now time.Time, window time.Duration) (Entry, error) {
+	// A single upsert, so that concurrent failures are all counted
+	err := s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"failures":        gorm.Expr("CASE WHEN rate_limit_entries.last_failure_at < ? THEN 1 ELSE rate_limit_entries.failures + 1 END", now.Add(-window)),
+			"last_failure_at": now,
+		}),
+	}).Create(&domain.RateLimitEntry{Key: key, Failures: 1, LastFailureAt: now}).Error
+	if err != nil {
+		return Entry{}, err
+	}
+	return s.Get(ctx, key)
+}
+
+func (s *DBStore) Get(ctx context.Context, key string) (Entry, error) {
+	var row domain.RateLimitEntry
+	err := s.db.WithContext(ctx).Where("key = ?", key).Take(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Entry{}, nil
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{Failures: row.Failures, LastFailure: row.LastFailureAt}, nil
+}
+
+func (s *DBStore) Reset(ctx context.Context, key string) error {
+	return s.db.WithContext(ctx).Where("key = ?", key).Delete(&domain.RateLimitEntry{}).Error
+}
+
+func (s *DBStore) Prune(ctx context.Context, cutoff time.Time) error {
+	return s.db.WithContext(ctx).Where("last_failure_at < ?", cutoff).Delete(&domain.RateLimitEntry{}).Error
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Store keeps failure counts per key. Implementations must make Fail atomic,
+// since several requests for the same key may arrive at once.
+type Store interface {
+	// Fail records a failure for key at now. Failures older than window are
+	// forgotten first, so the count starts again at 1.
+	Fail(ctx context.Context, key string, now time.Time, window time.Duration) (Entry, error)
+	Get(ctx context.Context, key string) (Entry, error)
+	Reset(ctx context.Context, key string) error
+	// Prune removes entries whose last failure is before cutoff
+	Prune(ctx context.Context, cutoff time.Time) error
+}
+
+// Entry is the failure history of one key
+type Entry struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+// Policy describes when a key is locked and for how long. After Threshold
+// failures the key is locked for BaseDelay, doubling with every further
+// failure up to MaxDelay. Failures are forgotten after Window without one.
+type Policy struct {
+	Threshold int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Window    time.Duration
+}
+
+// Delay is how long a key with the given number of failures stays locked
+func (p Policy) Delay(failures int) time.Duration {
+	if p.Threshold <= 0 || failures < p.Threshold {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.Threshold; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// Limiter applies a policy to the keys of a store. Keys should be prefixed
+// per use, e.g. "login:ip:203.0.113.7".
+type Limiter struct {
+	store  Store
+	policy Policy
+}
+
+func New(store Store, policy Policy) *Limiter {
+	return &Limiter{store: store, policy: policy}
+}
+
+// Policy returns the policy the limiter was created with
+func (l *Limiter) Policy() Policy {
+	return l.policy
+}
+
+// Locked returns how long key stays locked, or zero if it may try again
+func (l *Limiter) Locked(ctx context.Context, key string) (time.Duration, error) {
+	entry, err := l.store.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return l.retryAfter(entry, time.Now()), nil
+}
+
+// Fail records a failed attempt. It returns how long key is now locked and
+// whether this failure is the one that locked it.
+func (l *Limiter) Fail(ctx context.Context, key string) (time.Duration, bool, error) {
+	now := time.Now()
+	entry, err := l.store.Fail(ctx, key, now, l.policy.Window)
+	if err != nil {
+		return 0, false, err
+	}
+	return l.retryAfter(entry, now), entry.Failures == l.policy.Threshold, nil
+}
+
+// Reset forgets the failures of key, e.g. after a successful login
+func (l *Limiter) Reset(ctx context.Context, key string) error {
+	return l.store.Reset(ctx, key)
+}
+
+func (l *Limiter) retryAfter(entry Entry, now time.Time) time.Duration {
+	if now.Sub(entry.LastFailure) > l.policy.Window {
+		return 0
+	}
+	until := entry.LastFailure.Add(l.policy.Delay(entry.Failures))
+	if !until.After(now) {
+		return 0
+	}
+	return until.Sub(now)
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Storage is implemented by every image storage backend. Wines reference
+// images by key (e.g. "wines/42/<uuid>.jpg"); URL turns a key into
+// something a browser can load.
+type Storage interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Delete(ctx context.Context, key string) error
+	// List returns every object whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// Move renames an object, e.g. into quarantine
+	Move(ctx context.Context, from, to string) error
+	URL(key string) string
+}
+
+// Object describes a stored object
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+var backend Storage
+
+// Init selects the backend from STORAGE_DRIVER ("local", "s3" or "r2").
+// When unset, R2 is used if its credentials are present and the local
+// filesystem otherwise, except in production (see driverFromEnv).
+func Init() {
+	driver, err := driverFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch driver {
+	case "local":
+		backend, err = NewLocal(envOr("STORAGE_LOCAL_DIR", "uploads"), LocalURLPrefix)
+	case "s3":
+		backend, err = NewS3(S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          envOr("S3_REGION", "us-east-1"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			PublicURL:       os.Getenv("S3_PUBLIC_URL"),
+			UsePathStyle:    os.Getenv("S3_FORCE_PATH_STYLE") != "false",
+		})
+	case "r2":
+		backend, err = NewR2(
+			os.Getenv("R2_ACCOUNT_ID"),
+			os.Getenv("R2_ACCESS_KEY_ID"),
+			os.Getenv("R2_SECRET_ACCESS_KEY"),
+			os.Getenv("R2_BUCKET_NAME"),
+			os.Getenv("R2_PUBLIC_URL"),
+		)
+	default:
+		err = fmt.Errorf("unknown STORAGE_DRIVER %q", driver)
+	}
+	if err != nil {
+		log.Fatalf("Failed to initialize %s storage: %v", driver, err)
+	}
+
+	log.Printf("Image storage initialized (%s)", driver)
+}
+
+// driverFromEnv returns the driver Init uses. In production
+// (GO_ENV=production) the local filesystem must be chosen explicitly, since
+// hosts like Render wipe it on every deploy and the photos would be lost.
+func driverFromEnv() (string, error) {
+	if driver := os.Getenv("STORAGE_DRIVER"); driver != "" {
+		return driver, nil
+	}
+	if os.Getenv("R2_ACCOUNT_ID") != "" && os.Getenv("R2_BUCKET_NAME") != "" {
+		return "r2", nil
+	}
+	if os.Getenv("GO_ENV") == "production" {
+		return "", fmt.Errorf("STORAGE_DRIVER is not set and R2 is not configured; set STORAGE_DRIVER to r2 or s3, or to local only if the disk survives deploys")
+	}
+	return "local", nil
+}
+
+// Default returns the configured backend
+func Default() Storage {
+	return backend
+}
+
+// SaveImage stores an image for a user and returns its storage key
+func SaveImage(fileBytes []byte, contentType string, userID uint) (string, error) {
+	key := fmt.Sprintf("wines/%d/%s%s", userID, uuid.New().String(), GetExtensionFromContentType(contentType))
+	if err := backend.Put(context.TODO(), key, fileBytes, contentType); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// DeleteImage deletes the object behind an image reference. References that
+// do not point into our storage (data URIs, external URLs) are ignored.
+func DeleteImage(ref string) error {
+	key := KeyFromRef(ref)
+	if key == "" {
+		return nil
+	}
+	return backend.Delete(context.TODO(), key)
+}
+
+// KeyFromRef resolves an image reference to a storage key. References are
+// normally keys already; full URLs written before keys were introduced are
+// mapped back when they point at the configured backend.
+func KeyFromRef(ref string) string {
+	if ref == "" || strings.HasPrefix(ref, "data:") {
+		return ""
+	}
+	if IsKey(ref) {
+		return ref
+	}
+	if backend == nil {
+		return ""
+	}
+	if base := backend.URL(""); base != "" && strings.HasPrefix(ref, base) {
+		return strings.TrimPrefix(ref, base)
+	}
+	return ""
+}
+
+// IsKey reports whether ref is a bare storage key rather than a URL
+func IsKey(ref string) bool {
+	return ref != "" && !strings.Contains(ref, "://") && !strings.HasPrefix(ref, "/") && !strings.HasPrefix(ref, "data:")
+}
+
+// PublicURL returns a browser-loadable URL for an image reference
+func PublicURL(ref string) string {
+	if IsKey(ref) && backend != nil {
+		return backend.URL(ref)
+	}
+	return ref
+}
+
+// GetExtensionFromContentType returns the file extension for a content type
+func GetExtensionFromContentType(contentType string) string {
+	switch contentType {
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	default:
+		return ".jpg"
+	}
+}
+
+// GetContentTypeFromFilename returns the content type based on file extension
+func GetContentTypeFromFilename(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch ext {
+	case ".png":
+		return "image/png"
+	case ".gif":
+		return "image/gif"
+	case ".webp":
+		return "image/webp"
+	default:
+		return "image/jpeg"
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestDriverFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    string
+		wantErr bool
+	}{
+		{name: "default is local", want: "local"},
+		{name: "explicit driver", env: map[string]string{"STORAGE_DRIVER": "s3"}, want: "s3"},
+		{name: "r2 detected", env: map[string]string{"R2_ACCOUNT_ID": "acc", "R2_BUCKET_NAME": "b"}, want: "r2"},
+		{name: "production needs a driver", env: map[string]string{"GO_ENV": "production"}, wantErr: true},
+		{name: "production with r2", env: map[string]string{"GO_ENV": "production", "R2_ACCOUNT_ID": "acc", "R2_BUCKET_NAME": "b"}, want: "r2"},
+		{name: "production with explicit local", env: map[string]string{"GO_ENV": "production", "STORAGE_DRIVER": "local"}, want: "local"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"STORAGE_DRIVER", "R2_ACCOUNT_ID", "R2_BUCKET_NAME", "GO_ENV"} {
+				t.Setenv(key, tt.env[key])
+			}
+			got, err := driverFromEnv()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("driverFromEnv() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("driverFromEnv() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalContract(t *testing.T) {
+	local, err := NewLocal(t.TempDir(), LocalURLPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testContract(t, local, "contract/")
+}
+
+// TestS3ContractMinIO runs the driver contract against MinIO, e.g.
+//
+//	docker run -p 9000:9000 -e MINIO_ROOT_USER=minio -e MINIO_ROOT_PASSWORD=minio123 minio/minio server /data
+//	STORAGE_TEST_S3_ENDPOINT=http://localhost:9000 go test ./internal/shared/storage
+func TestS3ContractMinIO(t *testing.T) {
+	endpoint := os.Getenv("STORAGE_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("STORAGE_TEST_S3_ENDPOINT is not set")
+	}
+	bucket := envOr("STORAGE_TEST_S3_BUCKET", "winetrackr-test")
+	driver, err := NewS3(S3Config{
+		Endpoint:        endpoint,
+		Region:          "us-east-1",
+		AccessKeyID:     envOr("STORAGE_TEST_S3_ACCESS_KEY_ID", "minio"),
+		SecretAccessKey: envOr("STORAGE_TEST_S3_SECRET_ACCESS_KEY", "minio123"),
+		Bucket:          bucket,
+		UsePathStyle:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	_, err = driver.client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(bucket)})
+	var owned *types.BucketAlreadyOwnedByYou
+	if err != nil && !errors.As(err, &owned) {
+		t.Fatalf("create bucket: %v", err)
+	}
+
+	// A prefix of its own, so runs against a shared bucket don't collide
+	testContract(t, driver, fmt.Sprintf("contract-%d/", time.Now().UnixNano()))
+}
+
+// testContract checks the behaviour every driver must share. All keys are
+// created under prefix.
+func testContract(t *testing.T, store Storage, prefix string) {
+	t.Helper()
+	ctx := context.Background()
+
+	keys := []string{prefix + "wines/1/a.jpg", prefix + "wines/1/b b.png", prefix + "wines/2/c.jpg"}
+	for _, key := range keys {
+		if err := store.Put(ctx, key, []byte("data:"+key), "image/jpeg"); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+	}
+	// Overwriting keeps a single object
+	if err := store.Put(ctx, keys[0], []byte("new"), "image/jpeg"); err != nil {
+		t.Fatalf("Put overwrite: %v", err)
+	}
+
+	objects, err := store.List(ctx, prefix+"wines/1/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	got := objectKeys(objects)
+	if want := []string{keys[0], keys[1]}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("List(wines/1/) = %v, want %v", got, want)
+	}
+	for _, obj := range objects {
+		if obj.Key == keys[0] && obj.Size != int64(len("new")) {
+			t.Errorf("size of %s = %d, want %d", obj.Key, obj.Size, len("new"))
+		}
+		if obj.LastModified.IsZero() {
+			t.Errorf("%s has no modification time", obj.Key)
+		}
+	}
+
+	moved := prefix + "quarantine/wines/1/b b.png"
+	if err := store.Move(ctx, keys[1], moved); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	objects, err = store.List(ctx, prefix)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	got = objectKeys(objects)
+	want := []string{moved, keys[0], keys[2]}
+	sort.Strings(want)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("List after Move = %v, want %v", got, want)
+	}
+
+	if url := store.URL(keys[0]); !strings.HasSuffix(url, keys[0]) {
+		t.Errorf("URL(%q) = %q, want it to end with the key", keys[0], url)
+	}
+
+	for _, key := range []string{moved, keys[0], keys[2]} {
+		if err := store.Delete(ctx, key); err != nil {
+			t.Fatalf("Delete(%q): %v", key, err)
+		}
+	}
+	// Deleting a missing object is not an error
+	if err := store.Delete(ctx, keys[0]); err != nil {
+		t.Fatalf("Delete of a missing object: %v", err)
+	}
+	objects, err = store.List(ctx, prefix)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(objects) != 0 {
+		t.Fatalf("List after Delete = %v, want nothing", objectKeys(objects))
+	}
+}
+
+func objectKeys(objects []Object) []string {
+	keys := make([]string, len(objects))
+	for i, obj := range objects {
+		keys[i] = obj.Key
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -4,15 +4,16 @@ import (
 	"html/template"
 	"net/url"
 	"strings"
+
+	"wine-cellar/internal/shared/storage"
 )
 
 // FuncMap contains shared template functions
 var FuncMap = template.FuncMap{
-	"safeURL": func(s string) template.URL {
-		if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "mailto:") || strings.HasPrefix(s, "/") || strings.HasPrefix(s, "data:") {
-			return template.URL(s)
-		}
-		return template.URL("")
+	"safeURL": safeURL,
+	// imageURL resolves a wine image reference (storage key or legacy URL)
+	"imageURL": func(ref string) template.URL {
+		return safeURL(storage.PublicURL(ref))
 	},
 	"sortURL": func(base url.Values, field, currentSort, currentDirection string) string {
 		v := url.Values{}
@@ -31,3 +32,10 @@ var FuncMap = template.FuncMap{
 	},
 	"trim": strings.TrimSpace,
 }
+
+func safeURL(s string) template.URL {
+	if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "mailto:") || strings.HasPrefix(s, "/") || strings.HasPrefix(s, "data:") {
+		return template.URL(s)
+	}
+	return template.URL("")
+}
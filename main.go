@@ -9,22 +9,32 @@ import (
 	"os"
 	"strings"
 
+	"wine-cellar/internal/features/admin"
 	"wine-cellar/internal/features/auth"
+	"wine-cellar/internal/features/calendar"
+	"wine-cellar/internal/features/images"
 	"wine-cellar/internal/features/reviews/add"
 	deleteReview "wine-cellar/internal/features/reviews/delete"
 	editReview "wine-cellar/internal/features/reviews/edit"
 	"wine-cellar/internal/features/settings"
 	"wine-cellar/internal/features/subscription"
+	addTastingEvent "wine-cellar/internal/features/tastingevents/add"
+	deleteTastingEvent "wine-cellar/internal/features/tastingevents/delete"
 	addTastingNote "wine-cellar/internal/features/tastingnotes/add"
 	deleteTastingNote "wine-cellar/internal/features/tastingnotes/delete"
 	editTastingNote "wine-cellar/internal/features/tastingnotes/edit"
 	addWine "wine-cellar/internal/features/wines/add"
+	"wine-cellar/internal/features/wines/archive"
 	deleteWine "wine-cellar/internal/features/wines/delete"
 	"wine-cellar/internal/features/wines/details"
 	"wine-cellar/internal/features/wines/edit"
+	"wine-cellar/internal/features/wines/history"
 	"wine-cellar/internal/features/wines/list"
+	"wine-cellar/internal/features/wines/trash"
 	"wine-cellar/internal/features/wines/update"
 	"wine-cellar/internal/shared/database"
+	"wine-cellar/internal/shared/mailer"
+	"wine-cellar/internal/shared/plans"
 	"wine-cellar/internal/shared/storage"
 
 	"github.com/gorilla/csrf"
@@ -43,17 +53,42 @@ func main() {
 	// Initialize Auth (Session Store)
 	auth.Init()
 
-	// Initialize R2 Storage
+	// Initialize Mailer
+	mailer.Init()
+
+	// Initialize Image Storage
 	storage.Init()
 
 	database.InitDB()
 	database.Seed(database.DB)
 
+	// Brute-force protection, may keep its counts in the database
+	auth.InitRateLimits()
+
+	// Background jobs
+	images.ScheduleGarbageCollection()
+	settings.ScheduleAccountErasure()
+	trash.ScheduleAutoPurge()
+	auth.ScheduleSessionPruning()
+	subscription.ScheduleGrantExpiry()
+	subscription.ScheduleDunning()
+	subscription.ScheduleReconciliation()
+	subscription.BackfillPrices()
+
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/signup", auth.SignupHandler)
 	mux.HandleFunc("/login", auth.LoginHandler)
+	mux.HandleFunc("/login/2fa", auth.LoginTwoFactorHandler)
+	mux.HandleFunc("/passkeys/login/begin", auth.BeginPasskeyLoginHandler)
+	mux.HandleFunc("/passkeys/login/finish", auth.FinishPasskeyLoginHandler)
+	mux.HandleFunc("/oidc/login/", auth.OIDCLoginHandler)
+	mux.HandleFunc("/oidc/callback/", auth.OIDCCallbackHandler)
 	mux.HandleFunc("/logout", auth.LogoutHandler)
+	mux.HandleFunc("/forgot-password", auth.ForgotPasswordHandler)
+	mux.HandleFunc("/reset-password", auth.ResetPasswordHandler)
+	mux.HandleFunc("/verify-email", auth.VerifyEmailHandler)
+	mux.HandleFunc("/verify-email/resend", auth.Middleware(auth.ResendVerificationHandler))
 
 	mux.HandleFunc("/privacy", func(w http.ResponseWriter, r *http.Request) {
 		tmpl, err := template.ParseFiles("templates/privacy.html", "templates/header.html", "templates/footer.html", "templates/analytics.html")
@@ -117,26 +152,63 @@ func main() {
 	mux.HandleFunc("/details/", auth.Middleware(details.Handler))
 	mux.HandleFunc("/edit/", auth.Middleware(edit.Handler))
 	mux.HandleFunc("/update-quantity", auth.Middleware(update.QuantityHandler))
-	mux.HandleFunc("/add-review", auth.Middleware(add.Handler))
+	mux.HandleFunc("/revert-wine", auth.Middleware(history.RevertHandler))
+	mux.HandleFunc("/add-review", auth.Middleware(plans.Require(plans.Reviews, add.Handler)))
 	mux.HandleFunc("/delete-review", auth.Middleware(deleteReview.Handler))
-	mux.HandleFunc("/edit-review", auth.Middleware(editReview.Handler))
-	mux.HandleFunc("/add-tasting-note", auth.Middleware(addTastingNote.Handler))
-	mux.HandleFunc("/delete-tasting-note", auth.Middleware(deleteTastingNote.Handler))
-	mux.HandleFunc("/edit-tasting-note", auth.Middleware(editTastingNote.Handler))
+	mux.HandleFunc("/edit-review", auth.Middleware(plans.Require(plans.Reviews, editReview.Handler)))
+	mux.HandleFunc("/add-tasting-note", auth.Middleware(plans.Require(plans.TastingNotes, addTastingNote.Handler)))
+	mux.HandleFunc("/delete-tasting-note", auth.Middleware(plans.Require(plans.TastingNotes, deleteTastingNote.Handler)))
+	mux.HandleFunc("/edit-tasting-note", auth.Middleware(plans.Require(plans.TastingNotes, editTastingNote.Handler)))
+	mux.HandleFunc("/add-tasting-event", auth.Middleware(addTastingEvent.Handler))
+	mux.HandleFunc("/delete-tasting-event", auth.Middleware(deleteTastingEvent.Handler))
 	mux.HandleFunc("/settings", auth.Middleware(settings.Handler))
+	mux.HandleFunc("/settings/2fa", auth.Middleware(auth.TwoFactorSettingsHandler))
+	mux.HandleFunc("/passkeys/register/begin", auth.Middleware(auth.BeginPasskeyRegistrationHandler))
+	mux.HandleFunc("/passkeys/register/finish", auth.Middleware(auth.FinishPasskeyRegistrationHandler))
+	mux.HandleFunc("/sessions/revoke", auth.Middleware(auth.RevokeSessionHandler))
+	mux.HandleFunc("/sessions/revoke-others", auth.Middleware(auth.RevokeOtherSessionsHandler))
+	mux.HandleFunc("/passkeys/rename", auth.Middleware(auth.RenamePasskeyHandler))
+	mux.HandleFunc("/passkeys/delete", auth.Middleware(auth.DeletePasskeyHandler))
+	mux.HandleFunc("/calendar-token", auth.Middleware(auth.RequireVerified(calendar.TokenHandler)))
+	mux.HandleFunc("/calendar/", calendar.FeedHandler)
 	mux.HandleFunc("/export", auth.Middleware(settings.ExportHandler))
 	mux.HandleFunc("/delete-account", auth.Middleware(settings.DeleteAccountHandler))
+	mux.HandleFunc("/cancel-account-deletion", auth.Middleware(settings.CancelDeletionHandler))
 	mux.HandleFunc("/delete", auth.Middleware(deleteWine.Handler))
+	mux.HandleFunc("/trash", auth.Middleware(trash.Handler))
+	mux.HandleFunc("/trash/restore", auth.Middleware(trash.RestoreHandler))
+	mux.HandleFunc("/trash/purge", auth.Middleware(trash.PurgeHandler))
+	mux.HandleFunc("/archive", auth.Middleware(archive.Handler))
 	mux.HandleFunc("/delete-photo", auth.Middleware(edit.DeletePhotoHandler))
-	mux.HandleFunc("/create-checkout-session", auth.Middleware(subscription.CreateCheckoutSession))
+	mux.HandleFunc("/create-checkout-session", auth.Middleware(auth.RequireVerified(subscription.CreateCheckoutSession)))
+	mux.HandleFunc("/subscription/checkout/canceled", auth.Middleware(subscription.CheckoutCanceledHandler))
 	mux.HandleFunc("/create-portal-session", auth.Middleware(subscription.CreatePortalSession))
+	mux.HandleFunc("/subscription/switch", auth.Middleware(subscription.SwitchPriceHandler))
+	mux.HandleFunc("/pricing", subscription.PricingHandler)
+	if fake := subscription.Fake(); fake != nil {
+		mux.HandleFunc("/fake-billing/checkout", auth.Middleware(fake.CheckoutHandler))
+		mux.HandleFunc("/fake-billing/portal", auth.Middleware(fake.PortalHandler))
+		mux.HandleFunc("/fake-billing/invoice", auth.Middleware(fake.InvoiceHandler))
+	}
 	mux.HandleFunc("/webhook/stripe", subscription.WebhookHandler)
+	mux.HandleFunc("/admin", auth.Middleware(admin.Require(admin.Handler)))
+	mux.HandleFunc("/admin/users/", auth.Middleware(admin.Require(admin.UserHandler)))
+	mux.HandleFunc("/admin/audit", auth.Middleware(admin.Require(admin.AuditHandler)))
+	mux.HandleFunc("/admin/grant", auth.Middleware(admin.Require(admin.GrantHandler)))
+	mux.HandleFunc("/admin/grant/end", auth.Middleware(admin.Require(admin.EndGrantHandler)))
+	mux.HandleFunc("/admin/disable", auth.Middleware(admin.Require(admin.DisableHandler)))
+	mux.HandleFunc("/admin/enable", auth.Middleware(admin.Require(admin.EnableHandler)))
+	mux.HandleFunc("/admin/impersonate", auth.Middleware(admin.Require(admin.ImpersonateHandler)))
+	mux.HandleFunc("/admin/impersonate/stop", auth.Middleware(admin.StopImpersonationHandler))
 	mux.HandleFunc("/health", healthHandler)
 
 	// Serve static files
 	fs := http.FileServer(http.Dir("static"))
 	mux.Handle("/static/", http.StripPrefix("/static/", fs))
 
+	// Serve uploaded images when using the local storage driver
+	mux.Handle(storage.LocalURLPrefix, storage.Handler())
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -225,7 +297,7 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func landingHandler(w http.ResponseWriter, r *http.Request) {
-	tmpl, err := template.New("landing.html").Funcs(funcMap).ParseFiles("templates/landing.html", "templates/header.html", "templates/footer.html", "templates/analytics.html")
+	tmpl, err := template.New("landing.html").Funcs(funcMap).ParseFiles("templates/landing.html", "templates/header.html", "templates/footer.html", "templates/analytics.html", "templates/pricing_plans.html")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -234,9 +306,11 @@ func landingHandler(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		LoggedIn  bool
 		UserEmail string
+		Pricing   subscription.Pricing
 	}{
 		LoggedIn:  false,
 		UserEmail: "",
+		Pricing:   subscription.PricingFor(r.URL.Query().Get("currency")),
 	}
 
 	tmpl.Execute(w, data)
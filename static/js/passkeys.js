@@ -0,0 +1,104 @@
+// Passkey registration (settings) and login (login page) using WebAuthn.
+// The server sends and expects binary fields as base64url strings.
+(function () {
+  if (!window.PublicKeyCredential) {
+    return;
+  }
+
+  function decode(value) {
+    var base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+    var binary = atob(base64.padEnd(base64.length + (4 - base64.length % 4) % 4, "="));
+    return Uint8Array.from(binary, function (c) { return c.charCodeAt(0); }).buffer;
+  }
+
+  function encode(buffer) {
+    var binary = String.fromCharCode.apply(null, new Uint8Array(buffer));
+    return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+  }
+
+  function post(url, csrfToken, body) {
+    return fetch(url, {
+      method: "POST",
+      credentials: "same-origin",
+      headers: { "Content-Type": "application/json", "X-CSRF-Token": csrfToken },
+      body: body ? JSON.stringify(body) : null
+    }).then(function (response) {
+      if (!response.ok) {
+        return response.text().then(function (text) { throw new Error(text.trim()); });
+      }
+      return response.json();
+    });
+  }
+
+  function showError(err) {
+    var el = document.getElementById("passkey-error");
+    if (!el || (err && err.name === "NotAllowedError")) {
+      return; // Cancelled by the user
+    }
+    el.textContent = (err && err.message) || "Something went wrong, please try again.";
+    el.classList.remove("hidden");
+  }
+
+  function register(button) {
+    var name = prompt("Name this passkey, e.g. the device it is on:", "");
+    if (name === null) {
+      return;
+    }
+    var csrfToken = button.dataset.csrf;
+    post("/passkeys/register/begin", csrfToken).then(function (options) {
+      var publicKey = options.publicKey;
+      publicKey.challenge = decode(publicKey.challenge);
+      publicKey.user.id = decode(publicKey.user.id);
+      (publicKey.excludeCredentials || []).forEach(function (c) { c.id = decode(c.id); });
+      return navigator.credentials.create({ publicKey: publicKey });
+    }).then(function (credential) {
+      return post("/passkeys/register/finish?name=" + encodeURIComponent(name), csrfToken, {
+        id: credential.id,
+        rawId: encode(credential.rawId),
+        type: credential.type,
+        response: {
+          clientDataJSON: encode(credential.response.clientDataJSON),
+          attestationObject: encode(credential.response.attestationObject),
+          transports: credential.response.getTransports ? credential.response.getTransports() : []
+        }
+      });
+    }).then(function () {
+      window.location.reload();
+    }).catch(showError);
+  }
+
+  function login(button) {
+    var csrfToken = button.dataset.csrf;
+    post("/passkeys/login/begin", csrfToken).then(function (options) {
+      var publicKey = options.publicKey;
+      publicKey.challenge = decode(publicKey.challenge);
+      (publicKey.allowCredentials || []).forEach(function (c) { c.id = decode(c.id); });
+      return navigator.credentials.get({ publicKey: publicKey });
+    }).then(function (assertion) {
+      return post("/passkeys/login/finish", csrfToken, {
+        id: assertion.id,
+        rawId: encode(assertion.rawId),
+        type: assertion.type,
+        response: {
+          clientDataJSON: encode(assertion.response.clientDataJSON),
+          authenticatorData: encode(assertion.response.authenticatorData),
+          signature: encode(assertion.response.signature),
+          userHandle: assertion.response.userHandle ? encode(assertion.response.userHandle) : null
+        }
+      });
+    }).then(function (result) {
+      window.location.href = result.redirect || "/";
+    }).catch(showError);
+  }
+
+  var addButton = document.getElementById("add-passkey");
+  if (addButton) {
+    addButton.addEventListener("click", function () { register(addButton); });
+  }
+
+  var loginButton = document.getElementById("passkey-login-button");
+  if (loginButton) {
+    document.getElementById("passkey-login").classList.remove("hidden");
+    loginButton.addEventListener("click", function () { login(loginButton); });
+  }
+})();